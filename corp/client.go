@@ -7,12 +7,14 @@ package corp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"reflect"
+	"time"
 
 	wechatjson "github.com/philsong/wechat2/json"
+	"github.com/philsong/wechat2/util"
 )
 
 // 企业号"主动"请求功能的基本封装.
@@ -21,6 +23,44 @@ type CorpClient struct {
 
 	TokenServer TokenServer
 	HttpClient  *http.Client
+	Endpoint    *Endpoint // 如果 Endpoint == nil 则使用 DefaultEndpoint
+
+	// API 调用的拦截器, Interceptors[0] 在最外层, 参考 Interceptor.
+	//  拦截器包裹的是一次完整的 API 调用, 包括 access_token 失效的重试.
+	Interceptors []Interceptor
+
+	// 输出 API 调用的日志(api, errcode, latency 等, 不包含 access_token), 如果 Logger == nil 则不输出.
+	Logger util.Logger
+
+	ctx context.Context // 通过 WithContext 设置, 参考 http.Request.WithContext
+}
+
+// 获取 CorpClient 的 context.
+//  如果没有通过 WithContext 设置, 则返回 context.Background().
+func (clt *CorpClient) Context() context.Context {
+	if clt.ctx != nil {
+		return clt.ctx
+	}
+	return context.Background()
+}
+
+// 返回 clt 的一个浅拷贝, 该拷贝发起的所有请求都绑定到 ctx 上;
+// ctx 取消或者超时后, 正在进行的 http 请求和 access_token 失效重试都会中止.
+func (clt *CorpClient) WithContext(ctx context.Context) *CorpClient {
+	if ctx == nil {
+		panic("corp: nil context")
+	}
+	clt2 := *clt
+	clt2.ctx = ctx
+	return &clt2
+}
+
+// 根据 clt.Endpoint 返回 rawURL 最终的地址, 如果 clt.Endpoint == nil 则根据 DefaultEndpoint.
+func (clt *CorpClient) ResolveURL(rawURL string) string {
+	if clt.Endpoint != nil {
+		return clt.Endpoint.ResolveURL(rawURL)
+	}
+	return DefaultEndpoint.ResolveURL(rawURL)
 }
 
 // 获取 access_token.
@@ -73,19 +113,114 @@ func (clt *CorpClient) getNewToken() (token string, err error) {
 //
 //  NOTE:
 //  1. 一般不用调用这个方法, 请直接调用高层次的封装方法;
-//  2. 最终的 URL == incompleteURL + access_token;
-//  3. response 要求是 struct 的指针, 并且该 struct 拥有属性:
-//     ErrCode int `json:"errcode"` (可以是直接属性, 也可以是匿名属性里的属性)
-func (clt *CorpClient) PostJSON(incompleteURL string, request interface{}, response interface{}) (err error) {
+//  2. 最终的 URL == clt.ResolveURL(incompleteURL) + access_token;
+//  3. response 一般是嵌入了 Error 的 struct 的指针, 参考 Response;
+//     不需要解析的回复可以用 *RawResponse 原样保存.
+func (clt *CorpClient) PostJSON(incompleteURL string, request interface{}, response Response) (err error) {
+	return clt.PostJSONContext(clt.Context(), incompleteURL, request, response)
+}
+
+// 同 PostJSON, 请求绑定到 ctx 上.
+func (clt *CorpClient) PostJSONContext(ctx context.Context, incompleteURL string,
+	request interface{}, response Response) (err error) {
+
+	call := &Call{
+		URL:      incompleteURL,
+		Method:   "POST",
+		Request:  request,
+		Response: response,
+	}
+	return clt.doJSON(ctx, call, nil)
+}
+
+// GET 微信资源, 然后将微信服务器返回的 JSON 用 encoding/json 解析到 response.
+//
+//  NOTE:
+//  1. 一般不用调用这个方法, 请直接调用高层次的封装方法;
+//  2. 最终的 URL == clt.ResolveURL(incompleteURL) + access_token;
+//  3. response 一般是嵌入了 Error 的 struct 的指针, 参考 Response;
+//     不需要解析的回复可以用 *RawResponse 原样保存.
+func (clt *CorpClient) GetJSON(incompleteURL string, response Response) (err error) {
+	return clt.GetJSONContext(clt.Context(), incompleteURL, response)
+}
+
+// 同 GetJSON, 请求绑定到 ctx 上.
+func (clt *CorpClient) GetJSONContext(ctx context.Context, incompleteURL string, response Response) (err error) {
+	newRequest := func(finalURL string) (*http.Request, error) {
+		return http.NewRequest("GET", finalURL, nil)
+	}
+	call := &Call{
+		URL:      incompleteURL,
+		Method:   "GET",
+		Response: response,
+	}
+	return clt.doJSON(ctx, call, newRequest)
+}
+
+// 经过 clt.Interceptors 执行 call, 参考 invoke.
+//  如果 newRequest == nil 则 POST call.Request marshal 后的 JSON, 参考 invokePostJSON.
+func (clt *CorpClient) doJSON(ctx context.Context, call *Call,
+	newRequest func(finalURL string) (*http.Request, error)) (err error) {
+
+	call.API = apiPath(call.URL)
+	if call.Header == nil {
+		call.Header = make(http.Header)
+	}
+
+	var invoker Invoker = func(ctx context.Context, call *Call) error {
+		if newRequest == nil {
+			return clt.invokePostJSON(ctx, call)
+		}
+		return clt.invoke(ctx, call, newRequest)
+	}
+	if len(clt.Interceptors) > 0 {
+		invoker = chainInterceptors(clt.Interceptors, invoker)
+	}
+	if clt.Logger == nil {
+		return invoker(ctx, call)
+	}
+
+	start := time.Now()
+	err = invoker(ctx, call)
+	logAPICall(clt.Logger, call, start, err)
+	return
+}
+
+// 用 encoding/json 把 call.Request marshal 为 JSON, 然后 POST 到微信服务器, 参考 invoke.
+//  在所有拦截器之后才 marshal, 所以拦截器对 call.Request 的修改(或者替换)也会生效.
+func (clt *CorpClient) invokePostJSON(ctx context.Context, call *Call) (err error) {
 	buf := textBufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer textBufferPool.Put(buf)
 
-	if err = wechatjson.NewEncoder(buf).Encode(request); err != nil {
+	if err = wechatjson.NewEncoder(buf).Encode(call.Request); err != nil {
 		return
 	}
 	requestBytes := buf.Bytes()
 
+	newRequest := func(finalURL string) (*http.Request, error) {
+		httpReq, err := http.NewRequest("POST", finalURL, bytes.NewReader(requestBytes))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json; charset=utf-8")
+		return httpReq, nil
+	}
+	return clt.invoke(ctx, call, newRequest)
+}
+
+// 发送 newRequest 创建的请求, 然后将微信服务器返回的 JSON 用 encoding/json 解析到 call.Response;
+// 如果 access_token 失效则获取新的 access_token 重试一次.
+//  NOTE: 每次调用 newRequest 都要返回一个新的 *http.Request, 重试的时候会再次调用.
+func (clt *CorpClient) invoke(ctx context.Context, call *Call,
+	newRequest func(finalURL string) (*http.Request, error)) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	response := call.Response
+	incompleteURL := clt.ResolveURL(call.URL)
+
 	token, err := clt.Token()
 	if err != nil {
 		return
@@ -93,42 +228,30 @@ func (clt *CorpClient) PostJSON(incompleteURL string, request interface{}, respo
 
 	hasRetried := false
 RETRY:
-	finalURL := incompleteURL + token
-
-	httpResp, err := clt.HttpClient.Post(finalURL, "application/json; charset=utf-8", bytes.NewReader(requestBytes))
+	httpReq, err := newRequest(incompleteURL + token)
 	if err != nil {
 		return
 	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http.Status: %s", httpResp.Status)
+	for key, values := range call.Header {
+		httpReq.Header[key] = values
 	}
-
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
+	*response.APIError() = Error{} // 成功的回复可能没有 errcode 字段, 重试前要清除上次的错误码
+	if err = clt.roundTrip(httpReq.WithContext(ctx), response); err != nil {
 		return
 	}
 
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
+	apiErr := response.APIError()
+	switch apiErr.ErrCode {
 	case ErrCodeOK:
 		return
 	case ErrCodeTimeout, ErrCodeInvalidCredential:
 		if !hasRetried {
 			hasRetried = true
 
+			// ctx 已经取消则不再重试
+			if err = ctx.Err(); err != nil {
+				return
+			}
 			if token, err = clt.getNewToken(); err != nil {
 				return
 			}
@@ -140,24 +263,9 @@ RETRY:
 	}
 }
 
-// GET 微信资源, 然后将微信服务器返回的 JSON 用 encoding/json 解析到 response.
-//
-//  NOTE:
-//  1. 一般不用调用这个方法, 请直接调用高层次的封装方法;
-//  2. 最终的 URL == incompleteURL + access_token;
-//  3. response 要求是 struct 的指针, 并且该 struct 拥有属性:
-//     ErrCode int `json:"errcode"` (可以是直接属性, 也可以是匿名属性里的属性)
-func (clt *CorpClient) GetJSON(incompleteURL string, response interface{}) (err error) {
-	token, err := clt.Token()
-	if err != nil {
-		return
-	}
-
-	hasRetried := false
-RETRY:
-	finalURL := incompleteURL + token
-
-	httpResp, err := clt.HttpClient.Get(finalURL)
+// 执行一次 http 请求, 并将返回的 JSON 解析到 response.
+func (clt *CorpClient) roundTrip(httpReq *http.Request, response Response) (err error) {
+	httpResp, err := clt.HttpClient.Do(httpReq)
 	if err != nil {
 		return
 	}
@@ -167,37 +275,5 @@ RETRY:
 		return fmt.Errorf("http.Status: %s", httpResp.Status)
 	}
 
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
-		return
-	}
-
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
-	case ErrCodeOK:
-		return
-	case ErrCodeTimeout, ErrCodeInvalidCredential:
-		if !hasRetried {
-			hasRetried = true
-
-			if token, err = clt.getNewToken(); err != nil {
-				return
-			}
-			goto RETRY
-		}
-		fallthrough
-	default:
-		return
-	}
+	return json.NewDecoder(httpResp.Body).Decode(response)
 }
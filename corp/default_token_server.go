@@ -22,6 +22,7 @@ var _ TokenServer = new(DefaultTokenServer)
 type DefaultTokenServer struct {
 	corpId, corpSecret string
 	httpClient         *http.Client
+	endpoint           *Endpoint
 
 	// 缓存最后一次从微信服务器获取的 access_token 的结果.
 	currentToken struct {
@@ -41,14 +42,26 @@ type DefaultTokenServer struct {
 func NewDefaultTokenServer(corpId, corpSecret string,
 	httpClient *http.Client) (srv *DefaultTokenServer) {
 
+	return NewDefaultTokenServerWithEndpoint(corpId, corpSecret, httpClient, nil)
+}
+
+// 同 NewDefaultTokenServer, 通过 endpoint 获取 access_token, 一般和 WechatClient.Endpoint 相同.
+//  如果 endpoint == nil 则使用 DefaultEndpoint.
+func NewDefaultTokenServerWithEndpoint(corpId, corpSecret string,
+	httpClient *http.Client, endpoint *Endpoint) (srv *DefaultTokenServer) {
+
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
+	if endpoint == nil {
+		endpoint = DefaultEndpoint
+	}
 
 	srv = &DefaultTokenServer{
 		corpId:     corpId,
 		corpSecret: corpSecret,
 		httpClient: httpClient,
+		endpoint:   endpoint,
 	}
 
 	// 获取 access_token
@@ -108,8 +121,8 @@ type tokenResponse struct {
 
 // 从微信服务器获取 access_token.
 func (srv *DefaultTokenServer) getToken() (resp *tokenResponse, err error) {
-	url := "https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=" + srv.corpId +
-		"&corpsecret=" + srv.corpSecret
+	url := srv.endpoint.ResolveURL("https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=" + srv.corpId +
+		"&corpsecret=" + srv.corpSecret)
 
 	httpResp, err := srv.httpClient.Get(url)
 	if err != nil {
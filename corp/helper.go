@@ -43,18 +43,26 @@ func WriteResponse(w http.ResponseWriter, r *Request, msg interface{}) (err erro
 		return
 	}
 
-	EncryptedMsg := util.AESEncryptMsg(r.Random, MsgRawXML, r.CorpId, r.AESKey)
+	responseHttpBody := newResponseHttpBody(MsgRawXML, r.Random, r.CorpId, r.AESKey,
+		r.AgentToken, r.TimeStamp, r.Nonce)
+	return xml.NewEncoder(w).Encode(responseHttpBody)
+}
+
+// 加密 MsgRawXML 并签名, 得到回复消息的 http body.
+func newResponseHttpBody(MsgRawXML, random []byte, CorpId string, AESKey [32]byte,
+	token string, timestamp int64, nonce string) *ResponseHttpBody {
+
+	EncryptedMsg := util.AESEncryptMsg(random, MsgRawXML, CorpId, AESKey)
 	base64EncryptedMsg := base64.StdEncoding.EncodeToString(EncryptedMsg)
 
-	responseHttpBody := ResponseHttpBody{
+	responseHttpBody := &ResponseHttpBody{
 		EncryptedMsg: base64EncryptedMsg,
-		TimeStamp:    r.TimeStamp,
-		Nonce:        r.Nonce,
+		TimeStamp:    timestamp,
+		Nonce:        nonce,
 	}
 
 	TimestampStr := strconv.FormatInt(responseHttpBody.TimeStamp, 10)
-	responseHttpBody.MsgSignature = util.MsgSign(r.AgentToken, TimestampStr,
+	responseHttpBody.MsgSignature = util.MsgSign(token, TimestampStr,
 		responseHttpBody.Nonce, responseHttpBody.EncryptedMsg)
-
-	return xml.NewEncoder(w).Encode(&responseHttpBody)
+	return responseHttpBody
 }
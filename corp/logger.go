@@ -0,0 +1,44 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package corp
+
+import (
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+// AgentServer 实现了这个接口则 ServeHTTP 通过它输出日志, 参考 DefaultAgentServer.SetLogger.
+//  ServeHTTP 只输出 corpid, agentid, userid, msgtype, event, latency 等字段, 不会输出消息的内容和签名.
+type LoggerProvider interface {
+	Logger() util.Logger // 返回 nil 表示不输出日志
+}
+
+// 获取 agentServer 的 Logger, 没有则返回 util.NopLogger.
+func serverLogger(agentServer AgentServer) util.Logger {
+	if provider, ok := agentServer.(LoggerProvider); ok {
+		if logger := provider.Logger(); logger != nil {
+			return logger
+		}
+	}
+	return util.NopLogger
+}
+
+// 输出一条 MessageHandler 处理完消息的 Debug 日志.
+func logMessageServed(logger util.Logger, r *Request, start time.Time) {
+	util.LogMessageServed(logger, start,
+		util.LogField{Key: "corpid", Value: r.CorpId},
+		util.LogField{Key: "agentid", Value: r.AgentId},
+		util.LogField{Key: "userid", Value: r.MixedMsg.FromUserName},
+		util.LogField{Key: "msgtype", Value: r.MixedMsg.MsgType},
+		util.LogField{Key: "event", Value: r.MixedMsg.Event},
+	)
+}
+
+// 输出一次 API 调用的日志, 参考 util.LogAPICall.
+func logAPICall(logger util.Logger, call *Call, start time.Time, err error) {
+	util.LogAPICall(logger, call.API, call.Method, start, call.Response.APIError().ErrCode, err)
+}
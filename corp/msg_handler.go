@@ -8,6 +8,8 @@ package corp
 import (
 	"io"
 	"net/http"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 微信服务器推送过来的消息(事件)处理接口
@@ -58,6 +60,8 @@ type Request struct {
 	CorpId     string
 	AgentId    int64
 	AgentToken string
+
+	logger util.Logger // 输出 ReplyHandlerFunc 的错误, ServeHTTP 设置为 AgentServer 的 Logger
 }
 
 // 微信服务器推送过来的消息(事件)通用的消息头
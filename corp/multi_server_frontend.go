@@ -6,10 +6,11 @@
 package corp
 
 import (
-	"fmt"
 	"net/http"
-	"net/url"
 	"sync"
+	"time"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 回调 URL 上索引 AgentServer 的 key 的名称.
@@ -17,12 +18,29 @@ import (
 //  http://www.xxx.com/?agent_server=agent1&msg_signature=XXX&timestamp=123456789&nonce=12345678
 const URLQueryAgentServerKeyName = "agent_server"
 
+// 默认从回调 URL 的查询参数 URLQueryAgentServerKeyName 提取 key.
+var defaultAgentServerKeyExtractor = util.QueryServerKey(URLQueryAgentServerKeyName)
+
+// MultiAgentServerFrontend 找不到 serverKey 对应的 AgentServer 的时候, 用来加载(比如从配置中心) AgentServer.
+type AgentServerResolver interface {
+	// 返回 serverKey 对应的 AgentServer, server == nil && err == nil 表示不存在.
+	ResolveAgentServer(serverKey string) (server AgentServer, err error)
+}
+
+var _ AgentServerResolver = AgentServerResolverFunc(nil)
+
+type AgentServerResolverFunc func(serverKey string) (server AgentServer, err error)
+
+func (fn AgentServerResolverFunc) ResolveAgentServer(serverKey string) (server AgentServer, err error) {
+	return fn(serverKey)
+}
+
 // 多个 AgentServer 的前端, 负责处理 http 请求, net/http.Handler 的实现
 //
 //  NOTE:
-//  MultiAgentServerFrontend 可以处理多个企业号应用的消息（事件），但是要求在回调 URL 上加上一个
-//  查询参数，参考常量 URLQueryAgentServerKeyName，这个参数的值就是 MultiAgentServerFrontend
-//  索引 AgentServer 的 key。
+//  MultiAgentServerFrontend 可以处理多个企业号应用的消息（事件），但是要求能从回调请求中提取出一个 key，
+//  MultiAgentServerFrontend 根据这个 key 索引 AgentServer。默认是回调 URL 上的一个查询参数，
+//  参考常量 URLQueryAgentServerKeyName，也可以通过 SetServerKeyExtractor 从 path, host, header 中提取。
 //
 //  例如回调 URL 为 http://www.xxx.com/weixin?agent_server=1234567890，那么就可以在后端调用
 //
@@ -30,11 +48,22 @@ const URLQueryAgentServerKeyName = "agent_server"
 //
 //  来增加一个 AgentServer 来处理 agent_server=1234567890 的消息（事件）。
 //
+//  如果回调 URL 为 http://www.xxx.com/wx/1234567890，那么可以设置
+//
+//    MultiAgentServerFrontend.SetServerKeyExtractor(util.PathServerKey("/wx/"))
+//
+//  还可以通过 SetAgentServerResolver 设置 AgentServerResolver，在找不到 key 对应的 AgentServer
+//  的时候加载并且缓存 AgentServer。
+//
 //  MultiAgentServerFrontend 并发安全，可以在运行中动态增加和删除 AgentServer。
 type MultiAgentServerFrontend struct {
 	rwmutex               sync.RWMutex
-	agentServerMap        map[string]AgentServer
 	invalidRequestHandler InvalidRequestHandler
+	logger                util.Logger
+	serverKeyExtractor    util.ServerKeyExtractor
+	writeStatusCode       bool
+	allowHEAD             bool
+	registry              util.ServerRegistry
 }
 
 // 设置 InvalidRequestHandler, 如果 handler == nil 则使用默认的 DefaultInvalidRequestHandler
@@ -49,83 +78,111 @@ func (frontend *MultiAgentServerFrontend) SetInvalidRequestHandler(handler Inval
 	}
 }
 
-// 设置 serverKey-AgentServer pair.
-// 如果 serverKey == "" 或者 server == nil 则不做任何操作
-func (frontend *MultiAgentServerFrontend) SetAgentServer(serverKey string, server AgentServer) {
-	if serverKey == "" {
-		return
-	}
-	if server == nil {
+// 设置 Logger, 用于输出 frontend 本身拒绝的请求(比如找不到 AgentServer)的日志, logger == nil 表示不输出(默认).
+//  AgentServer 处理请求的日志由 AgentServer 自己的 Logger 输出, 参考 LoggerProvider.
+func (frontend *MultiAgentServerFrontend) SetLogger(logger util.Logger) {
+	frontend.rwmutex.Lock()
+	frontend.logger = logger
+	frontend.rwmutex.Unlock()
+}
+
+// 设置从回调请求中提取 serverKey 的 ServerKeyExtractor, 比如 util.PathServerKey, util.HostServerKey,
+// util.HeaderServerKey; extractor == nil 表示使用默认的查询参数 URLQueryAgentServerKeyName.
+func (frontend *MultiAgentServerFrontend) SetServerKeyExtractor(extractor util.ServerKeyExtractor) {
+	frontend.rwmutex.Lock()
+	frontend.serverKeyExtractor = extractor
+	frontend.rwmutex.Unlock()
+}
+
+// 设置 AgentServerResolver, resolver == nil 表示不加载(默认).
+//  找不到 serverKey 对应的 AgentServer 的时候调用 resolver 加载, 加载成功的 AgentServer 会通过
+//  SetAgentServer 缓存起来, 后面的请求不再调用 resolver; 同一个 serverKey 同时只会调用一次 resolver;
+//  resolver 返回的错误对应 503, 参考 SetWriteStatusCode.
+func (frontend *MultiAgentServerFrontend) SetAgentServerResolver(resolver AgentServerResolver) {
+	if resolver == nil {
+		frontend.registry.SetResolver(nil)
 		return
 	}
+	frontend.registry.SetResolver(func(serverKey string) (interface{}, error) {
+		return resolver.ResolveAgentServer(serverKey) // nil 的接口值转换为 interface{} 还是 nil
+	})
+}
 
+// 设置 AgentServerResolver 返回不存在(nil, nil)的 serverKey 的缓存时间, 缓存期间同一个 serverKey 的请求直接返回 404,
+// 不再调用 AgentServerResolver; ttl == 0 表示使用 util.DefaultNotFoundCacheTTL(默认), ttl < 0 表示不缓存.
+func (frontend *MultiAgentServerFrontend) SetNotFoundCacheTTL(ttl time.Duration) {
+	frontend.registry.SetNotFoundCacheTTL(ttl)
+}
+
+// 设置是否按照错误写入 HTTP 状态码, 默认不写入, 由 InvalidRequestHandler 决定.
+//  设置为 true 之后, 如果 InvalidRequestHandler 没有写入响应: 不支持的请求方法返回 405 并且设置 Allow header,
+//  查询参数等格式错误返回 400, 签名验证失败返回 403,
+//  找不到 serverKey 对应的 AgentServer 返回 404, AgentServerResolver 出错返回 503, 参考 util.InvalidRequestStatusCode.
+func (frontend *MultiAgentServerFrontend) SetWriteStatusCode(enabled bool) {
 	frontend.rwmutex.Lock()
-	defer frontend.rwmutex.Unlock()
+	frontend.writeStatusCode = enabled
+	frontend.rwmutex.Unlock()
+}
 
-	if frontend.agentServerMap == nil {
-		frontend.agentServerMap = make(map[string]AgentServer)
-	}
-	frontend.agentServerMap[serverKey] = server
+// 设置是否响应 HEAD 请求, 默认不响应(当作不支持的方法).
+//  设置为 true 之后 HEAD 请求直接返回 200, 不做任何检查, 一般用于负载均衡的健康检查.
+func (frontend *MultiAgentServerFrontend) SetAllowHEAD(enabled bool) {
+	frontend.rwmutex.Lock()
+	frontend.allowHEAD = enabled
+	frontend.rwmutex.Unlock()
+}
+
+// 设置 serverKey-AgentServer pair.
+// 如果 serverKey == "" 或者 server == nil 则不做任何操作
+func (frontend *MultiAgentServerFrontend) SetAgentServer(serverKey string, server AgentServer) {
+	frontend.registry.Set(serverKey, server)
 }
 
 // 删除 serverKey 对应的 AgentServer
 func (frontend *MultiAgentServerFrontend) DeleteAgentServer(serverKey string) {
-	frontend.rwmutex.Lock()
-	defer frontend.rwmutex.Unlock()
-
-	delete(frontend.agentServerMap, serverKey)
+	frontend.registry.Delete(serverKey)
 }
 
 // 删除所有的 AgentServer
 func (frontend *MultiAgentServerFrontend) DeleteAllAgentServer() {
-	frontend.rwmutex.Lock()
-	defer frontend.rwmutex.Unlock()
-
-	frontend.agentServerMap = make(map[string]AgentServer)
+	frontend.registry.DeleteAll()
 }
 
 // 实现 http.Handler
 func (frontend *MultiAgentServerFrontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	urlValues, err := url.ParseQuery(r.URL.RawQuery)
-	if err != nil {
-		frontend.rwmutex.RLock()
-		invalidRequestHandler := frontend.invalidRequestHandler
-		frontend.rwmutex.RUnlock()
-
-		if invalidRequestHandler == nil {
-			invalidRequestHandler = DefaultInvalidRequestHandler
-		}
-		invalidRequestHandler.ServeInvalidRequest(w, r, err)
-		return
-	}
-
-	serverKey := urlValues.Get(URLQueryAgentServerKeyName)
-	if serverKey == "" {
-		frontend.rwmutex.RLock()
-		invalidRequestHandler := frontend.invalidRequestHandler
-		frontend.rwmutex.RUnlock()
-
-		if invalidRequestHandler == nil {
-			invalidRequestHandler = DefaultInvalidRequestHandler
-		}
-		err = fmt.Errorf("the url query value with name %s is empty", URLQueryAgentServerKeyName)
-		invalidRequestHandler.ServeInvalidRequest(w, r, err)
-		return
-	}
-
 	frontend.rwmutex.RLock()
 	invalidRequestHandler := frontend.invalidRequestHandler
-	agentServer := frontend.agentServerMap[serverKey]
+	logger := frontend.logger
+	serverKeyExtractor := frontend.serverKeyExtractor
+	writeStatusCode := frontend.writeStatusCode
+	allowHEAD := frontend.allowHEAD
 	frontend.rwmutex.RUnlock()
 
 	if invalidRequestHandler == nil {
 		invalidRequestHandler = DefaultInvalidRequestHandler
 	}
-	if agentServer == nil {
-		err = fmt.Errorf("Not found AgentServer for %s == %s", URLQueryAgentServerKeyName, serverKey)
+	invalidRequestHandler = withInvalidRequestStatus(invalidRequestHandler, writeStatusCode)
+	if serverKeyExtractor == nil {
+		serverKeyExtractor = defaultAgentServerKeyExtractor
+	}
+
+	head, err := checkFrontendMethod(r, allowHEAD, "GET", "POST")
+	if head {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		invalidRequestHandler = util.WithInvalidRequestLogger(invalidRequestHandler, logger)
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
+		return
+	}
+
+	server, urlValues, err := frontend.registry.Lookup(r, serverKeyExtractor, "AgentServer")
+	if err != nil {
+		invalidRequestHandler = util.WithInvalidRequestLogger(invalidRequestHandler, logger)
 		invalidRequestHandler.ServeInvalidRequest(w, r, err)
 		return
 	}
 
-	ServeHTTP(w, r, urlValues, agentServer, invalidRequestHandler)
+	ServeHTTP(w, r, urlValues, server.(AgentServer), invalidRequestHandler)
 }
@@ -0,0 +1,39 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package corp
+
+import (
+	"encoding/json"
+)
+
+// 微信服务器返回的 JSON 回复.
+//  嵌入了 Error 的 struct 的指针都自动实现了这个接口, 比如
+//  var result struct {
+//      Error
+//      XXX
+//  }
+//  &result 就是一个 Response.
+type Response interface {
+	// 返回回复里的错误码和错误信息, 不能返回 nil.
+	APIError() *Error
+}
+
+// 实现 Response 接口.
+func (e *Error) APIError() *Error {
+	return e
+}
+
+// 原样保存微信服务器回复的 Response, 用于 SDK 还没有封装的 API.
+//  Raw 是完整的 JSON 回复, Error 是从中解析出来的错误码和错误信息.
+type RawResponse struct {
+	Error
+	Raw json.RawMessage
+}
+
+func (resp *RawResponse) UnmarshalJSON(data []byte) error {
+	resp.Raw = append(resp.Raw[:0], data...)
+	return json.Unmarshal(data, &resp.Error)
+}
@@ -9,12 +9,12 @@ import (
 	"bytes"
 	"crypto/subtle"
 	"encoding/base64"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/philsong/wechat2/util"
 )
@@ -34,6 +34,12 @@ type RequestHttpBody struct {
 func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 	agentServer AgentServer, invalidRequestHandler InvalidRequestHandler) {
 
+	start := time.Now()
+	logger := serverLogger(agentServer)
+	invalidRequestHandler = util.WithInvalidRequestLogger(invalidRequestHandler, logger,
+		util.LogField{Key: "corpid", Value: agentServer.CorpId()},
+		util.LogField{Key: "agentid", Value: agentServer.AgentId()})
+
 	switch r.Method {
 	case "POST": // 消息处理
 		msgSignature1, timestampStr, nonce, err := parsePostURLQuery(urlValues)
@@ -44,7 +50,7 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 
 		// 首先判断签名长度是否合法
 		if len(msgSignature1) != 40 {
-			err = fmt.Errorf("the length of msg_signature mismatch, have: %d, want: 40", len(msgSignature1))
+			err = &util.SignatureError{Name: "msg_signature", Input: msgSignature1}
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
@@ -56,9 +62,14 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 			return
 		}
 
-		// 解析 RequestHttpBody
+		// 解析 RequestHttpBody, 限制长度并且拒绝 DTD, 实体和过深的嵌套
+		body, err := util.ReadRequestBody(r, serverMaxBodySize(agentServer))
+		if err != nil {
+			invalidRequestHandler.ServeInvalidRequest(w, r, err)
+			return
+		}
 		var requestHttpBody RequestHttpBody
-		if err := xml.NewDecoder(r.Body).Decode(&requestHttpBody); err != nil {
+		if err = util.UnmarshalXML(body, &requestHttpBody); err != nil {
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
@@ -93,7 +104,13 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 		// 验证签名
 		msgSignature2 := util.MsgSign(agentToken, timestampStr, nonce, requestHttpBody.EncryptedMsg)
 		if subtle.ConstantTimeCompare([]byte(msgSignature1), []byte(msgSignature2)) != 1 {
-			err = fmt.Errorf("check signature failed, input: %s, local: %s", msgSignature1, msgSignature2)
+			err = &util.SignatureError{Name: "msg_signature", Input: msgSignature1, Local: msgSignature2}
+			invalidRequestHandler.ServeInvalidRequest(w, r, err)
+			return
+		}
+
+		// 防重放
+		if err = checkReplay(agentServer, timestamp, nonce, []byte(requestHttpBody.EncryptedMsg)); err != nil {
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
@@ -125,7 +142,7 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 
 		// 解密成功, 解析 MixedMessage
 		var MixedMsg MixedMessage
-		if err = xml.Unmarshal(RawMsgXML, &MixedMsg); err != nil {
+		if err = util.UnmarshalXML(RawMsgXML, &MixedMsg); err != nil {
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
@@ -170,8 +187,11 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 			CorpId:     wantCorpId,
 			AgentId:    wantAgentId,
 			AgentToken: agentToken,
+
+			logger: logger,
 		}
 		agentServer.MessageHandler().ServeMessage(w, r)
+		logMessageServed(logger, r, start)
 
 	case "GET": // 首次验证
 		msgSignature1, timestamp, nonce, encryptedMsg, err := parseGetURLQuery(urlValues)
@@ -182,14 +202,14 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 
 		// 验证签名
 		if len(msgSignature1) != 40 {
-			err = fmt.Errorf("the length of msg_signature mismatch, have: %d, want: 40", len(msgSignature1))
+			err = &util.SignatureError{Name: "msg_signature", Input: msgSignature1}
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
 
 		msgSignature2 := util.MsgSign(agentServer.Token(), timestamp, nonce, encryptedMsg)
 		if subtle.ConstantTimeCompare([]byte(msgSignature1), []byte(msgSignature2)) != 1 {
-			err = fmt.Errorf("check signature failed, input: %s, local: %s", msgSignature1, msgSignature2)
+			err = &util.SignatureError{Name: "msg_signature", Input: msgSignature1, Local: msgSignature2}
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
@@ -209,6 +229,32 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 			return
 		}
 
+		logger.Log(util.LogLevelInfo, "url verified",
+			util.LogField{Key: "corpid", Value: CorpId},
+			util.LogField{Key: "agentid", Value: agentServer.AgentId()})
 		w.Write(echostr)
+
+	default:
+		err := &util.MethodNotAllowedError{Method: r.Method, Allow: []string{"GET", "POST"}}
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
+	}
+}
+
+// 如果 agentServer 实现了 ReplayGuardProvider 则做防重放检查, 只检查通过了签名验证的消息请求.
+//  body 是签名的密文, 设置了 util.ReplayGuard.AllowRedelivery 则放行完全一样的请求(微信服务器的重试).
+func checkReplay(agentServer AgentServer, timestamp int64, nonce string, body []byte) error {
+	provider, ok := agentServer.(ReplayGuardProvider)
+	if !ok {
+		return nil
+	}
+	namespace := agentServer.CorpId() + "/" + strconv.FormatInt(agentServer.AgentId(), 10)
+	return provider.ReplayGuard().CheckBody(namespace, timestamp, nonce, body)
+}
+
+// 获取 agentServer 的消息请求 http body 的最大长度, 参考 MaxBodySizeProvider.
+func serverMaxBodySize(agentServer AgentServer) int64 {
+	if provider, ok := agentServer.(MaxBodySizeProvider); ok {
+		return provider.MaxBodySize()
 	}
+	return util.DefaultMaxRequestBodySize
 }
@@ -0,0 +1,54 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package corp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+// 构造一个消息请求, 只用于 http body 的检查, 签名不需要正确
+func newMessageRequest(body string) *http.Request {
+	query := url.Values{
+		"msg_signature": {strings.Repeat("0", 40)},
+		"timestamp":     {strconv.FormatInt(time.Now().Unix(), 10)},
+		"nonce":         {"nonce"},
+	}
+	return httptest.NewRequest("POST", "/?"+query.Encode(), strings.NewReader(body))
+}
+
+func TestServeHTTPBodyLimit(t *testing.T) {
+	served := 0
+	srv := NewDefaultAgentServer("corpid", 1, "token", make([]byte, 32),
+		MessageHandlerFunc(func(w http.ResponseWriter, r *Request) { served++ }))
+
+	var invalidErr error
+	frontend := NewAgentServerFrontend(srv, InvalidRequestHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		invalidErr = err
+	}))
+
+	// DTD 和实体
+	frontend.ServeHTTP(httptest.NewRecorder(), newMessageRequest(
+		`<!DOCTYPE xml [<!ENTITY e "corpid">]><xml><ToUserName>&e;</ToUserName><Encrypt>x</Encrypt></xml>`))
+	if invalidErr != util.ErrXMLDirective || served != 0 {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+
+	srv.SetMaxBodySize(64)
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newMessageRequest(
+		"<xml><ToUserName>corpid</ToUserName><AgentID>1</AgentID><Encrypt>"+strings.Repeat("x", 64)+"</Encrypt></xml>"))
+	if _, ok := invalidErr.(*util.RequestBodyTooLargeError); !ok || served != 0 {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+}
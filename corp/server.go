@@ -8,6 +8,8 @@ package corp
 import (
 	"errors"
 	"sync"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 企业号应用的服务端接口, 处理单个应用的消息(事件)请求.
@@ -22,7 +24,22 @@ type AgentServer interface {
 	MessageHandler() MessageHandler // 获取 MessageHandler
 }
 
+// AgentServer 实现了这个接口则 ServeHTTP 会对消息请求做防重放检查, 参考 DefaultAgentServer.SetReplayGuard.
+//  检查失败的错误是 *util.TimestampSkewError 或者 *util.ReplayError, 交给 InvalidRequestHandler 处理.
+type ReplayGuardProvider interface {
+	ReplayGuard() *util.ReplayGuard // 返回 nil 表示不检查
+}
+
+// AgentServer 实现了这个接口则 ServeHTTP 按照返回的长度限制消息请求的 http body, 否则使用 util.DefaultMaxRequestBodySize.
+//  超过限制的错误是 *util.RequestBodyTooLargeError, 交给 InvalidRequestHandler 处理.
+type MaxBodySizeProvider interface {
+	MaxBodySize() int64 // 返回 <= 0 表示使用 util.DefaultMaxRequestBodySize
+}
+
 var _ AgentServer = new(DefaultAgentServer)
+var _ ReplayGuardProvider = new(DefaultAgentServer)
+var _ LoggerProvider = new(DefaultAgentServer)
+var _ MaxBodySizeProvider = new(DefaultAgentServer)
 
 type DefaultAgentServer struct {
 	corpId  string
@@ -33,6 +50,9 @@ type DefaultAgentServer struct {
 	currentAESKey     [32]byte // 当前的 AES Key
 	lastAESKey        [32]byte // 最后一个 AES Key
 	isLastAESKeyValid bool     // lastAESKey 是否有效, 如果 lastAESKey 是 zero 则无效
+	replayGuard       *util.ReplayGuard
+	logger            util.Logger
+	maxBodySize       int64
 
 	messageHandler MessageHandler
 }
@@ -98,3 +118,45 @@ func (srv *DefaultAgentServer) UpdateAESKey(AESKey []byte) (err error) {
 	srv.rwmutex.Unlock()
 	return
 }
+
+// 设置防重放检查, guard == nil 表示不检查(默认).
+//  比如 srv.SetReplayGuard(util.NewReplayGuard(util.DefaultMaxTimestampSkew, nil)).
+//  NOTE: 默认拒绝微信服务器的重试, 需要处理重试请设置 guard.AllowRedelivery 并且在 MessageHandler 里去重.
+func (srv *DefaultAgentServer) SetReplayGuard(guard *util.ReplayGuard) {
+	srv.rwmutex.Lock()
+	srv.replayGuard = guard
+	srv.rwmutex.Unlock()
+}
+func (srv *DefaultAgentServer) ReplayGuard() (guard *util.ReplayGuard) {
+	srv.rwmutex.RLock()
+	guard = srv.replayGuard
+	srv.rwmutex.RUnlock()
+	return
+}
+
+// 设置 ServeHTTP 输出日志的 Logger, logger == nil 表示不输出日志(默认).
+//  比如 srv.SetLogger(util.NewStdLogger(os.Stderr, util.LogLevelInfo)).
+func (srv *DefaultAgentServer) SetLogger(logger util.Logger) {
+	srv.rwmutex.Lock()
+	srv.logger = logger
+	srv.rwmutex.Unlock()
+}
+func (srv *DefaultAgentServer) Logger() (logger util.Logger) {
+	srv.rwmutex.RLock()
+	logger = srv.logger
+	srv.rwmutex.RUnlock()
+	return
+}
+
+// 设置消息请求 http body 的最大长度, size <= 0 表示使用 util.DefaultMaxRequestBodySize(默认).
+func (srv *DefaultAgentServer) SetMaxBodySize(size int64) {
+	srv.rwmutex.Lock()
+	srv.maxBodySize = size
+	srv.rwmutex.Unlock()
+}
+func (srv *DefaultAgentServer) MaxBodySize() (size int64) {
+	srv.rwmutex.RLock()
+	size = srv.maxBodySize
+	srv.rwmutex.RUnlock()
+	return
+}
@@ -7,6 +7,7 @@ package pay
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -17,6 +18,12 @@ import (
 type Client struct {
 	apiKey     string
 	httpClient *http.Client
+
+	// 如果 Endpoint == nil 则使用 DefaultEndpoint, 和 mp.WechatClient.Endpoint 一样.
+	//  NOTE: 请在使用 Client 之前设置.
+	Endpoint *Endpoint
+
+	interceptors []Interceptor
 }
 
 // 创建一个新的 Client.
@@ -32,18 +39,72 @@ func NewClient(apiKey string, httpClient *http.Client) *Client {
 	}
 }
 
-// 微信支付通用请求方法.
-//  注意: err == nil 表示协议状态都为 SUCCESS.
-func (clt *Client) PostXML(url string, req map[string]string) (resp map[string]string, err error) {
+// 根据 clt.Endpoint 返回 rawURL 最终的地址, 如果 clt.Endpoint == nil 则根据 DefaultEndpoint.
+func (clt *Client) ResolveURL(rawURL string) string {
+	if clt.Endpoint != nil {
+		return clt.Endpoint.ResolveURL(rawURL)
+	}
+	return DefaultEndpoint.ResolveURL(rawURL)
+}
+
+// 设置 Client 的拦截器, interceptors[0] 在最外层, 参考 Interceptor.
+//  NOTE: 请在使用 Client 之前设置, 不是并发安全的.
+func (clt *Client) SetInterceptors(interceptors ...Interceptor) {
+	clt.interceptors = interceptors
+}
+
+// 经过 clt.interceptors 执行 call.
+func (clt *Client) intercept(ctx context.Context, call *Call, invoker Invoker) error {
+	call.API = apiPath(call.URL)
+	if call.Header == nil {
+		call.Header = make(http.Header)
+	}
+	if len(clt.interceptors) > 0 {
+		invoker = chainInterceptors(clt.interceptors, invoker)
+	}
+	return invoker(ctx, call)
+}
+
+// 发送 POST 请求, body 是 call.Request 格式化后的 XML.
+func (clt *Client) postXMLBody(ctx context.Context, call *Call) (httpResp *http.Response, err error) {
 	bodyBuf := textBufferPool.Get().(*bytes.Buffer)
 	bodyBuf.Reset()
 	defer textBufferPool.Put(bodyBuf)
 
-	if err = util.FormatMapToXML(bodyBuf, req); err != nil {
+	if err = util.FormatMapToXML(bodyBuf, call.Request); err != nil {
+		return
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", clt.ResolveURL(call.URL), bodyBuf)
+	if err != nil {
 		return
 	}
+	for key, values := range call.Header {
+		httpReq.Header[key] = values
+	}
+	httpReq.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	return clt.httpClient.Do(httpReq)
+}
 
-	httpResp, err := clt.httpClient.Post(url, "text/xml; charset=utf-8", bodyBuf)
+// 微信支付通用请求方法.
+//  注意: err == nil 表示协议状态都为 SUCCESS.
+func (clt *Client) PostXML(url string, req map[string]string) (resp map[string]string, err error) {
+	return clt.PostXMLContext(context.Background(), url, req)
+}
+
+// 同 PostXML, 请求绑定到 ctx 上.
+func (clt *Client) PostXMLContext(ctx context.Context, url string, req map[string]string) (resp map[string]string, err error) {
+	call := &Call{
+		URL:     url,
+		Request: req,
+	}
+	err = clt.intercept(ctx, call, clt.invokePostXML)
+	resp = call.Response
+	return
+}
+
+func (clt *Client) invokePostXML(ctx context.Context, call *Call) (err error) {
+	httpResp, err := clt.postXMLBody(ctx, call)
 	if err != nil {
 		return
 	}
@@ -54,9 +115,11 @@ func (clt *Client) PostXML(url string, req map[string]string) (resp map[string]s
 		return
 	}
 
-	if resp, err = util.ParseXMLToMap(httpResp.Body); err != nil {
+	resp, err := util.ParseXMLToMap(httpResp.Body)
+	if err != nil {
 		return
 	}
+	call.Response = resp
 
 	// 判断协议状态
 	ReturnCode, ok := resp["return_code"]
@@ -6,13 +6,11 @@
 package pay
 
 import (
-	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-
-	"github.com/philsong/util"
 )
 
 // 统一下单.
@@ -53,38 +51,36 @@ func (clt *Client) ShortURL(req map[string]string) (resp map[string]string, err
 
 // 下载对账单.
 func (clt *Client) DownloadBill(req map[string]string) (data []byte, err error) {
-	bodyBuf := textBufferPool.Get().(*bytes.Buffer)
-	bodyBuf.Reset()
-	defer textBufferPool.Put(bodyBuf)
-
-	if err = util.FormatMapToXML(bodyBuf, req); err != nil {
-		return
-	}
-
-	url := "https://api.mch.weixin.qq.com/pay/downloadbill"
-	httpResp, err := clt.httpClient.Post(url, "text/xml; charset=utf-8", bodyBuf)
-	if err != nil {
-		return
+	call := &Call{
+		URL:     "https://api.mch.weixin.qq.com/pay/downloadbill",
+		Request: req,
 	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("http.Status: %s", httpResp.Status)
+	err = clt.intercept(context.Background(), call, func(ctx context.Context, call *Call) (err error) {
+		httpResp, err := clt.postXMLBody(ctx, call)
+		if err != nil {
+			return
+		}
+		defer httpResp.Body.Close()
+
+		if httpResp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("http.Status: %s", httpResp.Status)
+			return
+		}
+
+		httpBody, err := ioutil.ReadAll(httpResp.Body)
+		if err != nil {
+			return
+		}
+
+		var result Error
+		if err = xml.Unmarshal(httpBody, &result); err == nil {
+			err = &result
+			return
+		}
+
+		data = httpBody
+		err = nil
 		return
-	}
-
-	httpBody, err := ioutil.ReadAll(httpResp.Body)
-	if err != nil {
-		return
-	}
-
-	var result Error
-	if err = xml.Unmarshal(httpBody, &result); err == nil {
-		err = &result
-		return
-	}
-
-	data = httpBody
-	err = nil
+	})
 	return
 }
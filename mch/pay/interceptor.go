@@ -0,0 +1,57 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package pay
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// 一次 API 调用, 传递给 Interceptor.
+type Call struct {
+	API    string      // URL 的 path, 比如 "/pay/unifiedorder"
+	URL    string      // 调用的 URL
+	Header http.Header // 附加到 http 请求上的 header, 比如 tracing 的 header
+
+	Request  map[string]string // 请求的参数, 包括 sign
+	Response map[string]string // 解析后的回复, 调用 Invoker 之后有效; DownloadBill 的时候为 nil
+}
+
+// 执行 API 调用.
+type Invoker func(ctx context.Context, call *Call) error
+
+// API 调用的拦截器, 可以用来添加 tracing header, 记录日志, 统计, 故障注入等.
+//  拦截器可以在调用 invoker 之前修改 call(比如 call.Header), 也可以不调用 invoker 直接返回.
+//  NOTE: 记录日志的时候请注意 Request 和 Response 里面的敏感信息.
+type Interceptor func(ctx context.Context, call *Call, invoker Invoker) error
+
+// 把 interceptors 和 invoker 串联成一个 Invoker, interceptors[0] 在最外层.
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, call *Call) error {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return invoker
+}
+
+// 返回 rawURL 的 path 部分, 比如
+//  apiPath("https://api.mch.weixin.qq.com/pay/unifiedorder") == "/pay/unifiedorder"
+func apiPath(rawURL string) string {
+	if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+		rawURL = rawURL[:i]
+	}
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		rawURL = rawURL[i+len("://"):]
+		if i = strings.IndexByte(rawURL, '/'); i >= 0 {
+			return rawURL[i:]
+		}
+		return "/"
+	}
+	return rawURL
+}
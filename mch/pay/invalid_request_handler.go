@@ -7,6 +7,8 @@ package pay
 
 import (
 	"net/http"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 无效请求(非法或者错误)的处理接口.
@@ -22,3 +24,34 @@ func (fn InvalidRequestHandlerFunc) ServeInvalidRequest(w http.ResponseWriter, r
 }
 
 var DefaultInvalidRequestHandler = InvalidRequestHandlerFunc(func(http.ResponseWriter, *http.Request, error) {})
+
+// 在 handler 没有写入响应的时候按照错误写入 HTTP 状态码, 参考 util.InvalidRequestStatusCode.
+type statusInvalidRequestHandler struct {
+	handler InvalidRequestHandler
+}
+
+func (h statusInvalidRequestHandler) ServeInvalidRequest(w http.ResponseWriter, r *http.Request, err error) {
+	util.ServeInvalidRequestStatus(w, err, func(w http.ResponseWriter) {
+		h.handler.ServeInvalidRequest(w, r, err)
+	})
+}
+
+// 如果 writeStatusCode 为 true 则返回写入 HTTP 状态码的 InvalidRequestHandler, 否则返回 handler.
+func withInvalidRequestStatus(handler InvalidRequestHandler, writeStatusCode bool) InvalidRequestHandler {
+	if !writeStatusCode {
+		return handler
+	}
+	return statusInvalidRequestHandler{handler: handler}
+}
+
+// 检查前端收到的请求的方法, allowHEAD 为 true 的时候 HEAD 请求返回 head == true, 由前端直接响应 200.
+//  methods 是 ServeHTTP 支持的方法, 不支持的方法返回 *util.MethodNotAllowedError.
+func checkFrontendMethod(r *http.Request, allowHEAD bool, methods ...string) (head bool, err error) {
+	if allowHEAD {
+		if r.Method == "HEAD" {
+			return true, nil
+		}
+		methods = append(methods[:len(methods):len(methods)], "HEAD")
+	}
+	return false, util.CheckMethod(r.Method, methods...)
+}
@@ -5,6 +5,12 @@
 
 package pay
 
+import (
+	"net/http"
+
+	"github.com/philsong/wechat2/util"
+)
+
 type MessageServer interface {
 	AppId() string
 	MchId() string
@@ -13,13 +19,22 @@ type MessageServer interface {
 	MessageHandler() MessageHandler // 获取 MessageHandler
 }
 
+// MessageServer 实现了这个接口则 ServeHTTP 按照返回的长度限制通知请求的 http body, 否则使用 util.DefaultMaxRequestBodySize.
+//  超过限制的错误是 *util.RequestBodyTooLargeError, 交给 InvalidRequestHandler 处理.
+type MaxBodySizeProvider interface {
+	MaxBodySize() int64 // 返回 <= 0 表示使用 util.DefaultMaxRequestBodySize
+}
+
 var _ MessageServer = new(DefaultMessageServer)
+var _ MaxBodySizeProvider = new(DefaultMessageServer)
 
 type DefaultMessageServer struct {
 	appId  string
 	mchId  string
 	apiKey string
 
+	maxBodySize int64
+
 	messageHandler MessageHandler
 }
 
@@ -48,3 +63,28 @@ func (srv *DefaultMessageServer) APIKey() string {
 func (srv *DefaultMessageServer) MessageHandler() MessageHandler {
 	return srv.messageHandler
 }
+
+// 设置通知请求 http body 的最大长度, size <= 0 表示使用 util.DefaultMaxRequestBodySize(默认).
+//  NOTE: 请在使用之前设置.
+func (srv *DefaultMessageServer) SetMaxBodySize(size int64) {
+	srv.maxBodySize = size
+}
+func (srv *DefaultMessageServer) MaxBodySize() int64 {
+	return srv.maxBodySize
+}
+
+// 读取通知请求的 http body, 限制长度并且拒绝 DTD, 实体和过深的嵌套.
+func readMessageBody(r *http.Request, messageServer MessageServer) (body []byte, err error) {
+	limit := int64(util.DefaultMaxRequestBodySize)
+	if provider, ok := messageServer.(MaxBodySizeProvider); ok {
+		limit = provider.MaxBodySize()
+	}
+
+	if body, err = util.ReadRequestBody(r, limit); err != nil {
+		return nil, err
+	}
+	if err = util.CheckXML(body); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -6,10 +6,11 @@
 package pay
 
 import (
-	"fmt"
 	"net/http"
-	"net/url"
 	"sync"
+	"time"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 回调 URL 上索引 MessageServer 的 key 的名称.
@@ -19,12 +20,29 @@ import (
 //  索引值一般为 mchid|appid.
 const URLQueryMessageServerKeyName = "msg_server_key"
 
+// 默认从回调 URL 的查询参数 URLQueryMessageServerKeyName 提取 key.
+var defaultMessageServerKeyExtractor = util.QueryServerKey(URLQueryMessageServerKeyName)
+
+// MultiMessageServerFrontend 找不到 serverKey 对应的 MessageServer 的时候, 用来加载(比如从配置中心) MessageServer.
+type MessageServerResolver interface {
+	// 返回 serverKey 对应的 MessageServer, server == nil && err == nil 表示不存在.
+	ResolveMessageServer(serverKey string) (server MessageServer, err error)
+}
+
+var _ MessageServerResolver = MessageServerResolverFunc(nil)
+
+type MessageServerResolverFunc func(serverKey string) (server MessageServer, err error)
+
+func (fn MessageServerResolverFunc) ResolveMessageServer(serverKey string) (server MessageServer, err error) {
+	return fn(serverKey)
+}
+
 // 多个 MessageServer 的前端, 负责处理 http 请求, net/http.Handler 的实现
 //
 //  NOTE:
-//  MultiMessageServerFrontend 可以处理多个APP的消息，但是要求在回调 URL 上加上一个
-//  查询参数，参考常量 URLQueryMessageServerKeyName，这个参数的值就是 MultiMessageServerFrontend
-//  索引 MessageServer 的 key。
+//  MultiMessageServerFrontend 可以处理多个APP的消息，但是要求能从回调请求中提取出一个 key，
+//  MultiMessageServerFrontend 根据这个 key 索引 MessageServer。默认是回调 URL 上的一个查询参数，
+//  参考常量 URLQueryMessageServerKeyName，也可以通过 SetServerKeyExtractor 从 path, host, header 中提取。
 //
 //  例如回调 URL 为 http://www.xxx.com/notify_url?msg_server_key=1234567890，那么就可以在后端调用
 //
@@ -32,11 +50,21 @@ const URLQueryMessageServerKeyName = "msg_server_key"
 //
 //  来增加一个 MessageServer 来处理 msg_server_key=1234567890 的消息。
 //
+//  如果回调 URL 为 http://www.xxx.com/notify_url/1234567890，那么可以设置
+//
+//    MultiMessageServerFrontend.SetServerKeyExtractor(util.PathServerKey("/notify_url/"))
+//
+//  还可以通过 SetMessageServerResolver 设置 MessageServerResolver，在找不到 key 对应的 MessageServer
+//  的时候加载并且缓存 MessageServer。
+//
 //  MultiMessageServerFrontend 并发安全，可以在运行中动态增加和删除 MessageServer。
 type MultiMessageServerFrontend struct {
 	rwmutex               sync.RWMutex
-	serverMap             map[string]MessageServer
 	invalidRequestHandler InvalidRequestHandler
+	serverKeyExtractor    util.ServerKeyExtractor
+	writeStatusCode       bool
+	allowHEAD             bool
+	registry              util.ServerRegistry
 }
 
 // 设置 InvalidRequestHandler, 如果 handler == nil 则使用默认的 DefaultInvalidRequestHandler
@@ -51,82 +79,100 @@ func (frontend *MultiMessageServerFrontend) SetInvalidRequestHandler(handler Inv
 	}
 }
 
-// 设置 serverKey-MessageServer pair.
-// 如果 serverKey == "" 或者 server == nil 则不做任何操作
-func (frontend *MultiMessageServerFrontend) SetMessageServer(serverKey string, server MessageServer) {
-	if serverKey == "" {
-		return
-	}
-	if server == nil {
+// 设置从回调请求中提取 serverKey 的 ServerKeyExtractor, 比如 util.PathServerKey, util.HostServerKey,
+// util.HeaderServerKey; extractor == nil 表示使用默认的查询参数 URLQueryMessageServerKeyName.
+func (frontend *MultiMessageServerFrontend) SetServerKeyExtractor(extractor util.ServerKeyExtractor) {
+	frontend.rwmutex.Lock()
+	frontend.serverKeyExtractor = extractor
+	frontend.rwmutex.Unlock()
+}
+
+// 设置 MessageServerResolver, resolver == nil 表示不加载(默认).
+//  找不到 serverKey 对应的 MessageServer 的时候调用 resolver 加载, 加载成功的 MessageServer 会通过
+//  SetMessageServer 缓存起来, 后面的请求不再调用 resolver; 同一个 serverKey 同时只会调用一次 resolver;
+//  resolver 返回的错误对应 503, 参考 SetWriteStatusCode.
+func (frontend *MultiMessageServerFrontend) SetMessageServerResolver(resolver MessageServerResolver) {
+	if resolver == nil {
+		frontend.registry.SetResolver(nil)
 		return
 	}
+	frontend.registry.SetResolver(func(serverKey string) (interface{}, error) {
+		return resolver.ResolveMessageServer(serverKey) // nil 的接口值转换为 interface{} 还是 nil
+	})
+}
+
+// 设置 MessageServerResolver 返回不存在(nil, nil)的 serverKey 的缓存时间, 缓存期间同一个 serverKey 的请求直接返回 404,
+// 不再调用 MessageServerResolver; ttl == 0 表示使用 util.DefaultNotFoundCacheTTL(默认), ttl < 0 表示不缓存.
+func (frontend *MultiMessageServerFrontend) SetNotFoundCacheTTL(ttl time.Duration) {
+	frontend.registry.SetNotFoundCacheTTL(ttl)
+}
 
+// 设置是否按照错误写入 HTTP 状态码, 默认不写入, 由 InvalidRequestHandler 决定.
+//  设置为 true 之后, 如果 InvalidRequestHandler 没有写入响应: 不支持的请求方法返回 405 并且设置 Allow header,
+//  查询参数等格式错误返回 400, 签名验证失败返回 403, http body 太大返回 413,
+//  找不到 serverKey 对应的 MessageServer 返回 404, MessageServerResolver 出错返回 503, 参考 util.InvalidRequestStatusCode.
+func (frontend *MultiMessageServerFrontend) SetWriteStatusCode(enabled bool) {
 	frontend.rwmutex.Lock()
-	defer frontend.rwmutex.Unlock()
+	frontend.writeStatusCode = enabled
+	frontend.rwmutex.Unlock()
+}
 
-	if frontend.serverMap == nil {
-		frontend.serverMap = make(map[string]MessageServer)
-	}
-	frontend.serverMap[serverKey] = server
+// 设置是否响应 HEAD 请求, 默认不响应(当作不支持的方法).
+//  设置为 true 之后 HEAD 请求直接返回 200, 不做任何检查, 一般用于负载均衡的健康检查.
+func (frontend *MultiMessageServerFrontend) SetAllowHEAD(enabled bool) {
+	frontend.rwmutex.Lock()
+	frontend.allowHEAD = enabled
+	frontend.rwmutex.Unlock()
+}
+
+// 设置 serverKey-MessageServer pair.
+// 如果 serverKey == "" 或者 server == nil 则不做任何操作
+func (frontend *MultiMessageServerFrontend) SetMessageServer(serverKey string, server MessageServer) {
+	frontend.registry.Set(serverKey, server)
 }
 
 // 删除 serverKey 对应的 MessageServer
 func (frontend *MultiMessageServerFrontend) DeleteMessageServer(serverKey string) {
-	frontend.rwmutex.Lock()
-	defer frontend.rwmutex.Unlock()
-
-	delete(frontend.serverMap, serverKey)
+	frontend.registry.Delete(serverKey)
 }
 
 // 删除所有的 MessageServer
 func (frontend *MultiMessageServerFrontend) DeleteAllMessageServer() {
-	frontend.rwmutex.Lock()
-	defer frontend.rwmutex.Unlock()
-
-	frontend.serverMap = make(map[string]MessageServer)
+	frontend.registry.DeleteAll()
 }
 
 // 实现 http.Handler
 func (frontend *MultiMessageServerFrontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	urlValues, err := url.ParseQuery(r.URL.RawQuery)
-	if err != nil {
-		frontend.rwmutex.RLock()
-		invalidRequestHandler := frontend.invalidRequestHandler
-		frontend.rwmutex.RUnlock()
-
-		if invalidRequestHandler == nil {
-			invalidRequestHandler = DefaultInvalidRequestHandler
-		}
-		invalidRequestHandler.ServeInvalidRequest(w, r, err)
-		return
-	}
-
-	serverKey := urlValues.Get(URLQueryMessageServerKeyName)
-	if serverKey == "" {
-		frontend.rwmutex.RLock()
-		invalidRequestHandler := frontend.invalidRequestHandler
-		frontend.rwmutex.RUnlock()
-
-		if invalidRequestHandler == nil {
-			invalidRequestHandler = DefaultInvalidRequestHandler
-		}
-		err = fmt.Errorf("the url query value with name %s is empty", URLQueryMessageServerKeyName)
-		invalidRequestHandler.ServeInvalidRequest(w, r, err)
-		return
-	}
-
 	frontend.rwmutex.RLock()
 	invalidRequestHandler := frontend.invalidRequestHandler
-	messageServer := frontend.serverMap[serverKey]
+	serverKeyExtractor := frontend.serverKeyExtractor
+	writeStatusCode := frontend.writeStatusCode
+	allowHEAD := frontend.allowHEAD
 	frontend.rwmutex.RUnlock()
 
 	if invalidRequestHandler == nil {
 		invalidRequestHandler = DefaultInvalidRequestHandler
 	}
-	if messageServer == nil {
-		invalidRequestHandler.ServeInvalidRequest(w, r, fmt.Errorf("Not found MessageServer for %s == %s", URLQueryMessageServerKeyName, serverKey))
+	invalidRequestHandler = withInvalidRequestStatus(invalidRequestHandler, writeStatusCode)
+	if serverKeyExtractor == nil {
+		serverKeyExtractor = defaultMessageServerKeyExtractor
+	}
+
+	head, err := checkFrontendMethod(r, allowHEAD, "POST")
+	if head {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
+		return
+	}
+
+	server, _, err := frontend.registry.Lookup(r, serverKeyExtractor, "MessageServer")
+	if err != nil {
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
 		return
 	}
 
-	ServeHTTP(w, r, nil, messageServer, invalidRequestHandler)
+	ServeHTTP(w, r, nil, server.(MessageServer), invalidRequestHandler)
 }
@@ -10,11 +10,11 @@ import (
 	"crypto/subtle"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 
 	"github.com/philsong/util"
+	wechatutil "github.com/philsong/wechat2/util"
 )
 
 func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
@@ -22,7 +22,7 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 
 	switch r.Method {
 	case "POST":
-		RawMsgXML, err := ioutil.ReadAll(r.Body)
+		RawMsgXML, err := readMessageBody(r, messageServer)
 		if err != nil {
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
@@ -71,12 +71,12 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 			}
 			signature2 := Sign(msg, messageServer.APIKey(), nil)
 			if len(signature1) != len(signature2) {
-				err = fmt.Errorf("check signature failed, \r\ninput: %q, \r\nlocal: %q", signature1, signature2)
+				err = &wechatutil.SignatureError{Name: "sign", Input: signature1, Local: signature2}
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
 			if subtle.ConstantTimeCompare([]byte(signature1), []byte(signature2)) != 1 {
-				err = fmt.Errorf("check signature failed, \r\ninput: %q, \r\nlocal: %q", signature1, signature2)
+				err = &wechatutil.SignatureError{Name: "sign", Input: signature1, Local: signature2}
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
@@ -91,6 +91,7 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 		messageServer.MessageHandler().ServeMessage(w, req)
 
 	default:
-		invalidRequestHandler.ServeInvalidRequest(w, r, errors.New("Request.Method: "+r.Method))
+		err := &wechatutil.MethodNotAllowedError{Method: r.Method, Allow: []string{"POST"}}
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
 	}
 }
@@ -13,6 +13,8 @@ import (
 type MessageServerFrontend struct {
 	server                MessageServer
 	invalidRequestHandler InvalidRequestHandler
+	writeStatusCode       bool
+	allowHEAD             bool
 }
 
 func NewMessageServerFrontend(server MessageServer, handler InvalidRequestHandler) *MessageServerFrontend {
@@ -29,10 +31,35 @@ func NewMessageServerFrontend(server MessageServer, handler InvalidRequestHandle
 	}
 }
 
+// 设置是否按照错误写入 HTTP 状态码, 默认不写入, 由 InvalidRequestHandler 决定.
+//  设置为 true 之后, 如果 InvalidRequestHandler 没有写入响应: 不支持的请求方法返回 405 并且设置 Allow header,
+//  查询参数等格式错误返回 400, 签名验证失败返回 403, http body 太大返回 413, 参考 util.InvalidRequestStatusCode.
+//  NOTE: 请在使用之前设置.
+func (frontend *MessageServerFrontend) SetWriteStatusCode(enabled bool) {
+	frontend.writeStatusCode = enabled
+}
+
+// 设置是否响应 HEAD 请求, 默认不响应(当作不支持的方法).
+//  设置为 true 之后 HEAD 请求直接返回 200, 不做任何检查, 一般用于负载均衡的健康检查.
+//  NOTE: 请在使用之前设置.
+func (frontend *MessageServerFrontend) SetAllowHEAD(enabled bool) {
+	frontend.allowHEAD = enabled
+}
+
 // 实现 http.Handler.
 func (frontend *MessageServerFrontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	messageServer := frontend.server
-	invalidRequestHandler := frontend.invalidRequestHandler
+	invalidRequestHandler := withInvalidRequestStatus(frontend.invalidRequestHandler, frontend.writeStatusCode)
+
+	head, err := checkFrontendMethod(r, frontend.allowHEAD, "POST")
+	if head {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
+		return
+	}
 
 	ServeHTTP(w, r, nil, messageServer, invalidRequestHandler)
 }
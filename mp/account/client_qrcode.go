@@ -6,6 +6,7 @@
 package account
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -145,9 +146,15 @@ func (clt *Client) CreatePermanentQRCodeWithSceneString(SceneString string) (qrc
 
 // 通过ticket换取二维码, 写入到 writer.
 //  NOTE: 调用者保证所有参数有效.
-func qrcodeDownloadToWriter(ticket string, writer io.Writer, httpClient *http.Client) (err error) {
-	qrcodeURL := "https://mp.weixin.qq.com/cgi-bin/showqrcode?ticket=" + url.QueryEscape(ticket)
-	httpResp, err := httpClient.Get(qrcodeURL)
+func qrcodeDownloadToWriter(ctx context.Context, ticket string, writer io.Writer,
+	httpClient *http.Client, endpoint *mp.Endpoint) (err error) {
+
+	qrcodeURL := endpoint.ResolveURL("https://mp.weixin.qq.com/cgi-bin/showqrcode?ticket=" + url.QueryEscape(ticket))
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", qrcodeURL, nil)
+	if err != nil {
+		return
+	}
+	httpResp, err := httpClient.Do(httpReq)
 	if err != nil {
 		return
 	}
@@ -169,7 +176,7 @@ func QRCodeDownloadToWriter(ticket string, writer io.Writer, httpClient *http.Cl
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
-	return qrcodeDownloadToWriter(ticket, writer, httpClient)
+	return qrcodeDownloadToWriter(context.Background(), ticket, writer, httpClient, mp.DefaultEndpoint)
 }
 
 // 通过ticket换取二维码, 写入到 writer.
@@ -180,7 +187,7 @@ func (clt *Client) QRCodeDownloadToWriter(ticket string, writer io.Writer) (err
 	if clt.HttpClient == nil {
 		clt.HttpClient = http.DefaultClient
 	}
-	return qrcodeDownloadToWriter(ticket, writer, clt.HttpClient)
+	return qrcodeDownloadToWriter(clt.Context(), ticket, writer, clt.HttpClient, clt.endpoint())
 }
 
 // 通过ticket换取二维码, 写入到 filepath 路径的文件.
@@ -195,7 +202,7 @@ func QRCodeDownload(ticket, filepath string, httpClient *http.Client) (err error
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
-	return qrcodeDownloadToWriter(ticket, file, httpClient)
+	return qrcodeDownloadToWriter(context.Background(), ticket, file, httpClient, mp.DefaultEndpoint)
 }
 
 // 通过ticket换取二维码, 写入到 filepath 路径的文件.
@@ -209,5 +216,13 @@ func (clt *Client) QRCodeDownload(ticket, filepath string) (err error) {
 	if clt.HttpClient == nil {
 		clt.HttpClient = http.DefaultClient
 	}
-	return qrcodeDownloadToWriter(ticket, file, clt.HttpClient)
+	return qrcodeDownloadToWriter(clt.Context(), ticket, file, clt.HttpClient, clt.endpoint())
+}
+
+// 获取 clt 使用的 Endpoint, 如果 clt.Endpoint == nil 则返回 mp.DefaultEndpoint.
+func (clt *Client) endpoint() *mp.Endpoint {
+	if clt.Endpoint != nil {
+		return clt.Endpoint
+	}
+	return mp.DefaultEndpoint
 }
@@ -7,30 +7,114 @@ package mp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"reflect"
+	"sync/atomic"
+	"time"
 
 	wechatjson "github.com/philsong/wechat2/json"
+	"github.com/philsong/wechat2/util"
 )
 
 // 微信公众号"主动"请求功能的基本封装.
+//  NOTE: WechatClient 可以被多个 goroutine 同时使用.
 type WechatClient struct {
-	accessToken string // 缓存当前的 access_token
+	// 缓存当前的 access_token(string), 用于 GetNewToken 判断中控服务器是否已经更新了 access_token.
+	//  多个 goroutine 同时读写, 所以用 atomic.Value.
+	accessToken atomic.Value
 
 	TokenServer TokenServer
 	HttpClient  *http.Client
+	Endpoint    *Endpoint   // 如果 Endpoint == nil 则使用 DefaultEndpoint
+	RetryPolicy RetryPolicy // 如果 RetryPolicy == nil 则不重试(access_token 失效的重试除外)
+	Limiter     Limiter     // 如果 Limiter == nil 则不限流, 可以是 *QuotaLimiter
+
+	// API 调用的拦截器, Interceptors[0] 在最外层, 参考 Interceptor.
+	//  拦截器包裹的是一次完整的 API 调用, 包括限流和重试.
+	Interceptors []Interceptor
+
+	// 输出 API 调用的日志(api, errcode, latency 等, 不包含 access_token), 如果 Logger == nil 则不输出.
+	Logger util.Logger
+
+	ctx context.Context // 通过 WithContext 设置, 参考 http.Request.WithContext
+}
+
+// 获取 WechatClient 的 context.
+//  如果没有通过 WithContext 设置, 则返回 context.Background().
+func (clt *WechatClient) Context() context.Context {
+	if clt.ctx != nil {
+		return clt.ctx
+	}
+	return context.Background()
+}
+
+// 返回 clt 的一个浅拷贝, 该拷贝发起的所有请求都绑定到 ctx 上;
+// ctx 取消或者超时后, 正在进行的 http 请求和 access_token 失效重试都会中止.
+func (clt *WechatClient) WithContext(ctx context.Context) *WechatClient {
+	if ctx == nil {
+		panic("mp: nil context")
+	}
+	// 不能直接复制 *clt, accessToken 可能正在被别的 goroutine 修改
+	clt2 := &WechatClient{
+		TokenServer:  clt.TokenServer,
+		HttpClient:   clt.HttpClient,
+		Endpoint:     clt.Endpoint,
+		RetryPolicy:  clt.RetryPolicy,
+		Limiter:      clt.Limiter,
+		Interceptors: clt.Interceptors,
+		Logger:       clt.Logger,
+		ctx:          ctx,
+	}
+	clt2.accessToken.Store(clt.cachedToken())
+	return clt2
+}
+
+// 获取缓存的 access_token, 没有则返回空串.
+func (clt *WechatClient) cachedToken() string {
+	token, _ := clt.accessToken.Load().(string)
+	return token
+}
+
+// 根据 clt.Endpoint 返回 rawURL 最终的地址, 如果 clt.Endpoint == nil 则根据 DefaultEndpoint.
+func (clt *WechatClient) ResolveURL(rawURL string) string {
+	if clt.Endpoint != nil {
+		return clt.Endpoint.ResolveURL(rawURL)
+	}
+	return DefaultEndpoint.ResolveURL(rawURL)
 }
 
 // 获取 access_token.
+//  如果 clt.TokenServer 实现了 ExpiringTokenServer, 并且 access_token 快要过期了,
+//  则在后台提前刷新, 同一个 TokenServer 的提前刷新会合并.
+//  如果 clt.TokenServer 实现了 ContextTokenServer, 需要获取 access_token 的时候请求绑定到 clt.Context() 上.
 func (clt *WechatClient) Token() (token string, err error) {
-	token, err = clt.TokenServer.Token()
+	return clt.token(clt.Context())
+}
+
+func (clt *WechatClient) token(ctx context.Context) (token string, err error) {
+	srv, ok := clt.TokenServer.(ExpiringTokenServer)
+	if !ok {
+		token, err = clt.TokenServer.Token()
+		clt.accessToken.Store(token)
+		return
+	}
+
+	var expiresAt time.Time
+	if ctxSrv, ok := srv.(ContextTokenServer); ok {
+		token, expiresAt, err = ctxSrv.TokenWithExpiryContext(ctx)
+	} else {
+		token, expiresAt, err = srv.TokenWithExpiry()
+	}
 	if err != nil {
-		clt.accessToken = ""
+		clt.accessToken.Store("")
 		return
 	}
-	clt.accessToken = token
+	clt.accessToken.Store(token)
+	if !expiresAt.IsZero() && time.Until(expiresAt) < proactiveRefreshWindow {
+		refreshTokenAhead(srv)
+	}
 	return
 }
 
@@ -40,18 +124,45 @@ func (clt *WechatClient) Token() (token string, err error) {
 //  2. 即使 access_token 失效(错误代码 40001, 正常情况下不会出现),
 //     也请谨慎调用 TokenRefresh, 建议直接返回错误! 因为很有可能高并发情况下造成雪崩效应!
 //  3. 再次强调, 调用这个函数你应该知道发生了什么!!!
+//  4. 同一个 TokenServer 并发的调用会合并为一次 TokenServer.TokenRefresh();
+//  5. 如果 clt.TokenServer 实现了 ContextTokenServer, 刷新的请求绑定到 clt.Context() 上.
 func (clt *WechatClient) TokenRefresh() (token string, err error) {
-	token, err = clt.TokenServer.TokenRefresh()
+	return clt.tokenRefresh(clt.Context())
+}
+
+func (clt *WechatClient) tokenRefresh(ctx context.Context) (token string, err error) {
+	token, err = refreshToken(ctx, clt.TokenServer)
 	if err != nil {
-		clt.accessToken = ""
+		clt.accessToken.Store("")
 		return
 	}
-	clt.accessToken = token
+	clt.accessToken.Store(token)
 	return
 }
 
 // 当 WechatClient.Token() 返回的 access_token 失效时获取新的 access_token.
+//  如果中控服务器的 access_token 和 clt 缓存的不同, 则直接返回中控服务器的, 否则调用 TokenRefresh.
+//  NOTE: 多个 goroutine 共用 clt 的时候缓存的不一定是失效的那个 access_token, 建议使用 RenewToken.
 func (clt *WechatClient) GetNewToken() (token string, err error) {
+	token, err = clt.TokenServer.Token()
+	if err != nil {
+		clt.accessToken.Store("")
+		return
+	}
+	if clt.cachedToken() != token {
+		clt.accessToken.Store(token)
+		return
+	}
+	return clt.TokenRefresh()
+}
+
+// 当 staleToken 被微信服务器认为失效时获取新的 access_token.
+//  如果 clt.TokenServer 实现了 ContextTokenServer, 获取的请求绑定到 clt.Context() 上.
+func (clt *WechatClient) RenewToken(staleToken string) (token string, err error) {
+	return clt.renewToken(clt.Context(), staleToken)
+}
+
+func (clt *WechatClient) renewToken(ctx context.Context, staleToken string) (token string, err error) {
 	// 失效有两种可能:
 	// 1. 中控服务器更新了 access_token, 但是没有及时更新到缓存, 导致此次 WechatClient.Token()
 	//    获取到的不是有效的 access_token;
@@ -61,17 +172,17 @@ func (clt *WechatClient) GetNewToken() (token string, err error) {
 
 	// 策略:
 	//     先到中控服务器去查询是否有新的 access_token, 如果没有新的 access_token 则请求调用
-	// WechatClient.TokenRefresh() 返回 access_token.
+	// WechatClient.TokenRefresh() 返回 access_token; 并发的多个请求同时失效的时候只会刷新一次,
+	// 刷新完成之后才失效的请求会从中控服务器拿到新的 access_token, 不会再次刷新.
 	token, err = clt.TokenServer.Token()
 	if err != nil {
-		clt.accessToken = ""
 		return
 	}
-	if clt.accessToken != token {
-		clt.accessToken = token
+	if token != staleToken {
+		clt.accessToken.Store(token)
 		return
 	}
-	return clt.TokenRefresh()
+	return clt.tokenRefresh(ctx)
 }
 
 // 用 encoding/json 把 request marshal 为 JSON, 放入 http 请求的 body 中,
@@ -79,131 +190,192 @@ func (clt *WechatClient) GetNewToken() (token string, err error) {
 //
 //  NOTE:
 //  1. 一般不用调用这个方法, 请直接调用高层次的封装方法;
-//  2. 最终的 URL == incompleteURL + access_token;
-//  3. response 要求是 struct 的指针, 并且该 struct 拥有属性:
-//     ErrCode int `json:"errcode"` (可以是直接属性, 也可以是匿名属性里的属性)
-func (clt *WechatClient) PostJSON(incompleteURL string, request interface{}, response interface{}) (err error) {
+//  2. 最终的 URL == clt.ResolveURL(incompleteURL) + access_token;
+//  3. response 一般是嵌入了 Error 的 struct 的指针, 参考 Response;
+//     不需要解析的回复可以用 *RawResponse 原样保存.
+func (clt *WechatClient) PostJSON(incompleteURL string, request interface{}, response Response) (err error) {
+	return clt.PostJSONContext(clt.Context(), incompleteURL, request, response)
+}
+
+// 同 PostJSON, 请求绑定到 ctx 上.
+func (clt *WechatClient) PostJSONContext(ctx context.Context, incompleteURL string,
+	request interface{}, response Response) (err error) {
+
+	call := &Call{
+		URL:      incompleteURL,
+		Method:   "POST",
+		Request:  request,
+		Response: response,
+	}
+	return clt.doJSON(ctx, call, nil)
+}
+
+// GET 微信资源, 然后将微信服务器返回的 JSON 用 encoding/json 解析到 response.
+//
+//  NOTE:
+//  1. 一般不用调用这个方法, 请直接调用高层次的封装方法;
+//  2. 最终的 URL == clt.ResolveURL(incompleteURL) + access_token;
+//  3. response 一般是嵌入了 Error 的 struct 的指针, 参考 Response;
+//     不需要解析的回复可以用 *RawResponse 原样保存.
+func (clt *WechatClient) GetJSON(incompleteURL string, response Response) (err error) {
+	return clt.GetJSONContext(clt.Context(), incompleteURL, response)
+}
+
+// 同 GetJSON, 请求绑定到 ctx 上.
+func (clt *WechatClient) GetJSONContext(ctx context.Context, incompleteURL string, response Response) (err error) {
+	newRequest := func(finalURL string) (*http.Request, error) {
+		return http.NewRequest("GET", finalURL, nil)
+	}
+	call := &Call{
+		URL:      incompleteURL,
+		Method:   "GET",
+		Response: response,
+	}
+	return clt.doJSON(ctx, call, newRequest)
+}
+
+// 经过 clt.Interceptors 执行 call, 参考 invoke.
+//  如果 newRequest == nil 则 POST call.Request marshal 后的 JSON, 参考 invokePostJSON.
+func (clt *WechatClient) doJSON(ctx context.Context, call *Call,
+	newRequest func(finalURL string) (*http.Request, error)) (err error) {
+
+	call.API = apiPath(call.URL)
+	if call.Header == nil {
+		call.Header = make(http.Header)
+	}
+
+	var invoker Invoker = func(ctx context.Context, call *Call) error {
+		if newRequest == nil {
+			return clt.invokePostJSON(ctx, call)
+		}
+		return clt.invoke(ctx, call, newRequest)
+	}
+	if len(clt.Interceptors) > 0 {
+		invoker = chainInterceptors(clt.Interceptors, invoker)
+	}
+	if clt.Logger == nil {
+		return invoker(ctx, call)
+	}
+
+	start := time.Now()
+	err = invoker(ctx, call)
+	logAPICall(clt.Logger, call, start, err)
+	return
+}
+
+// 用 encoding/json 把 call.Request marshal 为 JSON, 然后 POST 到微信服务器, 参考 invoke.
+//  在所有拦截器之后才 marshal, 所以拦截器对 call.Request 的修改(或者替换)也会生效.
+func (clt *WechatClient) invokePostJSON(ctx context.Context, call *Call) (err error) {
 	buf := textBufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer textBufferPool.Put(buf)
 
-	if err = wechatjson.NewEncoder(buf).Encode(request); err != nil {
+	if err = wechatjson.NewEncoder(buf).Encode(call.Request); err != nil {
 		return
 	}
 	requestBytes := buf.Bytes()
 
-	token, err := clt.Token()
+	newRequest := func(finalURL string) (*http.Request, error) {
+		httpReq, err := http.NewRequest("POST", finalURL, bytes.NewReader(requestBytes))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json; charset=utf-8")
+		return httpReq, nil
+	}
+	return clt.invoke(ctx, call, newRequest)
+}
+
+// 发送 newRequest 创建的请求, 然后将微信服务器返回的 JSON 用 encoding/json 解析到 call.Response;
+// 如果 access_token 失效则获取新的 access_token 重试一次, 其他的错误根据 clt.RetryPolicy 决定是否重试.
+//  NOTE: 每次调用 newRequest 都要返回一个新的 *http.Request, 重试的时候会再次调用.
+func (clt *WechatClient) invoke(ctx context.Context, call *Call,
+	newRequest func(finalURL string) (*http.Request, error)) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	response := call.Response
+	idempotent := call.Method == "GET" || !isNonIdempotentAPI(call.API)
+	incompleteURL := clt.ResolveURL(call.URL)
+
+	token, err := clt.token(ctx)
 	if err != nil {
 		return
 	}
 
 	hasRetried := false
+	attempt := 0
 RETRY:
-	finalURL := incompleteURL + token
-
-	httpResp, err := clt.HttpClient.Post(finalURL, "application/json; charset=utf-8", bytes.NewReader(requestBytes))
+	attempt++
+	if clt.Limiter != nil {
+		if err = clt.Limiter.Wait(ctx, call.API); err != nil {
+			return
+		}
+	}
+	httpReq, err := newRequest(incompleteURL + token)
 	if err != nil {
 		return
 	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http.Status: %s", httpResp.Status)
+	for key, values := range call.Header {
+		httpReq.Header[key] = values
 	}
-
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
+	*response.APIError() = Error{} // 成功的回复可能没有 errcode 字段, 重试前要清除上次的错误码
+	if err = clt.roundTrip(httpReq.WithContext(ctx), response); err != nil {
+		if clt.shouldRetry(ctx, idempotent, attempt, err) {
+			goto RETRY
+		}
 		return
 	}
 
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
+	apiErr := response.APIError()
+	switch apiErr.ErrCode {
 	case ErrCodeOK:
 		return
 	case ErrCodeInvalidCredential, ErrCodeTimeout:
 		if !hasRetried {
 			hasRetried = true
 
-			if token, err = clt.GetNewToken(); err != nil {
+			// ctx 已经取消则不再重试
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			if token, err = clt.renewToken(ctx, token); err != nil {
 				return
 			}
 			goto RETRY
 		}
 		fallthrough
 	default:
+		observeQuota(clt.Limiter, call.API, apiErr)
+		if clt.RetryPolicy == nil {
+			return
+		}
+		wxErr := *apiErr // 重试的时候 apiErr 会被覆盖
+		if clt.shouldRetry(ctx, idempotent, attempt, &wxErr) {
+			goto RETRY
+		}
 		return
 	}
 }
 
-// GET 微信资源, 然后将微信服务器返回的 JSON 用 encoding/json 解析到 response.
-//
-//  NOTE:
-//  1. 一般不用调用这个方法, 请直接调用高层次的封装方法;
-//  2. 最终的 URL == incompleteURL + access_token;
-//  3. response 要求是 struct 的指针, 并且该 struct 拥有属性:
-//     ErrCode int `json:"errcode"` (可以是直接属性, 也可以是匿名属性里的属性)
-func (clt *WechatClient) GetJSON(incompleteURL string, response interface{}) (err error) {
-	token, err := clt.Token()
-	if err != nil {
-		return
-	}
+// 执行一次 http 请求, 并将返回的 JSON 解析到 response.
+//  http 层面的错误都包装成 *TransportError 返回.
+func (clt *WechatClient) roundTrip(httpReq *http.Request, response Response) (err error) {
+	rawURL := httpReq.URL.String()
 
-	hasRetried := false
-RETRY:
-	finalURL := incompleteURL + token
-
-	httpResp, err := clt.HttpClient.Get(finalURL)
+	httpResp, err := clt.HttpClient.Do(httpReq)
 	if err != nil {
-		return
+		return NewTransportError(rawURL, 0, err)
 	}
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http.Status: %s", httpResp.Status)
+		return NewTransportError(rawURL, httpResp.StatusCode, fmt.Errorf("http.Status: %s", httpResp.Status))
 	}
 
 	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
-		return
-	}
-
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
-	case ErrCodeOK:
-		return
-	case ErrCodeInvalidCredential, ErrCodeTimeout:
-		if !hasRetried {
-			hasRetried = true
-
-			if token, err = clt.GetNewToken(); err != nil {
-				return
-			}
-			goto RETRY
-		}
-		fallthrough
-	default:
-		return
+		return NewTransportError(rawURL, httpResp.StatusCode, err)
 	}
+	return
 }
@@ -0,0 +1,344 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的 TokenServer, TokenRefresh 之后返回新的 access_token.
+type testTokenServer struct {
+	token        string
+	refreshCount int
+}
+
+func (srv *testTokenServer) Token() (string, error) {
+	return srv.token, nil
+}
+
+func (srv *testTokenServer) TokenRefresh() (string, error) {
+	srv.refreshCount++
+	srv.token = "new_token"
+	return srv.token, nil
+}
+
+func TestWechatClientPostJSON(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "new_token" {
+			io.WriteString(w, `{"errcode":40001,"errmsg":"invalid credential"}`)
+			return
+		}
+		io.WriteString(w, `{"errcode":0,"errmsg":"ok","value":"hello"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tokenServer := &testTokenServer{token: "old_token"}
+	clt := &WechatClient{
+		TokenServer: tokenServer,
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+	}
+
+	var result struct {
+		Error
+		Value string `json:"value"`
+	}
+	err := clt.PostJSON("https://api.weixin.qq.com/cgi-bin/test?access_token=", map[string]string{"a": "b"}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ErrCode != ErrCodeOK || result.Value != "hello" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if tokenServer.refreshCount != 1 {
+		t.Errorf("refreshCount mismatch, have: %d, want: 1", tokenServer.refreshCount)
+	}
+}
+
+func TestWechatClientContextCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not be sent")
+	}))
+	defer server.Close()
+
+	clt := &WechatClient{
+		TokenServer: &testTokenServer{token: "token"},
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var result Error
+	err := clt.WithContext(ctx).GetJSON("https://api.weixin.qq.com/cgi-bin/test?access_token=", &result)
+	if err != context.Canceled {
+		t.Errorf("err mismatch, have: %v, want: %v", err, context.Canceled)
+	}
+}
+
+func TestWechatClientRenewTokenContext(t *testing.T) {
+	var fetchCount int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/token", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetchCount, 1)
+		select { // 微信服务器很慢, 直到调用者放弃
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/cgi-bin/test", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"errcode":40001,"errmsg":"invalid credential"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	store := new(MemoryTokenStore)
+	store.Save("appid", &TokenEntry{Token: "old_token", ExpiresAt: time.Now().Add(time.Hour)})
+	tokenServer := NewDistributedTokenServer("appid", "secret", store, server.Client())
+	tokenServer.Endpoint = &Endpoint{APIBaseURL: server.URL}
+	clt := &WechatClient{
+		TokenServer: tokenServer,
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+	}
+
+	// access_token 失效之后刷新 access_token 的请求也绑定到调用者的 ctx 上
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var result Error
+	err := clt.WithContext(ctx).GetJSON("https://api.weixin.qq.com/cgi-bin/test?access_token=", &result)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err mismatch, have: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the caller's deadline is ignored, elapsed: %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&fetchCount); n != 1 {
+		t.Errorf("fetchCount mismatch, have: %d, want: 1", n)
+	}
+
+	// 调用者放弃不算获取失败
+	if status := tokenServer.Status(); status.ConsecutiveFailures != 0 || status.LastError != nil {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestWechatClientRetryPolicy(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount == 1 {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if requestCount == 2 {
+			io.WriteString(w, `{"errcode":-1,"errmsg":"system error"}`)
+			return
+		}
+		io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+	}))
+	defer server.Close()
+
+	clt := &WechatClient{
+		TokenServer: &testTokenServer{token: "token"},
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+		RetryPolicy: &BackoffRetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	}
+
+	var result Error
+	if err := clt.PostJSON("https://api.weixin.qq.com/cgi-bin/menu/create?access_token=", nil, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.ErrCode != ErrCodeOK || requestCount != 3 {
+		t.Errorf("unexpected result: %+v, requestCount: %d", result, requestCount)
+	}
+
+	// 非幂等的 API 收到 5xx 不能重试
+	requestCount = 0
+	err := clt.PostJSON("https://api.weixin.qq.com/cgi-bin/message/mass/sendall?access_token=", nil, &result)
+	if !errors.Is(err, ErrorClassTransport) {
+		t.Errorf("err mismatch, have: %v, want: %v", err, ErrorClassTransport)
+	}
+	if requestCount != 1 {
+		t.Errorf("requestCount mismatch, have: %d, want: 1", requestCount)
+	}
+}
+
+func TestWechatClientRetryNonIdempotent(t *testing.T) {
+	var (
+		requestCount int
+		errCode      int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount == 1 {
+			fmt.Fprintf(w, `{"errcode":%d,"errmsg":"error"}`, errCode)
+			return
+		}
+		io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+	}))
+	defer server.Close()
+
+	clt := &WechatClient{
+		TokenServer: &testTokenServer{token: "token"},
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+		RetryPolicy: &BackoffRetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	}
+
+	tests := []struct {
+		errCode      int
+		requestCount int
+	}{
+		{ErrCodeSystemBusy, 1},        // 微信服务器可能已经群发了, 不能重试
+		{ErrCodeAPIFreqOutOfLimit, 2}, // 确定没有执行, 可以重试
+	}
+	for _, tt := range tests {
+		requestCount, errCode = 0, tt.errCode
+		var result Error
+		clt.PostJSON("https://api.weixin.qq.com/cgi-bin/message/mass/sendall?access_token=", nil, &result)
+		if requestCount != tt.requestCount {
+			t.Errorf("errcode %d: requestCount mismatch, have: %d, want: %d", tt.errCode, requestCount, tt.requestCount)
+		}
+	}
+}
+
+func TestWechatClientRawResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"errcode":45009,"errmsg":"api freq out of limit","extra":1}`)
+	}))
+	defer server.Close()
+
+	clt := &WechatClient{
+		TokenServer: &testTokenServer{token: "token"},
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+	}
+
+	var result RawResponse
+	if err := clt.GetJSON("https://api.weixin.qq.com/cgi-bin/unknown?access_token=", &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.ErrCode != ErrCodeAPIQuotaExceeded {
+		t.Errorf("ErrCode mismatch, have: %d, want: %d", result.ErrCode, ErrCodeAPIQuotaExceeded)
+	}
+	if string(result.Raw) != `{"errcode":45009,"errmsg":"api freq out of limit","extra":1}` {
+		t.Errorf("Raw mismatch, have: %s", result.Raw)
+	}
+}
+
+func TestWechatClientInterceptors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Trace-Id") != "trace" {
+			t.Errorf("X-Trace-Id mismatch, have: %q, want: %q", r.Header.Get("X-Trace-Id"), "trace")
+		}
+		io.WriteString(w, `{"errcode":48001,"errmsg":"api unauthorized"}`)
+	}))
+	defer server.Close()
+
+	var trace []string
+	clt := &WechatClient{
+		TokenServer: &testTokenServer{token: "token"},
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+		Interceptors: []Interceptor{
+			func(ctx context.Context, call *Call, invoker Invoker) error {
+				trace = append(trace, "outer:"+call.API)
+				call.Header.Set("X-Trace-Id", "trace")
+				return invoker(ctx, call)
+			},
+			func(ctx context.Context, call *Call, invoker Invoker) error {
+				err := invoker(ctx, call)
+				trace = append(trace, "inner:"+call.Response.APIError().ErrMsg)
+				return err
+			},
+		},
+	}
+
+	var result Error
+	if err := clt.PostJSON("https://api.weixin.qq.com/cgi-bin/menu/create?access_token=", nil, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 2 || trace[0] != "outer:/cgi-bin/menu/create" || trace[1] != "inner:api unauthorized" {
+		t.Errorf("unexpected trace: %q", trace)
+	}
+}
+
+func TestWechatClientInterceptorRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"a":"c"}`+"\n" {
+			t.Errorf("body mismatch, have: %q", body)
+		}
+		io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+	}))
+	defer server.Close()
+
+	clt := &WechatClient{
+		TokenServer: &testTokenServer{token: "token"},
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+		Interceptors: []Interceptor{
+			func(ctx context.Context, call *Call, invoker Invoker) error {
+				call.Request = map[string]string{"a": "c"} // 拦截器替换了 request
+				return invoker(ctx, call)
+			},
+		},
+	}
+
+	var result Error
+	if err := clt.PostJSON("https://api.weixin.qq.com/cgi-bin/test?access_token=", map[string]string{"a": "b"}, &result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWechatClientGetNewToken(t *testing.T) {
+	tokenServer := &testTokenServer{token: "old_token"}
+	clt := &WechatClient{TokenServer: tokenServer}
+
+	if token, err := clt.Token(); err != nil || token != "old_token" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+
+	// 中控服务器已经更新了 access_token, 不需要刷新
+	tokenServer.token = "other_token"
+	if token, err := clt.GetNewToken(); err != nil || token != "other_token" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+	if tokenServer.refreshCount != 0 {
+		t.Errorf("refreshCount mismatch, have: %d, want: 0", tokenServer.refreshCount)
+	}
+
+	// 中控服务器的 access_token 和缓存的一样, 需要刷新
+	if token, err := clt.GetNewToken(); err != nil || token != "new_token" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+	if tokenServer.refreshCount != 1 {
+		t.Errorf("refreshCount mismatch, have: %d, want: 1", tokenServer.refreshCount)
+	}
+
+	// WithContext 的拷贝继承缓存的 access_token
+	if token, err := clt.WithContext(context.Background()).GetNewToken(); err != nil || token != "new_token" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+	if tokenServer.refreshCount != 2 {
+		t.Errorf("refreshCount mismatch, have: %d, want: 2", tokenServer.refreshCount)
+	}
+}
@@ -7,12 +7,10 @@ package mp
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
+	"context"
 	"io"
 	"net/http"
 	"os"
-	"reflect"
 	"strings"
 )
 
@@ -50,30 +48,36 @@ func escapeQuotes(s string) string {
 //
 //  NOTE:
 //  1. 一般不用调用这个方法, 请直接调用高层次的封装方法;
-//  2. 最终的 URL == incompleteURL + access_token;
+//  2. 最终的 URL == clt.ResolveURL(incompleteURL) + access_token;
 //  3. 参数 filename 不是文件路径, 是指定 multipart/form-data 里面文件名称
-//  4. response 要求是 struct 的指针, 并且该 struct 拥有属性:
-//     ErrCode int `json:"errcode"` (可以是直接属性, 也可以是匿名属性里的属性)
+//  4. response 一般是嵌入了 Error 的 struct 的指针, 参考 Response.
 func (clt *WechatClient) UploadFromReader(incompleteURL, filename string,
-	reader io.Reader, response interface{}) (err error) {
+	reader io.Reader, response Response) (err error) {
+
+	return clt.UploadFromReaderContext(clt.Context(), incompleteURL, filename, reader, response)
+}
+
+// 同 UploadFromReader, 请求绑定到 ctx 上.
+func (clt *WechatClient) UploadFromReaderContext(ctx context.Context, incompleteURL, filename string,
+	reader io.Reader, response Response) (err error) {
 
 	filename = escapeQuotes(filename)
 	switch v := reader.(type) {
 	case *os.File:
-		return clt.uploadFromOSFile(incompleteURL, filename, v, response)
+		return clt.uploadFromOSFile(ctx, incompleteURL, filename, v, response)
 	case *bytes.Buffer:
-		return clt.uploadFromBytesBuffer(incompleteURL, filename, v, response)
+		return clt.uploadFromBytes(ctx, incompleteURL, filename, v.Bytes(), response)
 	case *bytes.Reader:
-		return clt.uploadFromBytesReader(incompleteURL, filename, v, response)
+		return clt.uploadFromSeeker(ctx, incompleteURL, filename, v, int64(v.Len()), response)
 	case *strings.Reader:
-		return clt.uploadFromStringsReader(incompleteURL, filename, v, response)
+		return clt.uploadFromSeeker(ctx, incompleteURL, filename, v, int64(v.Len()), response)
 	default:
-		return clt.uploadFromIOReader(incompleteURL, filename, v, response)
+		return clt.uploadFromIOReader(ctx, incompleteURL, filename, v, response)
 	}
 }
 
-func (clt *WechatClient) uploadFromOSFile(incompleteURL, filename string,
-	file *os.File, response interface{}) (err error) {
+func (clt *WechatClient) uploadFromOSFile(ctx context.Context, incompleteURL, filename string,
+	file *os.File, response Response) (err error) {
 
 	fi, err := file.Stat()
 	if err != nil {
@@ -81,336 +85,67 @@ func (clt *WechatClient) uploadFromOSFile(incompleteURL, filename string,
 	}
 
 	if !fi.Mode().IsRegular() {
-		return clt.uploadFromIOReader(incompleteURL, filename, file, response)
+		return clt.uploadFromIOReader(ctx, incompleteURL, filename, file, response)
 	}
 
 	originalOffset, err := file.Seek(0, 1)
 	if err != nil {
 		return
 	}
-	ContentLength := int64(multipartConstPartLen+len(filename)) + fi.Size() - originalOffset
-
-	token, err := clt.Token()
-	if err != nil {
-		return
-	}
-
-	hasRetried := false
-RETRY:
-	finalURL := incompleteURL + token
-
-	if hasRetried {
-		if _, err = file.Seek(originalOffset, 0); err != nil {
-			return
-		}
-	}
-	mr := io.MultiReader(
-		strings.NewReader(multipartFormDataFront),
-		strings.NewReader(filename),
-		strings.NewReader(multipartFormDataMiddle),
-		file,
-		strings.NewReader(multipartFormDataEnd),
-	)
-
-	httpReq, err := http.NewRequest("POST", finalURL, mr)
-	if err != nil {
-		return
-	}
-	httpReq.Header.Set("Content-Type", multipartContentType)
-	httpReq.ContentLength = ContentLength
-
-	httpResp, err := clt.HttpClient.Do(httpReq)
-	if err != nil {
-		return
-	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("http.Status: %s", httpResp.Status)
-		return
-	}
-
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
-		return
-	}
-
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
-	case ErrCodeOK:
-		return
-	case ErrCodeInvalidCredential, ErrCodeTimeout:
-		if !hasRetried {
-			hasRetried = true
-
-			if token, err = clt.GetNewToken(); err != nil {
-				return
-			}
-			goto RETRY
-		}
-		fallthrough
-	default:
-		return
-	}
-}
-
-func (clt *WechatClient) uploadFromBytesBuffer(incompleteURL, filename string,
-	buffer *bytes.Buffer, response interface{}) (err error) {
-
-	fileBytes := buffer.Bytes()
-	ContentLength := int64(multipartConstPartLen + len(filename) + len(fileBytes))
-
-	token, err := clt.Token()
-	if err != nil {
-		return
-	}
-
-	hasRetried := false
-RETRY:
-	finalURL := incompleteURL + token
-
-	mr := io.MultiReader(
-		strings.NewReader(multipartFormDataFront),
-		strings.NewReader(filename),
-		strings.NewReader(multipartFormDataMiddle),
-		bytes.NewReader(fileBytes),
-		strings.NewReader(multipartFormDataEnd),
-	)
-
-	httpReq, err := http.NewRequest("POST", finalURL, mr)
-	if err != nil {
-		return
-	}
-	httpReq.Header.Set("Content-Type", multipartContentType)
-	httpReq.ContentLength = ContentLength
-
-	httpResp, err := clt.HttpClient.Do(httpReq)
-	if err != nil {
-		return
-	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("http.Status: %s", httpResp.Status)
-		return
-	}
-
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
-		return
-	}
-
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
-	case ErrCodeOK:
-		return
-	case ErrCodeInvalidCredential, ErrCodeTimeout:
-		if !hasRetried {
-			hasRetried = true
-
-			if token, err = clt.GetNewToken(); err != nil {
-				return
-			}
-			goto RETRY
-		}
-		fallthrough
-	default:
-		return
-	}
+	return clt.uploadFromSeeker(ctx, incompleteURL, filename, file, fi.Size()-originalOffset, response)
 }
 
-func (clt *WechatClient) uploadFromBytesReader(incompleteURL, filename string,
-	reader *bytes.Reader, response interface{}) (err error) {
+// 上传 reader 从当前位置开始的 size 个字节, 重试的时候 reader 会 Seek 到最初的位置.
+func (clt *WechatClient) uploadFromSeeker(ctx context.Context, incompleteURL, filename string,
+	reader io.ReadSeeker, size int64, response Response) (err error) {
 
 	originalOffset, err := reader.Seek(0, 1)
 	if err != nil {
 		return
 	}
-	ContentLength := int64(multipartConstPartLen + len(filename) + reader.Len())
-
-	token, err := clt.Token()
-	if err != nil {
-		return
-	}
-
-	hasRetried := false
-RETRY:
-	finalURL := incompleteURL + token
-
-	if hasRetried {
-		if _, err = reader.Seek(originalOffset, 0); err != nil {
-			return
-		}
-	}
-	mr := io.MultiReader(
-		strings.NewReader(multipartFormDataFront),
-		strings.NewReader(filename),
-		strings.NewReader(multipartFormDataMiddle),
-		reader,
-		strings.NewReader(multipartFormDataEnd),
-	)
-
-	httpReq, err := http.NewRequest("POST", finalURL, mr)
-	if err != nil {
-		return
-	}
-	httpReq.Header.Set("Content-Type", multipartContentType)
-	httpReq.ContentLength = ContentLength
-
-	httpResp, err := clt.HttpClient.Do(httpReq)
-	if err != nil {
-		return
-	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("http.Status: %s", httpResp.Status)
-		return
-	}
-
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
-		return
-	}
-
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
+	ContentLength := int64(multipartConstPartLen+len(filename)) + size
 
-	switch ErrCode {
-	case ErrCodeOK:
-		return
-	case ErrCodeInvalidCredential, ErrCodeTimeout:
-		if !hasRetried {
-			hasRetried = true
-
-			if token, err = clt.GetNewToken(); err != nil {
-				return
+	hasCalled := false
+	newRequest := func(finalURL string) (*http.Request, error) {
+		if hasCalled {
+			if _, err := reader.Seek(originalOffset, 0); err != nil {
+				return nil, err
 			}
-			goto RETRY
 		}
-		fallthrough
-	default:
-		return
-	}
-}
-
-func (clt *WechatClient) uploadFromStringsReader(incompleteURL, filename string,
-	reader *strings.Reader, response interface{}) (err error) {
-
-	originalOffset, err := reader.Seek(0, 1)
-	if err != nil {
-		return
-	}
-	ContentLength := int64(multipartConstPartLen + len(filename) + reader.Len())
-
-	token, err := clt.Token()
-	if err != nil {
-		return
-	}
-
-	hasRetried := false
-RETRY:
-	finalURL := incompleteURL + token
-
-	if hasRetried {
-		if _, err = reader.Seek(originalOffset, 0); err != nil {
-			return
+		hasCalled = true
+
+		mr := io.MultiReader(
+			strings.NewReader(multipartFormDataFront),
+			strings.NewReader(filename),
+			strings.NewReader(multipartFormDataMiddle),
+			reader,
+			strings.NewReader(multipartFormDataEnd),
+		)
+
+		httpReq, err := http.NewRequest("POST", finalURL, mr)
+		if err != nil {
+			return nil, err
 		}
+		httpReq.Header.Set("Content-Type", multipartContentType)
+		httpReq.ContentLength = ContentLength
+		return httpReq, nil
 	}
-	mr := io.MultiReader(
-		strings.NewReader(multipartFormDataFront),
-		strings.NewReader(filename),
-		strings.NewReader(multipartFormDataMiddle),
-		reader,
-		strings.NewReader(multipartFormDataEnd),
-	)
-
-	httpReq, err := http.NewRequest("POST", finalURL, mr)
-	if err != nil {
-		return
-	}
-	httpReq.Header.Set("Content-Type", multipartContentType)
-	httpReq.ContentLength = ContentLength
-
-	httpResp, err := clt.HttpClient.Do(httpReq)
-	if err != nil {
-		return
-	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("http.Status: %s", httpResp.Status)
-		return
-	}
-
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
-		return
+	call := &Call{
+		URL:      incompleteURL,
+		Method:   "POST",
+		Response: response,
 	}
+	return clt.doJSON(ctx, call, newRequest)
+}
 
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
-	case ErrCodeOK:
-		return
-	case ErrCodeInvalidCredential, ErrCodeTimeout:
-		if !hasRetried {
-			hasRetried = true
+func (clt *WechatClient) uploadFromBytes(ctx context.Context, incompleteURL, filename string,
+	fileBytes []byte, response Response) (err error) {
 
-			if token, err = clt.GetNewToken(); err != nil {
-				return
-			}
-			goto RETRY
-		}
-		fallthrough
-	default:
-		return
-	}
+	return clt.uploadFromSeeker(ctx, incompleteURL, filename, bytes.NewReader(fileBytes), int64(len(fileBytes)), response)
 }
 
-func (clt *WechatClient) uploadFromIOReader(incompleteURL, filename string,
-	reader io.Reader, response interface{}) (err error) {
+func (clt *WechatClient) uploadFromIOReader(ctx context.Context, incompleteURL, filename string,
+	reader io.Reader, response Response) (err error) {
 
 	bodyBuf := mediaBufferPool.Get().(*bytes.Buffer)
 	bodyBuf.Reset()
@@ -426,57 +161,18 @@ func (clt *WechatClient) uploadFromIOReader(incompleteURL, filename string,
 
 	bodyBytes := bodyBuf.Bytes()
 
-	token, err := clt.Token()
-	if err != nil {
-		return
-	}
-
-	hasRetried := false
-RETRY:
-	finalURL := incompleteURL + token
-
-	httpResp, err := clt.HttpClient.Post(finalURL, multipartContentType, bytes.NewReader(bodyBytes))
-	if err != nil {
-		return
-	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("http.Status: %s", httpResp.Status)
-		return
-	}
-
-	if err = json.NewDecoder(httpResp.Body).Decode(response); err != nil {
-		return
-	}
-
-	// 请注意:
-	// 下面获取 ErrCode 的代码不具备通用性!!!
-	//
-	// 因为本 SDK 的 response 都是
-	//  struct {
-	//    Error
-	//    XXX
-	//  }
-	// 的结构, 所以用下面简单的方法得到 ErrCode.
-	//
-	// 如果你是直接调用这个函数, 那么要根据你的 response 数据结构修改下面的代码.
-	ErrCode := reflect.ValueOf(response).Elem().FieldByName("ErrCode").Int()
-
-	switch ErrCode {
-	case ErrCodeOK:
-		return
-	case ErrCodeInvalidCredential, ErrCodeTimeout:
-		if !hasRetried {
-			hasRetried = true
-
-			if token, err = clt.GetNewToken(); err != nil {
-				return
-			}
-			goto RETRY
+	newRequest := func(finalURL string) (*http.Request, error) {
+		httpReq, err := http.NewRequest("POST", finalURL, bytes.NewReader(bodyBytes))
+		if err != nil {
+			return nil, err
 		}
-		fallthrough
-	default:
-		return
+		httpReq.Header.Set("Content-Type", multipartContentType)
+		return httpReq, nil
+	}
+	call := &Call{
+		URL:      incompleteURL,
+		Method:   "POST",
+		Response: response,
 	}
+	return clt.doJSON(ctx, call, newRequest)
 }
@@ -0,0 +1,466 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultTickDuration = time.Minute // 设置 44 秒以上就不会超过限制(2000次/日)
+
+var errRefresherStopped = errors.New("mp: credential refresher stopped before first use")
+
+// 从微信服务器获取一个凭证(access_token, jsapi_ticket 等), 请求要绑定到 ctx 上,
+// expiresIn 是凭证的有效期, 应该已经减去了缓冲的时间, 参考 BufferedExpiresIn.
+//  后台的定时刷新和第一次获取的 ctx 是 context.Background(), fetch 自己要限制超时.
+type CredentialFetcher func(ctx context.Context) (credential string, expiresIn time.Duration, err error)
+
+// 由于网络的延时, 凭证的过期时间要留一个缓冲区, 返回微信服务器返回的 expires_in(单位: 秒)
+// 减去缓冲区之后的有效期; 正常情况下微信服务器会返回 7200, 则缓冲区的大小为 10 分钟.
+func BufferedExpiresIn(expiresIn int64) (time.Duration, error) {
+	switch {
+	case expiresIn > 60*60:
+		expiresIn -= 60 * 10
+	case expiresIn > 60*30:
+		expiresIn -= 60 * 5
+	case expiresIn > 60*5:
+		expiresIn -= 60
+	case expiresIn > 60:
+		expiresIn -= 10
+	case expiresIn > 0:
+	default:
+		return 0, errors.New("invalid expires_in: " + strconv.FormatInt(expiresIn, 10))
+	}
+	return time.Duration(expiresIn) * time.Second, nil
+}
+
+// access_token, jsapi_ticket 等会过期的凭证的自动刷新, 是 DefaultTokenServer 和
+// jssdk.DefaultTicketServer 的公共部分, 实现自己的中控服务器的时候也可以使用.
+//  NOTE:
+//  1. 第一次调用 Credential() 或者 Refresh() 的时候才会获取凭证并启动后台的 goroutine,
+//     凭证过期之前后台会自动刷新, 不再使用的时候请调用 Close() 或者 Stop(ctx) 停止这个 goroutine;
+//  2. 没有设置 TokenStore 的时候, 同一个凭证整个系统只能有一个 CredentialRefresher 实例;
+//     设置了 TokenStore 则多个副本通过 TokenStore 共享凭证, 参考 SetStore.
+type CredentialRefresher struct {
+	fetch CredentialFetcher
+
+	store    TokenStore
+	storeKey string
+	owner    string // 本副本的标识, 用于获取 TokenStore 的租约
+
+	// 按需获取的模式, 参考 newOnDemandCredentialRefresher.
+	onDemand bool
+	schedule func(tickDuration time.Duration) // 按需获取的模式下每次获取之后调用, 可以为 nil
+
+	// 缓存最后一次获取的凭证的结果.
+	// goroutine autoUpdate() 里有个定时器, 每次触发都会更新 current.
+	current struct {
+		rwmutex    sync.RWMutex
+		status     RefreshStatus
+		credential string
+		expiresAt  time.Time
+		err        error
+	}
+
+	// goroutine autoUpdate() 监听 resetTickChan,
+	// 如果有新的数据, 则重置定时器, 定时时间为 resetTickChan 传过来的数据.
+	//  NOTE: 容量为 1, 发送的时候不会阻塞, 参考 resetTick.
+	resetTickChan chan time.Duration
+
+	refresh struct {
+		mutex            sync.Mutex
+		lastGetTimestamp int64 // 最后一次获取凭证的时间戳
+	}
+
+	lifecycle struct {
+		startOnce sync.Once
+		mutex     sync.Mutex
+		started   bool
+		closed    bool
+		stopChan  chan struct{} // Stop 的时候关闭
+		doneChan  chan struct{} // goroutine autoUpdate() 退出的时候关闭
+	}
+
+	notify struct {
+		mutex sync.Mutex
+		chans []chan<- RefreshEvent
+	}
+
+	// 每次成功获取凭证之后调用, 参数是更新后的状态.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnRefresh func(status RefreshStatus)
+
+	// 每次获取凭证失败之后调用, status.LastError 是这次的错误,
+	// status.ConsecutiveFailures 是连续失败的次数.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnError func(status RefreshStatus)
+}
+
+// 创建一个新的 CredentialRefresher, fetch 用于从微信服务器获取凭证.
+//  NOTE: 创建的时候不会获取凭证, 第一次使用的时候才获取.
+func NewCredentialRefresher(fetch CredentialFetcher) (r *CredentialRefresher) {
+	if fetch == nil {
+		panic("mp: nil CredentialFetcher")
+	}
+
+	r = &CredentialRefresher{
+		fetch:         fetch,
+		resetTickChan: make(chan time.Duration, 1),
+	}
+	r.lifecycle.stopChan = make(chan struct{})
+	r.lifecycle.doneChan = make(chan struct{})
+	return
+}
+
+// 创建一个按需获取的 CredentialRefresher, 用于 DistributedTokenServer 和 TokenManager.
+//  不启动后台的 goroutine, 没有获取过, 凭证过期了或者上次获取失败的时候, 在 Credential() 里同步的获取;
+//  如果 schedule != nil, 则每次 Refresh 之后调用 schedule 通知外部的调度器 tickDuration 之后调用 tick.
+func newOnDemandCredentialRefresher(fetch CredentialFetcher,
+	schedule func(tickDuration time.Duration)) (r *CredentialRefresher) {
+
+	r = NewCredentialRefresher(fetch)
+	r.onDemand = true
+	r.schedule = schedule
+	return
+}
+
+// 通过 store 和其他副本共享凭证, key 是凭证在 store 里的 key, 比如 "appid/jsapi_ticket".
+//  设置之后获取凭证的时候先读取 store, 只有获得 key 的租约的副本才去微信服务器获取.
+//  NOTE: 请在第一次使用之前调用.
+func (r *CredentialRefresher) SetStore(store TokenStore, key string) {
+	if store == nil {
+		panic("mp: nil TokenStore")
+	}
+	r.store = store
+	r.storeKey = key
+	r.owner = newLeaseOwner()
+}
+
+// 获取凭证并启动 goroutine autoUpdate, 只执行一次.
+//  如果已经 Stop 了则什么都不做.
+func (r *CredentialRefresher) start() {
+	r.lifecycle.startOnce.Do(func() {
+		r.lifecycle.mutex.Lock()
+		closed := r.lifecycle.closed
+		r.lifecycle.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		r.refresh.mutex.Lock()
+		tickDuration := r.update(r.fetchCredential(context.Background()))
+		r.refresh.lastGetTimestamp = time.Now().Unix()
+		r.refresh.mutex.Unlock()
+
+		r.lifecycle.mutex.Lock()
+		r.lifecycle.started = true
+		r.lifecycle.mutex.Unlock()
+		go r.autoUpdate(tickDuration)
+	})
+}
+
+// 停止后台的 goroutine, 并等待它退出或者 ctx 结束.
+//  Stop 之后 Credential() 返回最后一次获取的结果, Refresh() 仍然可以同步的获取凭证.
+//  可以多次调用.
+func (r *CredentialRefresher) Stop(ctx context.Context) error {
+	r.lifecycle.mutex.Lock()
+	if !r.lifecycle.closed {
+		r.lifecycle.closed = true
+		close(r.lifecycle.stopChan)
+	}
+	r.lifecycle.mutex.Unlock()
+
+	// 如果 start 正在执行则等待它完成; 如果还没有执行则以后也不会再执行.
+	r.lifecycle.startOnce.Do(func() {})
+
+	r.lifecycle.mutex.Lock()
+	started := r.lifecycle.started
+	r.lifecycle.mutex.Unlock()
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-r.lifecycle.doneChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 停止后台的 goroutine 并等待它退出, 实现了 io.Closer.
+func (r *CredentialRefresher) Close() error {
+	return r.Stop(context.Background())
+}
+
+// 每次获取凭证之后(不管成功失败)都会往 ch 发送一个 RefreshEvent.
+//  发送是非阻塞的, 如果 ch 满了则丢弃这个事件, 所以 ch 一般要有缓冲, 参考 signal.Notify.
+func (r *CredentialRefresher) Notify(ch chan<- RefreshEvent) {
+	if ch == nil {
+		panic("mp: Notify using nil channel")
+	}
+	r.notify.mutex.Lock()
+	r.notify.chans = append(r.notify.chans, ch)
+	r.notify.mutex.Unlock()
+}
+
+// 不再往 ch 发送 RefreshEvent.
+func (r *CredentialRefresher) StopNotify(ch chan<- RefreshEvent) {
+	r.notify.mutex.Lock()
+	defer r.notify.mutex.Unlock()
+
+	for i, c := range r.notify.chans {
+		if c == ch {
+			r.notify.chans = append(r.notify.chans[:i], r.notify.chans[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *CredentialRefresher) emit(event RefreshEvent) {
+	r.notify.mutex.Lock()
+	defer r.notify.mutex.Unlock()
+
+	for _, ch := range r.notify.chans {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// 获取新的凭证; 设置了 TokenStore 则优先使用别的副本获取的凭证.
+func (r *CredentialRefresher) fetchCredential(ctx context.Context) (credential string, expiresIn time.Duration, err error) {
+	if r.store == nil {
+		return r.fetch(ctx)
+	}
+
+	r.current.rwmutex.RLock()
+	staleCredential := r.current.credential
+	r.current.rwmutex.RUnlock()
+
+	entry, err := leasedRefresh(ctx, r.store, r.storeKey, r.owner, staleCredential, func(ctx context.Context) (*TokenEntry, error) {
+		credential, expiresIn, err := r.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &TokenEntry{Token: credential, ExpiresAt: time.Now().Add(expiresIn)}, nil
+	})
+	if err != nil {
+		return
+	}
+	return entry.Token, time.Until(entry.ExpiresAt), nil
+}
+
+// 根据 fetchCredential 的结果更新 current 并发送 RefreshEvent, 返回下次定时获取的间隔.
+//  获取失败的时候, 如果之前的凭证还没有过期则继续使用, 只记录错误, 参考 cached.
+func (r *CredentialRefresher) update(credential string, expiresIn time.Duration, err error) (tickDuration time.Duration) {
+	event := RefreshEvent{Time: time.Now()}
+
+	r.current.rwmutex.Lock()
+	if err != nil {
+		if !event.Time.Before(r.current.expiresAt) {
+			r.current.credential = ""
+			r.current.expiresAt = time.Time{}
+		}
+		r.current.err = err
+		event.Err = err
+		tickDuration = defaultTickDuration
+	} else {
+		r.current.credential = credential
+		r.current.expiresAt = event.Time.Add(expiresIn)
+		r.current.err = nil
+		event.ExpiresIn = expiresIn
+		tickDuration = expiresIn
+		if tickDuration < time.Second { // 从 TokenStore 读取的凭证可能马上就要过期了
+			tickDuration = time.Second
+		}
+	}
+	r.current.status.Update(event)
+	status := r.current.status
+	r.current.rwmutex.Unlock()
+
+	r.emit(event)
+	if event.Err != nil {
+		if r.OnError != nil {
+			r.OnError(status)
+		}
+	} else {
+		if r.OnRefresh != nil {
+			r.OnRefresh(status)
+		}
+	}
+	return
+}
+
+// 获取凭证的刷新状态, 实现了 StatusReporter.
+func (r *CredentialRefresher) Status() (status RefreshStatus) {
+	r.current.rwmutex.RLock()
+	status = r.current.status
+	r.current.rwmutex.RUnlock()
+	return
+}
+
+// 通知 goroutine autoUpdate() 重置定时器, 不会阻塞.
+//  如果之前的通知还没有被处理, 则用新的替换.
+func (r *CredentialRefresher) resetTick(tickDuration time.Duration) {
+	for {
+		select {
+		case r.resetTickChan <- tickDuration:
+			return
+		default:
+		}
+		select {
+		case <-r.resetTickChan:
+		default:
+		}
+	}
+}
+
+// 获取缓存的凭证.
+func (r *CredentialRefresher) Credential() (credential string, err error) {
+	credential, _, err = r.CredentialWithExpiry()
+	return
+}
+
+// 同 Credential, 同时返回凭证的过期时间(已经减去了缓冲的时间).
+func (r *CredentialRefresher) CredentialWithExpiry() (credential string, expiresAt time.Time, err error) {
+	return r.CredentialWithExpiryContext(context.Background())
+}
+
+// 同 CredentialWithExpiry, 按需获取的模式下需要获取凭证的时候请求绑定到 ctx 上.
+//  NOTE: 不是按需获取的模式下, 第一次获取凭证是所有调用者共享的, 不绑定到 ctx 上.
+func (r *CredentialRefresher) CredentialWithExpiryContext(ctx context.Context) (credential string, expiresAt time.Time, err error) {
+	if !r.onDemand {
+		r.start()
+		return r.cached()
+	}
+
+	if credential, expiresAt, err = r.cached(); credential != "" && time.Now().Before(expiresAt) {
+		return
+	}
+	if _, err = r.RefreshContext(ctx); err != nil {
+		return "", time.Time{}, err
+	}
+	return r.cached()
+}
+
+// 读取缓存的凭证.
+//  最后一次获取失败的时候, 之前的凭证没有过期则返回之前的凭证, 过期了才返回最后一次的错误.
+func (r *CredentialRefresher) cached() (credential string, expiresAt time.Time, err error) {
+	r.current.rwmutex.RLock()
+	credential = r.current.credential
+	expiresAt = r.current.expiresAt
+	err = r.current.err
+	r.current.rwmutex.RUnlock()
+
+	if err != nil {
+		if credential != "" && time.Now().Before(expiresAt) {
+			return credential, expiresAt, nil
+		}
+		return "", time.Time{}, err
+	}
+	if credential == "" {
+		err = errRefresherStopped // 启动之前就 Stop 了
+	}
+	return
+}
+
+// 马上获取新的凭证, 一般在当前的凭证被微信服务器认为无效的时候调用.
+//  等待的时候别的 goroutine 已经获取了新的凭证, 或者没有设置 TokenStore 并且 5 秒内获取过,
+//  则直接返回之前的结果; 设置了 TokenStore 则通过租约保证多个副本同时只有一个去获取.
+func (r *CredentialRefresher) Refresh() (credential string, err error) {
+	return r.RefreshContext(context.Background())
+}
+
+// 同 Refresh, 获取凭证的请求绑定到 ctx 上.
+//  ctx 结束导致的失败是调用者放弃了, 不是获取失败, 不更新缓存的凭证和状态, 下次调用会重新获取.
+func (r *CredentialRefresher) RefreshContext(ctx context.Context) (credential string, err error) {
+	if !r.onDemand {
+		r.start()
+	}
+	staleCredential, _, _ := r.cached()
+
+	r.refresh.mutex.Lock()
+	defer r.refresh.mutex.Unlock()
+
+	timeNow := time.Now().Unix()
+	if credential, _, err = r.cached(); credential != "" && credential != staleCredential {
+		return
+	}
+	if r.store == nil && timeNow < r.refresh.lastGetTimestamp+5 {
+		return
+	}
+
+	credential, expiresIn, err := r.fetchCredential(ctx)
+	if err != nil && ctx.Err() != nil {
+		return "", err
+	}
+	tickDuration := r.update(credential, expiresIn, err)
+	r.refresh.lastGetTimestamp = timeNow
+	if !r.onDemand {
+		r.resetTick(tickDuration)
+	} else if r.schedule != nil {
+		r.schedule(tickDuration)
+	}
+	return
+}
+
+// 定时获取凭证, 返回下次定时获取的间隔, goroutine autoUpdate() 和 TokenManager 的定时器触发的时候调用.
+//  如果 5 秒内获取过(比如刚刚调用了 Refresh), 则不再获取, 直接返回当前凭证剩余的有效期.
+func (r *CredentialRefresher) tick() (tickDuration time.Duration) {
+	r.refresh.mutex.Lock()
+	defer r.refresh.mutex.Unlock()
+
+	timeNow := time.Now().Unix()
+	if timeNow < r.refresh.lastGetTimestamp+5 {
+		credential, expiresAt, err := r.cached()
+		if err != nil || credential == "" {
+			return defaultTickDuration
+		}
+		if tickDuration = time.Until(expiresAt); tickDuration < time.Second {
+			tickDuration = time.Second
+		}
+		return
+	}
+
+	tickDuration = r.update(r.fetchCredential(context.Background())) // 出错则是 defaultTickDuration
+	r.refresh.lastGetTimestamp = timeNow
+	return
+}
+
+// 单独一个 goroutine 来定时获取凭证.
+//  tickDuration: 启动后初始 tickDuration.
+func (r *CredentialRefresher) autoUpdate(tickDuration time.Duration) {
+	defer close(r.lifecycle.doneChan)
+
+	var ticker *time.Ticker
+
+NEW_TICK_DURATION:
+	ticker = time.NewTicker(tickDuration)
+	for {
+		select {
+		case <-r.lifecycle.stopChan:
+			ticker.Stop()
+			return
+
+		case tickDuration = <-r.resetTickChan:
+			ticker.Stop()
+			goto NEW_TICK_DURATION
+
+		case <-ticker.C:
+			if newTickDuration := r.tick(); tickDuration != newTickDuration {
+				ticker.Stop()
+				tickDuration = newTickDuration
+				goto NEW_TICK_DURATION
+			}
+		}
+	}
+}
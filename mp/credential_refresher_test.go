@@ -0,0 +1,136 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCredentialRefresherStore(t *testing.T) {
+	var fetchCount int32
+	fetch := func(context.Context) (string, time.Duration, error) {
+		n := atomic.AddInt32(&fetchCount, 1)
+		return "ticket" + strconv.Itoa(int(n)), time.Hour, nil
+	}
+
+	// 两个副本共享一个 TokenStore, 只有一个会从微信服务器获取
+	store := new(MemoryTokenStore)
+	r1 := NewCredentialRefresher(fetch)
+	r1.SetStore(store, "appid/jsapi_ticket")
+	defer r1.Close()
+	r2 := NewCredentialRefresher(fetch)
+	r2.SetStore(store, "appid/jsapi_ticket")
+	defer r2.Close()
+
+	ticket1, err := r1.Credential()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket2, expiresAt, err := r2.CredentialWithExpiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket1 != "ticket1" || ticket2 != ticket1 {
+		t.Errorf("unexpected tickets: %q, %q", ticket1, ticket2)
+	}
+	if d := time.Until(expiresAt); d <= 0 || d > time.Hour {
+		t.Errorf("unexpected expiresAt: %v", expiresAt)
+	}
+
+	// r1 刷新之后 r2 刷新直接使用 r1 的结果
+	r1.refresh.lastGetTimestamp = 0
+	r2.refresh.lastGetTimestamp = 0
+	if ticket1, err = r1.Refresh(); err != nil || ticket1 != "ticket2" {
+		t.Fatalf("unexpected ticket: %q, err: %v", ticket1, err)
+	}
+	if ticket2, err = r2.Refresh(); err != nil || ticket2 != "ticket2" {
+		t.Fatalf("unexpected ticket: %q, err: %v", ticket2, err)
+	}
+	if n := atomic.LoadInt32(&fetchCount); n != 2 {
+		t.Errorf("fetchCount mismatch, have: %d, want: 2", n)
+	}
+}
+
+func TestCredentialRefresherOnDemand(t *testing.T) {
+	var (
+		fetchCount int32
+		fail       int32
+	)
+	fetch := func(context.Context) (string, time.Duration, error) {
+		n := atomic.AddInt32(&fetchCount, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			return "", 0, errors.New("fetch failed")
+		}
+		return "token" + strconv.Itoa(int(n)), time.Hour, nil
+	}
+
+	var scheduled []time.Duration
+	r := newOnDemandCredentialRefresher(fetch, func(tickDuration time.Duration) {
+		scheduled = append(scheduled, tickDuration)
+	})
+
+	// 第一次使用的时候同步获取, 不启动后台的 goroutine
+	if token, err := r.Credential(); err != nil || token != "token1" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+	r.Credential()
+	if n := atomic.LoadInt32(&fetchCount); n != 1 {
+		t.Errorf("fetchCount mismatch, have: %d, want: 1", n)
+	}
+	if len(scheduled) != 1 || scheduled[0] != time.Hour {
+		t.Errorf("unexpected scheduled: %v", scheduled)
+	}
+
+	// 过期之后同步获取
+	r.current.rwmutex.Lock()
+	r.current.expiresAt = time.Now().Add(-time.Second)
+	r.current.rwmutex.Unlock()
+	r.refresh.lastGetTimestamp = 0
+	if token, err := r.Credential(); err != nil || token != "token2" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+
+	// 刷新失败的时候 token2 还没有过期, 继续使用
+	atomic.StoreInt32(&fail, 1)
+	r.refresh.lastGetTimestamp = 0
+	if _, err := r.Refresh(); err == nil {
+		t.Fatal("want error")
+	}
+	if token, err := r.Credential(); err != nil || token != "token2" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+	if status := r.Status(); status.ConsecutiveFailures != 1 || status.LastError == nil {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// token2 过期之后返回最后一次的错误, 失败之后 5 秒内不会重复获取
+	r.current.rwmutex.Lock()
+	r.current.expiresAt = time.Now().Add(-time.Second)
+	r.current.rwmutex.Unlock()
+	if _, err := r.Credential(); err == nil {
+		t.Fatal("want error")
+	}
+	if n := atomic.LoadInt32(&fetchCount); n != 3 {
+		t.Errorf("fetchCount mismatch, have: %d, want: 3", n)
+	}
+	if d := r.tick(); d != defaultTickDuration {
+		t.Errorf("tickDuration mismatch, have: %v, want: %v", d, defaultTickDuration)
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	r.refresh.lastGetTimestamp = 0
+	if token, err := r.Credential(); err != nil || token != "token4" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+	if status := r.Status(); status.ConsecutiveFailures != 0 || status.LastError != nil {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
@@ -6,6 +6,7 @@
 package datacube
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/philsong/wechat2/mp"
@@ -32,3 +33,10 @@ func NewClient(TokenServer mp.TokenServer, HttpClient *http.Client) *Client {
 		},
 	}
 }
+
+// 返回 clt 的一个浅拷贝, 该拷贝发起的所有请求都绑定到 ctx 上.
+func (clt *Client) WithContext(ctx context.Context) *Client {
+	return &Client{
+		WechatClient: *clt.WechatClient.WithContext(ctx),
+	}
+}
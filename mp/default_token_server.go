@@ -6,47 +6,51 @@
 package mp
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
-	"sync"
 	"time"
 )
 
-const defaultTickDuration = time.Minute // 设置 44 秒以上就不会超过限制(2000次/日)
-
-var _ TokenServer = new(DefaultTokenServer)
+var _ ContextTokenServer = new(DefaultTokenServer)
 
 // TokenServer 的简单实现.
 //  NOTE:
-//  一般用于单进程环境, 因为 DefaultTokenServer 同时也实现了一个简单的中控服务器, 而不是简单的
-//  实现了 TokenServer 接口, 所以整个系统只能存在一个 DefaultTokenServer 实例!!!
+//  1. 一般用于单进程环境, 因为 DefaultTokenServer 同时也实现了一个简单的中控服务器, 而不是简单的
+//     实现了 TokenServer 接口, 所以整个系统只能存在一个 DefaultTokenServer 实例!!!
+//     多进程环境请使用 DistributedTokenServer;
+//  2. 第一次调用 Token() 或者 TokenRefresh() 的时候才会获取 access_token 并启动后台的 goroutine,
+//     不再使用的时候请调用 Close() 或者 Stop(ctx) 停止这个 goroutine.
 type DefaultTokenServer struct {
 	appid, appsecret string
 	httpClient       *http.Client
 
-	// 缓存最后一次从微信服务器获取的 access_token 的结果.
-	// goroutine tokenAutoUpdate() 里有个定时器, 每次触发都会更新 currentToken.
-	currentToken struct {
-		rwmutex sync.RWMutex
-		token   string
-		err     error
-	}
+	// 获取 access_token 使用的 Endpoint, 如果 Endpoint == nil 则使用 DefaultEndpoint.
+	//  一般和使用这个 TokenServer 的 WechatClient.Endpoint 相同.
+	//  NOTE: 请在第一次使用之前设置.
+	Endpoint *Endpoint
 
-	// goroutine tokenAutoUpdate() 监听 resetTokenRefreshTickChan,
-	// 如果有新的数据, 则重置定时器, 定时时间为 resetTokenRefreshTickChan 传过来的数据.
-	resetTokenRefreshTickChan chan time.Duration
+	// 获取 access_token 之前调用 Limiter.Wait(ctx, "/cgi-bin/token"), 如果 Limiter == nil 则不限流.
+	//  一般和 WechatClient.Limiter 是同一个 *QuotaLimiter, 这样获取 access_token 的次数也会计入配额.
+	//  NOTE: 请在第一次使用之前设置.
+	Limiter Limiter
 
-	tokenRefresh struct {
-		mutex            sync.Mutex
-		lastGetTimestamp int64 // 最后一次从服务器获取 access_token 的时间戳
-	}
+	refresher *CredentialRefresher
+
+	// 每次成功从微信服务器获取 access_token 之后调用, 参数是更新后的状态.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnRefresh func(status RefreshStatus)
+
+	// 每次从微信服务器获取 access_token 失败之后调用, status.LastError 是这次的错误,
+	// status.ConsecutiveFailures 是连续失败的次数.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnError func(status RefreshStatus)
 }
 
 // 创建一个新的 DefaultTokenServer.
 //  如果 httpClient == nil 则默认使用 http.DefaultClient.
+//  NOTE: 创建的时候不会获取 access_token, 第一次使用的时候才获取.
 func NewDefaultTokenServer(appid, appsecret string,
 	httpClient *http.Client) (srv *DefaultTokenServer) {
 
@@ -55,110 +59,75 @@ func NewDefaultTokenServer(appid, appsecret string,
 	}
 
 	srv = &DefaultTokenServer{
-		appid:                     appid,
-		appsecret:                 appsecret,
-		httpClient:                httpClient,
-		resetTokenRefreshTickChan: make(chan time.Duration),
+		appid:      appid,
+		appsecret:  appsecret,
+		httpClient: httpClient,
 	}
-
-	// 获取 access_token 并启动 goroutine tokenAutoUpdate
-	resp, err := srv.getToken()
-	if err != nil {
-		srv.currentToken.token = ""
-		srv.currentToken.err = err
-		go srv.tokenAutoUpdate(defaultTickDuration)
-	} else {
-		srv.currentToken.token = resp.Token
-		srv.currentToken.err = nil
-		go srv.tokenAutoUpdate(time.Duration(resp.ExpiresIn) * time.Second)
+	srv.refresher = NewCredentialRefresher(srv.getToken)
+	srv.refresher.OnRefresh = func(status RefreshStatus) {
+		if srv.OnRefresh != nil {
+			srv.OnRefresh(status)
+		}
+	}
+	srv.refresher.OnError = func(status RefreshStatus) {
+		if srv.OnError != nil {
+			srv.OnError(status)
+		}
 	}
-
 	return
 }
 
-func (srv *DefaultTokenServer) Token() (token string, err error) {
-	srv.currentToken.rwmutex.RLock()
-	token = srv.currentToken.token
-	err = srv.currentToken.err
-	srv.currentToken.rwmutex.RUnlock()
-	return
+// 停止后台的 goroutine, 并等待它退出或者 ctx 结束.
+//  Stop 之后 Token() 返回最后一次获取的结果, TokenRefresh() 仍然可以同步的获取 access_token.
+//  可以多次调用.
+func (srv *DefaultTokenServer) Stop(ctx context.Context) error {
+	return srv.refresher.Stop(ctx)
 }
 
-func (srv *DefaultTokenServer) TokenRefresh() (token string, err error) {
-	srv.tokenRefresh.mutex.Lock()
-	defer srv.tokenRefresh.mutex.Unlock()
+// 停止后台的 goroutine 并等待它退出, 实现了 io.Closer.
+func (srv *DefaultTokenServer) Close() error {
+	return srv.refresher.Close()
+}
 
-	timeNow := time.Now().Unix()
+// 每次从微信服务器获取 access_token 之后(不管成功失败)都会往 ch 发送一个 RefreshEvent.
+//  发送是非阻塞的, 如果 ch 满了则丢弃这个事件, 所以 ch 一般要有缓冲, 参考 signal.Notify.
+func (srv *DefaultTokenServer) Notify(ch chan<- RefreshEvent) {
+	srv.refresher.Notify(ch)
+}
 
-	// 如果 5 秒内调用过, 则直接返回原来调用的结果.
-	if timeNow < srv.tokenRefresh.lastGetTimestamp+5 {
-		return srv.Token()
-	}
+// 不再往 ch 发送 RefreshEvent.
+func (srv *DefaultTokenServer) StopNotify(ch chan<- RefreshEvent) {
+	srv.refresher.StopNotify(ch)
+}
 
-	resp, err := srv.getToken()
-	if err != nil {
-		srv.currentToken.rwmutex.Lock()
-		srv.currentToken.token = ""
-		srv.currentToken.err = err
-		srv.currentToken.rwmutex.Unlock()
-
-		srv.resetTokenRefreshTickChan <- defaultTickDuration
-	} else {
-		srv.currentToken.rwmutex.Lock()
-		srv.currentToken.token = resp.Token
-		srv.currentToken.err = nil
-		srv.currentToken.rwmutex.Unlock()
-
-		token = resp.Token
-		srv.resetTokenRefreshTickChan <- time.Duration(resp.ExpiresIn) * time.Second
-	}
+// 获取 access_token 的刷新状态, 实现了 StatusReporter.
+func (srv *DefaultTokenServer) Status() RefreshStatus {
+	return srv.refresher.Status()
+}
 
-	srv.tokenRefresh.lastGetTimestamp = timeNow ////
-	return
+func (srv *DefaultTokenServer) Token() (token string, err error) {
+	return srv.refresher.Credential()
 }
 
-// 单独一个 goroutine 来定时获取 access_token.
-//  tickDuration: 启动后初始 tickDuration.
-func (srv *DefaultTokenServer) tokenAutoUpdate(tickDuration time.Duration) {
-	var ticker *time.Ticker
-
-NEW_TICK_DURATION:
-	ticker = time.NewTicker(tickDuration)
-	for {
-		select {
-		case tickDuration = <-srv.resetTokenRefreshTickChan:
-			ticker.Stop()
-			goto NEW_TICK_DURATION
-
-		case <-ticker.C:
-			resp, err := srv.getToken()
-			if err != nil {
-				srv.currentToken.rwmutex.Lock()
-				srv.currentToken.token = ""
-				srv.currentToken.err = err
-				srv.currentToken.rwmutex.Unlock()
-
-				// 出错则重置到 defaultTickDuration
-				if tickDuration != defaultTickDuration {
-					ticker.Stop()
-					tickDuration = defaultTickDuration
-					goto NEW_TICK_DURATION
-				}
-			} else {
-				srv.currentToken.rwmutex.Lock()
-				srv.currentToken.token = resp.Token
-				srv.currentToken.err = nil
-				srv.currentToken.rwmutex.Unlock()
-
-				newTickDuration := time.Duration(resp.ExpiresIn) * time.Second
-				if tickDuration != newTickDuration {
-					ticker.Stop()
-					tickDuration = newTickDuration
-					goto NEW_TICK_DURATION
-				}
-			}
-		}
-	}
+// 同 Token, 同时返回 access_token 的过期时间, 实现了 ExpiringTokenServer.
+func (srv *DefaultTokenServer) TokenWithExpiry() (token string, expiresAt time.Time, err error) {
+	return srv.refresher.CredentialWithExpiry()
+}
+
+// 同 TokenWithExpiry, 实现了 ContextTokenServer.
+//  NOTE: 第一次获取 access_token 是所有调用者共享的, 不绑定到 ctx 上.
+func (srv *DefaultTokenServer) TokenWithExpiryContext(ctx context.Context) (token string, expiresAt time.Time, err error) {
+	return srv.refresher.CredentialWithExpiryContext(ctx)
+}
+
+// 如果 5 秒内从微信服务器获取过, 则直接返回原来获取的结果.
+func (srv *DefaultTokenServer) TokenRefresh() (token string, err error) {
+	return srv.refresher.Refresh()
+}
+
+// 同 TokenRefresh, 请求绑定到 ctx 上, 实现了 ContextTokenServer.
+func (srv *DefaultTokenServer) TokenRefreshContext(ctx context.Context) (token string, err error) {
+	return srv.refresher.RefreshContext(ctx)
 }
 
 type tokenResponse struct {
@@ -166,19 +135,57 @@ type tokenResponse struct {
 	ExpiresIn int64  `json:"expires_in"`   // 凭证有效时间，单位：秒
 }
 
-// 从微信服务器获取 access_token.
-func (srv *DefaultTokenServer) getToken() (resp *tokenResponse, err error) {
-	url := "https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=" +
-		srv.appid + "&secret=" + srv.appsecret
+// 从微信服务器获取 access_token, 实现了 CredentialFetcher.
+func (srv *DefaultTokenServer) getToken(ctx context.Context) (token string, expiresIn time.Duration, err error) {
+	resp, err := getToken(ctx, srv.httpClient, srv.Endpoint, srv.Limiter, srv.appid, srv.appsecret)
+	if err != nil {
+		return
+	}
+	return resp.Token, time.Duration(resp.ExpiresIn) * time.Second, nil
+}
+
+const (
+	tokenAPI = "/cgi-bin/token" // 获取 access_token 的 API, 用于 Limiter
+
+	// 一次 getToken(包括等待 Limiter)的超时时间, 调用者的 ctx 的 deadline 更早则以 ctx 为准.
+	//  要小于 defaultLeaseTTL, 保证持有刷新租约的副本在租约过期之前完成或者放弃, 不会有两个副本同时刷新.
+	defaultFetchTimeout = 10 * time.Second
+)
+
+// 从微信服务器获取 access_token, resp.ExpiresIn 已经减去了缓冲的时间.
+//  请求绑定到 ctx 上, 最多 defaultFetchTimeout;
+//  如果 endpoint == nil 则使用 DefaultEndpoint; 如果 limiter != nil 则获取之前调用 limiter.Wait.
+func getToken(ctx context.Context, httpClient *http.Client, endpoint *Endpoint, limiter Limiter,
+	appid, appsecret string) (resp *tokenResponse, err error) {
+
+	if endpoint == nil {
+		endpoint = DefaultEndpoint
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultFetchTimeout)
+	defer cancel()
 
-	httpResp, err := srv.httpClient.Get(url)
+	if limiter != nil {
+		if err = limiter.Wait(ctx, tokenAPI); err != nil {
+			return
+		}
+	}
+	url := endpoint.ResolveURL("https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=" +
+		appid + "&secret=" + appsecret)
+
+	httpReq, err := http.NewRequest("GET", url, nil)
 	if err != nil {
+		err = NewTransportError(url, 0, err)
+		return
+	}
+	httpResp, err := httpClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		err = NewTransportError(url, 0, err)
 		return
 	}
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("http.Status: %s", httpResp.Status)
+		err = NewTransportError(url, httpResp.StatusCode, fmt.Errorf("http.Status: %s", httpResp.Status))
 		return
 	}
 
@@ -187,38 +194,21 @@ func (srv *DefaultTokenServer) getToken() (resp *tokenResponse, err error) {
 		tokenResponse
 	}
 	if err = json.NewDecoder(httpResp.Body).Decode(&result); err != nil {
+		err = NewTransportError(url, httpResp.StatusCode, err)
 		return
 	}
 
 	if result.ErrCode != ErrCodeOK {
 		err = &result.Error
+		observeQuota(limiter, tokenAPI, err)
 		return
 	}
 
-	// 由于网络的延时, access_token 过期时间留了一个缓冲区;
-	// 正常情况下微信服务器会返回 7200, 则缓冲区的大小为 10 分钟.
-	switch {
-	case result.ExpiresIn > 60*60:
-		result.ExpiresIn -= 60 * 10
-		resp = &result.tokenResponse
-		return
-	case result.ExpiresIn > 60*30:
-		result.ExpiresIn -= 60 * 5
-		resp = &result.tokenResponse
-		return
-	case result.ExpiresIn > 60*5:
-		result.ExpiresIn -= 60
-		resp = &result.tokenResponse
-		return
-	case result.ExpiresIn > 60:
-		result.ExpiresIn -= 10
-		resp = &result.tokenResponse
-		return
-	case result.ExpiresIn > 0:
-		resp = &result.tokenResponse
-		return
-	default:
-		err = errors.New("invalid expires_in: " + strconv.FormatInt(result.ExpiresIn, 10))
+	expiresIn, err := BufferedExpiresIn(result.ExpiresIn)
+	if err != nil {
 		return
 	}
+	result.ExpiresIn = int64(expiresIn / time.Second)
+	resp = &result.tokenResponse
+	return
 }
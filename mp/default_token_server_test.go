@@ -0,0 +1,161 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDefaultTokenServerLifecycle(t *testing.T) {
+	var requestCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requestCount, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":7200}`, n)
+	}))
+	defer server.Close()
+
+	srv := NewDefaultTokenServer("appid", "secret", server.Client())
+	srv.Endpoint = &Endpoint{APIBaseURL: server.URL}
+	events := make(chan RefreshEvent, 4)
+	srv.Notify(events)
+
+	// 创建的时候不获取 access_token
+	if n := atomic.LoadInt32(&requestCount); n != 0 {
+		t.Errorf("requestCount mismatch, have: %d, want: 0", n)
+	}
+	token, err := srv.Token()
+	if err != nil || token != "token1" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+	if event := <-events; event.Err != nil || event.ExpiresIn != (7200-600)*time.Second {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	// 5 秒内 TokenRefresh 直接返回之前的结果, 并且不会阻塞
+	for i := 0; i < 3; i++ {
+		if token, err = srv.TokenRefresh(); err != nil || token != "token1" {
+			t.Errorf("unexpected token: %q, err: %v", token, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = srv.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 启动之前 Stop 则不会再启动
+	srv = NewDefaultTokenServer("appid", "secret", server.Client())
+	srv.Close()
+	if _, err = srv.Token(); err == nil {
+		t.Error("Token() after Close() should return error")
+	}
+	if n := atomic.LoadInt32(&requestCount); n != 1 {
+		t.Errorf("requestCount mismatch, have: %d, want: 1", n)
+	}
+}
+
+func TestDefaultTokenServerStatus(t *testing.T) {
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			io.WriteString(w, `{"errcode":40013,"errmsg":"invalid appid"}`)
+			return
+		}
+		io.WriteString(w, `{"access_token":"token","expires_in":7200}`)
+	}))
+	defer server.Close()
+
+	var refreshCount, errorCount int
+	srv := NewDefaultTokenServer("appid", "secret", server.Client())
+	srv.Endpoint = &Endpoint{APIBaseURL: server.URL}
+	srv.OnRefresh = func(status RefreshStatus) { refreshCount++ }
+	srv.OnError = func(status RefreshStatus) { errorCount++ }
+	defer srv.Close()
+
+	health := NewHealthHandler()
+	health.Register("appid/access_token", srv)
+
+	if _, err := srv.Token(); ClassOf(err) != ErrorClassInvalidRequest {
+		t.Errorf("unexpected err: %v", err)
+	}
+	if status := srv.Status(); status.ConsecutiveFailures != 1 || status.LastError == nil || errorCount != 1 {
+		t.Errorf("unexpected status: %+v, errorCount: %d", status, errorCount)
+	}
+	recorder := httptest.NewRecorder()
+	health.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code mismatch, have: %d, want: %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+
+	fail = false
+	srv.refresher.refresh.lastGetTimestamp = 0
+	if _, err := srv.TokenRefresh(); err != nil {
+		t.Fatal(err)
+	}
+	if status := srv.Status(); status.ConsecutiveFailures != 0 || !status.Healthy(time.Now()) || refreshCount != 1 {
+		t.Errorf("unexpected status: %+v, refreshCount: %d", status, refreshCount)
+	}
+	recorder = httptest.NewRecorder()
+	health.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"healthy":true`) {
+		t.Errorf("unexpected response: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDefaultTokenServerRefreshError(t *testing.T) {
+	var fail int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) != 0 {
+			io.WriteString(w, `{"errcode":-1,"errmsg":"system error"}`)
+			return
+		}
+		io.WriteString(w, `{"access_token":"token1","expires_in":7200}`)
+	}))
+	defer server.Close()
+
+	srv := NewDefaultTokenServer("appid", "secret", server.Client())
+	srv.Endpoint = &Endpoint{APIBaseURL: server.URL}
+	defer srv.Close()
+
+	token, expiresAt, err := srv.TokenWithExpiry()
+	if err != nil || token != "token1" {
+		t.Fatalf("unexpected token: %q, err: %v", token, err)
+	}
+
+	// 刷新失败不影响还没有过期的 access_token
+	atomic.StoreInt32(&fail, 1)
+	srv.refresher.refresh.lastGetTimestamp = 0
+	if _, err = srv.TokenRefresh(); ClassOf(err) != ErrorClassSystemBusy {
+		t.Errorf("unexpected err: %v", err)
+	}
+	token2, expiresAt2, err := srv.TokenWithExpiry()
+	if err != nil || token2 != token || !expiresAt2.Equal(expiresAt) {
+		t.Errorf("unexpected token: %q, expiresAt: %v, err: %v", token2, expiresAt2, err)
+	}
+	if status := srv.Status(); status.ConsecutiveFailures != 1 || status.LastError == nil {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// 过期之后返回最后一次的错误
+	srv.refresher.current.rwmutex.Lock()
+	srv.refresher.current.expiresAt = time.Now().Add(-time.Second)
+	srv.refresher.current.rwmutex.Unlock()
+	if _, err = srv.Token(); ClassOf(err) != ErrorClassSystemBusy {
+		t.Errorf("unexpected err: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+const (
+	defaultLeaseTTL          = 30 * time.Second       // 刷新租约的有效期, 要大于 defaultFetchTimeout
+	defaultLeaseWaitTimeout  = 15 * time.Second       // 等待别的副本刷新 access_token 的最长时间
+	defaultLeasePollInterval = 200 * time.Millisecond // 等待的时候轮询 TokenStore 的间隔
+)
+
+var _ ContextTokenServer = new(DistributedTokenServer)
+
+// 多副本(多进程)环境下的 TokenServer.
+//  所有副本通过 TokenStore 共享 access_token, access_token 过期(或者失效)的时候,
+//  只有获得刷新租约的副本去微信服务器获取新的 access_token, 其他的副本等待并读取 TokenStore.
+//  和 DefaultTokenServer 不同, DistributedTokenServer 没有后台的 goroutine, 只有在需要的时候才刷新,
+//  所以系统里可以存在任意多个实例.
+type DistributedTokenServer struct {
+	appid, appsecret string
+	httpClient       *http.Client
+
+	// 获取 access_token 使用的 Endpoint, 如果 Endpoint == nil 则使用 DefaultEndpoint.
+	//  NOTE: 请在第一次使用之前设置.
+	Endpoint *Endpoint
+
+	// 获取 access_token 之前调用 Limiter.Wait(ctx, "/cgi-bin/token"), 如果 Limiter == nil 则不限流.
+	//  NOTE: 请在第一次使用之前设置.
+	Limiter Limiter
+
+	refresher *CredentialRefresher // 按需获取的模式, 以 appid 为 key 设置了 TokenStore
+
+	// 本副本得到新的 access_token(自己刷新的或者从 TokenStore 读取的)之后调用.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnRefresh func(status RefreshStatus)
+
+	// 获取 access_token 失败之后调用, status.LastError 是这次的错误.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnError func(status RefreshStatus)
+}
+
+// 创建一个新的 DistributedTokenServer.
+//  store 是所有副本共享的 TokenStore, 以 appid 为 key;
+//  如果 httpClient == nil 则默认使用 http.DefaultClient.
+func NewDistributedTokenServer(appid, appsecret string, store TokenStore,
+	httpClient *http.Client) (srv *DistributedTokenServer) {
+
+	if store == nil {
+		panic("mp: nil TokenStore")
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	srv = &DistributedTokenServer{
+		appid:      appid,
+		appsecret:  appsecret,
+		httpClient: httpClient,
+	}
+	srv.refresher = newOnDemandCredentialRefresher(srv.getToken, nil)
+	srv.refresher.SetStore(store, appid)
+	srv.refresher.OnRefresh = func(status RefreshStatus) {
+		if srv.OnRefresh != nil {
+			srv.OnRefresh(status)
+		}
+	}
+	srv.refresher.OnError = func(status RefreshStatus) {
+		if srv.OnError != nil {
+			srv.OnError(status)
+		}
+	}
+	return
+}
+
+// 生成副本的标识: hostname-pid-随机数
+func newLeaseOwner() string {
+	hostname, _ := os.Hostname()
+	return hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + util.NewNonce()
+}
+
+// 获取 access_token 的状态, 实现了 StatusReporter.
+//  NOTE: LastRefresh, LastSuccess 包括从 TokenStore 读取到新的 access_token 的时间.
+func (srv *DistributedTokenServer) Status() RefreshStatus {
+	return srv.refresher.Status()
+}
+
+func (srv *DistributedTokenServer) Token() (token string, err error) {
+	return srv.refresher.Credential()
+}
+
+// 同 Token, 同时返回 access_token 的过期时间, 实现了 ExpiringTokenServer.
+func (srv *DistributedTokenServer) TokenWithExpiry() (token string, expiresAt time.Time, err error) {
+	return srv.refresher.CredentialWithExpiry()
+}
+
+// 当前的 access_token 被微信服务器认为无效的时候调用, 会获取新的 access_token.
+//  如果别的副本已经刷新过了, 则直接返回别的副本刷新的结果.
+func (srv *DistributedTokenServer) TokenRefresh() (token string, err error) {
+	return srv.refresher.Refresh()
+}
+
+// 同 TokenWithExpiry, 需要获取 access_token 的时候请求绑定到 ctx 上, 实现了 ContextTokenServer.
+func (srv *DistributedTokenServer) TokenWithExpiryContext(ctx context.Context) (token string, expiresAt time.Time, err error) {
+	return srv.refresher.CredentialWithExpiryContext(ctx)
+}
+
+// 同 TokenRefresh, 请求和等待别的副本刷新都绑定到 ctx 上, 实现了 ContextTokenServer.
+func (srv *DistributedTokenServer) TokenRefreshContext(ctx context.Context) (token string, err error) {
+	return srv.refresher.RefreshContext(ctx)
+}
+
+// 从微信服务器获取 access_token, 实现了 CredentialFetcher.
+func (srv *DistributedTokenServer) getToken(ctx context.Context) (token string, expiresIn time.Duration, err error) {
+	resp, err := getToken(ctx, srv.httpClient, srv.Endpoint, srv.Limiter, srv.appid, srv.appsecret)
+	if err != nil {
+		return
+	}
+	return resp.Token, time.Duration(resp.ExpiresIn) * time.Second, nil
+}
+
+// 通过 store 获取 key 对应的一个有效的并且不等于 staleToken 的凭证.
+//  只有获得租约的副本才调用 fetch 从微信服务器获取并保存到 store, 其他的副本轮询 store 等待结果;
+//  ctx 结束则不再等待.
+func leasedRefresh(ctx context.Context, store TokenStore, key, owner, staleToken string,
+	fetch func(ctx context.Context) (*TokenEntry, error)) (entry *TokenEntry, err error) {
+
+	deadline := time.Now().Add(defaultLeaseWaitTimeout)
+	for {
+		if entry, err = store.Load(key); err != nil {
+			return nil, err
+		}
+		if entry.Valid(time.Now()) && entry.Token != staleToken {
+			return
+		}
+
+		var ok bool
+		if ok, err = store.AcquireLease(key, owner, defaultLeaseTTL); err != nil {
+			return nil, err
+		}
+		if ok {
+			return refreshWithLease(ctx, store, key, owner, staleToken, fetch)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("mp: timeout waiting for another replica to refresh " + key)
+		}
+		timer := time.NewTimer(defaultLeasePollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 持有租约的时候调用 fetch 获取新的凭证并保存到 store.
+func refreshWithLease(ctx context.Context, store TokenStore, key, owner, staleToken string,
+	fetch func(ctx context.Context) (*TokenEntry, error)) (entry *TokenEntry, err error) {
+
+	defer store.ReleaseLease(key, owner)
+
+	// 获取租约之前别的副本可能刚刚刷新完成
+	if entry, err = store.Load(key); err != nil {
+		return nil, err
+	}
+	if entry.Valid(time.Now()) && entry.Token != staleToken {
+		return
+	}
+
+	if entry, err = fetch(ctx); err != nil {
+		return nil, err
+	}
+	if err = store.Save(key, entry); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,74 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDistributedTokenServer(t *testing.T) {
+	var requestCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requestCount, 1)
+		time.Sleep(50 * time.Millisecond) // 让其他副本等待租约
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":7200}`, n)
+	}))
+	defer server.Close()
+
+	store, err := NewFileTokenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := []TokenStore{new(MemoryTokenStore), store, newFakeSQLTokenStore(t)}
+
+	for _, store := range stores {
+		atomic.StoreInt32(&requestCount, 0)
+
+		// 多个副本同时获取 access_token, 只有一个副本去微信服务器获取
+		replicas := make([]*DistributedTokenServer, 5)
+		for i := range replicas {
+			replicas[i] = NewDistributedTokenServer("appid", "secret", store, server.Client())
+			replicas[i].Endpoint = &Endpoint{APIBaseURL: server.URL}
+		}
+		var wg sync.WaitGroup
+		for _, srv := range replicas {
+			wg.Add(1)
+			go func(srv *DistributedTokenServer) {
+				defer wg.Done()
+				token, err := srv.Token()
+				if err != nil || token != "token1" {
+					t.Errorf("%T: unexpected token: %q, err: %v", store, token, err)
+				}
+			}(srv)
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&requestCount); n != 1 {
+			t.Errorf("%T: requestCount mismatch, have: %d, want: 1", store, n)
+		}
+
+		// access_token 失效, 多个副本同时刷新也只刷新一次
+		for _, srv := range replicas {
+			wg.Add(1)
+			go func(srv *DistributedTokenServer) {
+				defer wg.Done()
+				token, err := srv.TokenRefresh()
+				if err != nil || token != "token2" {
+					t.Errorf("%T: unexpected token: %q, err: %v", store, token, err)
+				}
+			}(srv)
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&requestCount); n != 2 {
+			t.Errorf("%T: requestCount mismatch, have: %d, want: 2", store, n)
+		}
+	}
+}
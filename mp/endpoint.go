@@ -0,0 +1,49 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"github.com/philsong/wechat2/util"
+)
+
+// 微信公众平台 API 的域名
+const (
+	APIHost  = "api.weixin.qq.com"
+	FileHost = "file.api.weixin.qq.com"
+	MPHost   = "mp.weixin.qq.com"
+)
+
+// 微信公众平台 API 地址注册表.
+//  SDK 里的 URL 都是微信服务器的完整地址, 发送请求之前会根据 Endpoint 把 URL 的 scheme://host
+//  部分替换为这里设置的基础地址, 比如 "http://127.0.0.1:8080", 这样就可以把请求发送到本地的
+//  测试服务器(httptest.Server), 录制代理或者其他的网关.
+//
+//  字段为空则表示不替换, 继续使用微信服务器的地址.
+type Endpoint struct {
+	APIBaseURL  string // 替换 http(s)://api.weixin.qq.com
+	FileBaseURL string // 替换 http(s)://file.api.weixin.qq.com
+	MPBaseURL   string // 替换 http(s)://mp.weixin.qq.com
+}
+
+// 全局的 Endpoint.
+//  没有单独设置 Endpoint 的 WechatClient, DefaultTokenServer 等都使用这个 Endpoint;
+//  请在程序初始化的时候设置, 运行中修改不是并发安全的.
+var DefaultEndpoint = new(Endpoint)
+
+// 根据 Endpoint 的设置返回 rawURL 最终的地址.
+//  如果 endpoint == nil 则原样返回 rawURL.
+func (endpoint *Endpoint) ResolveURL(rawURL string) string {
+	if endpoint == nil {
+		return rawURL
+	}
+	if finalURL := util.ReplaceBaseURL(rawURL, APIHost, endpoint.APIBaseURL); finalURL != rawURL {
+		return finalURL
+	}
+	if finalURL := util.ReplaceBaseURL(rawURL, FileHost, endpoint.FileBaseURL); finalURL != rawURL {
+		return finalURL
+	}
+	return util.ReplaceBaseURL(rawURL, MPHost, endpoint.MPBaseURL)
+}
@@ -5,14 +5,125 @@
 
 package mp
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
 
 const (
+	ErrCodeSystemBusy        = -1
 	ErrCodeOK                = 0
 	ErrCodeInvalidCredential = 40001 // access_token 过期（无效）返回这个错误
 	ErrCodeTimeout           = 42001 // access_token 过期（无效）返回这个错误（maybe!!!）
+
+	ErrCodeInvalidGrantType      = 40002
+	ErrCodeInvalidOpenId         = 40003
+	ErrCodeInvalidAppId          = 40013
+	ErrCodeInvalidAccessToken    = 40014
+	ErrCodeInvalidOAuthCode      = 40029
+	ErrCodeInvalidAppSecret      = 40125
+	ErrCodeIPNotInWhitelist      = 40164
+	ErrCodeAccessTokenMissing    = 41001
+	ErrCodeRefreshTokenTimeout   = 42002
+	ErrCodeOAuthCodeTimeout      = 42003
+	ErrCodeRequireSubscribe      = 43004
+	ErrCodeUserRefused           = 43101
+	ErrCodeAPIQuotaExceeded      = 45009
+	ErrCodeAPIFreqOutOfLimit     = 45011
+	ErrCodeResponseOutOfTime     = 45015
+	ErrCodeMassSendQuotaExceeded = 45028
+	ErrCodeCustomSendOutOfLimit  = 45047
+	ErrCodeUserNotExist          = 46004
+	ErrCodeAPIUnauthorized       = 48001
+	ErrCodeUserUnauthorized      = 50001
+	ErrCodeUserLimited           = 50002
 )
 
+// 错误的分类.
+//  ErrorClass 也实现了 error 接口, 所以可以用 errors.Is(err, ErrorClassQuota) 判断错误的类别.
+type ErrorClass int
+
+const (
+	ErrorClassUnknown        ErrorClass = iota // 未知的错误
+	ErrorClassTransport                        // 网络错误, http 状态码错误等, 参考 TransportError
+	ErrorClassSystemBusy                       // 微信服务器繁忙或者调用太频繁, 稍候重试可能成功
+	ErrorClassToken                            // access_token 无效或者过期
+	ErrorClassQuota                            // 接口调用次数超过限制
+	ErrorClassUserPermission                   // 用户侧的原因, 比如用户未关注, 拒收消息, 超过回复时间窗口
+	ErrorClassAPIPermission                    // 公众号没有接口权限, IP 不在白名单等
+	ErrorClassInvalidRequest                   // 参数错误, 重试也不会成功
+)
+
+var errorClassNames = [...]string{
+	ErrorClassUnknown:        "unknown",
+	ErrorClassTransport:      "transport",
+	ErrorClassSystemBusy:     "system busy",
+	ErrorClassToken:          "token",
+	ErrorClassQuota:          "quota",
+	ErrorClassUserPermission: "user permission",
+	ErrorClassAPIPermission:  "api permission",
+	ErrorClassInvalidRequest: "invalid request",
+}
+
+func (class ErrorClass) String() string {
+	if class >= 0 && int(class) < len(errorClassNames) {
+		return errorClassNames[class]
+	}
+	return "ErrorClass(" + fmt.Sprint(int(class)) + ")"
+}
+
+func (class ErrorClass) Error() string {
+	return "mp: " + class.String() + " error"
+}
+
+type errCodeInfo struct {
+	class ErrorClass
+	desc  string
+}
+
+// 已知的错误码
+var errCodeTable = map[int]errCodeInfo{
+	ErrCodeSystemBusy:            {ErrorClassSystemBusy, "系统繁忙, 此时请开发者稍候再试"},
+	ErrCodeInvalidCredential:     {ErrorClassToken, "获取 access_token 时 AppSecret 错误, 或者 access_token 无效"},
+	ErrCodeInvalidAccessToken:    {ErrorClassToken, "不合法的 access_token"},
+	ErrCodeAccessTokenMissing:    {ErrorClassToken, "缺少 access_token 参数"},
+	ErrCodeTimeout:               {ErrorClassToken, "access_token 超时"},
+	ErrCodeAPIQuotaExceeded:      {ErrorClassQuota, "接口调用超过限制"},
+	ErrCodeAPIFreqOutOfLimit:     {ErrorClassSystemBusy, "API 调用太频繁, 请稍候再试"},
+	ErrCodeMassSendQuotaExceeded: {ErrorClassQuota, "没有群发配额"},
+	ErrCodeCustomSendOutOfLimit:  {ErrorClassQuota, "客服接口下行条数超过上限"},
+	ErrCodeRequireSubscribe:      {ErrorClassUserPermission, "需要接收者关注"},
+	ErrCodeUserRefused:           {ErrorClassUserPermission, "用户拒绝接受消息"},
+	ErrCodeResponseOutOfTime:     {ErrorClassUserPermission, "回复时间超过限制"},
+	ErrCodeAPIUnauthorized:       {ErrorClassAPIPermission, "api 功能未授权"},
+	ErrCodeUserUnauthorized:      {ErrorClassAPIPermission, "用户未授权该 api"},
+	ErrCodeUserLimited:           {ErrorClassAPIPermission, "用户受限, 可能是违规后接口被封禁"},
+	ErrCodeIPNotInWhitelist:      {ErrorClassAPIPermission, "调用接口的 IP 地址不在白名单中"},
+	ErrCodeInvalidGrantType:      {ErrorClassInvalidRequest, "不合法的凭证类型"},
+	ErrCodeInvalidOpenId:         {ErrorClassInvalidRequest, "不合法的 OpenID"},
+	ErrCodeInvalidAppId:          {ErrorClassInvalidRequest, "不合法的 AppID"},
+	ErrCodeInvalidOAuthCode:      {ErrorClassInvalidRequest, "不合法的 oauth_code"},
+	ErrCodeInvalidAppSecret:      {ErrorClassInvalidRequest, "不合法的 AppSecret"},
+	ErrCodeRefreshTokenTimeout:   {ErrorClassInvalidRequest, "refresh_token 超时"},
+	ErrCodeOAuthCodeTimeout:      {ErrorClassInvalidRequest, "oauth_code 超时"},
+	ErrCodeUserNotExist:          {ErrorClassInvalidRequest, "不存在的用户"},
+}
+
+// 获取错误码的分类, 未知的错误码返回 ErrorClassUnknown.
+func ErrCodeClass(errCode int) ErrorClass {
+	return errCodeTable[errCode].class
+}
+
+// 获取错误码的说明, 未知的错误码返回空串.
+func ErrCodeDescription(errCode int) string {
+	return errCodeTable[errCode].desc
+}
+
 type Error struct {
 	ErrCode int    `json:"errcode"`
 	ErrMsg  string `json:"errmsg"`
@@ -21,3 +132,160 @@ type Error struct {
 func (e *Error) Error() string {
 	return fmt.Sprintf("errcode: %d, errmsg: %s", e.ErrCode, e.ErrMsg)
 }
+
+// 错误的分类.
+func (e *Error) Class() ErrorClass {
+	return ErrCodeClass(e.ErrCode)
+}
+
+// 支持 errors.Is:
+//  target 是 *Error 的时候比较 ErrCode, 比如 errors.Is(err, &Error{ErrCode: ErrCodeAPIQuotaExceeded});
+//  target 是 ErrorClass 的时候比较分类, 比如 errors.Is(err, ErrorClassQuota).
+func (e *Error) Is(target error) bool {
+	switch v := target.(type) {
+	case *Error:
+		return v != nil && e.ErrCode == v.ErrCode
+	case ErrorClass:
+		return e.Class() == v
+	default:
+		return false
+	}
+}
+
+// 调用微信 API 时 http 层面的错误: 网络错误, http 状态码不是 200, 返回的数据无法解析等.
+type TransportError struct {
+	URL        string // 请求的 URL, access_token, secret 等敏感参数已经去掉
+	StatusCode int    // http 状态码, 0 表示没有收到 http 回复
+	Err        error  // 原始的错误
+}
+
+func (e *TransportError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: http.StatusCode: %d: %v", e.URL, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.URL, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// 支持 errors.Is(err, ErrorClassTransport).
+func (e *TransportError) Is(target error) bool {
+	return target == ErrorClassTransport
+}
+
+// 重试是否可能成功: 5xx 状态码, 超时, 连接被重置等返回 true;
+// context 被取消, 返回的数据无法解析等返回 false.
+func (e *TransportError) Retryable() bool {
+	if errors.Is(e.Err, context.Canceled) {
+		return false
+	}
+	switch {
+	case e.StatusCode >= 500:
+		return true
+	case e.StatusCode != 0:
+		return false
+	}
+
+	// *url.Error 也实现了 net.Error, 所以要判断它包装的错误
+	err := e.Err
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true // 超时, 连接被重置, 连接被拒绝等
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// 新建一个 TransportError, rawURL 和 err 里面的敏感参数会被去掉.
+func NewTransportError(rawURL string, statusCode int, err error) *TransportError {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = &url.Error{
+			Op:  urlErr.Op,
+			URL: redactURL(urlErr.URL),
+			Err: urlErr.Err,
+		}
+	}
+	return &TransportError{
+		URL:        redactURL(rawURL),
+		StatusCode: statusCode,
+		Err:        err,
+	}
+}
+
+// 需要从 URL 中去掉的敏感参数
+var sensitiveQueryKeys = []string{"access_token", "secret", "appsecret", "corpsecret"}
+
+// 去掉 rawURL 中 access_token, secret 等参数的值.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+			return rawURL[:i]
+		}
+		return rawURL
+	}
+	query := u.Query()
+	redacted := false
+	for _, key := range sensitiveQueryKeys {
+		if query.Get(key) != "" {
+			query.Set(key, "***")
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// 错误的分类, err 可以是 *Error, *TransportError, *QuotaExceededError 或者包装了它们的错误;
+// 其他错误返回 ErrorClassUnknown.
+func ClassOf(err error) ErrorClass {
+	var wxErr *Error
+	if errors.As(err, &wxErr) {
+		return wxErr.Class()
+	}
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return ErrorClassTransport
+	}
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return ErrorClassQuota
+	}
+	return ErrorClassUnknown
+}
+
+// 判断 err 是不是稍候重试可能成功的错误: 系统繁忙, 调用太频繁, 可重试的 TransportError.
+func IsRetryable(err error) bool {
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return transportErr.Retryable()
+	}
+	return ClassOf(err) == ErrorClassSystemBusy
+}
+
+// 判断 err 是不是 access_token 无效或者过期的错误.
+func IsTokenError(err error) bool {
+	return ClassOf(err) == ErrorClassToken
+}
+
+// 判断 err 是不是接口调用次数超过限制的错误.
+func IsQuotaError(err error) bool {
+	return ClassOf(err) == ErrorClassQuota
+}
+
+// 判断 err 是不是用户侧原因的错误, 比如用户未关注, 用户拒收消息, 超过回复时间窗口等.
+func IsUserPermissionError(err error) bool {
+	return ClassOf(err) == ErrorClassUserPermission
+}
+
+// 判断 err 是不是公众号没有接口权限的错误, 比如 api 功能未授权, IP 不在白名单等.
+func IsAPIPermissionError(err error) bool {
+	return ClassOf(err) == ErrorClassAPIPermission
+}
@@ -0,0 +1,215 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestErrCodeTable(t *testing.T) {
+	tests := []struct {
+		errCode int
+		class   ErrorClass
+	}{
+		{ErrCodeSystemBusy, ErrorClassSystemBusy},
+		{ErrCodeOK, ErrorClassUnknown},
+		{ErrCodeInvalidCredential, ErrorClassToken},
+		{ErrCodeTimeout, ErrorClassToken},
+		{ErrCodeInvalidAccessToken, ErrorClassToken},
+		{ErrCodeAccessTokenMissing, ErrorClassToken},
+		{ErrCodeAPIQuotaExceeded, ErrorClassQuota},
+		{ErrCodeMassSendQuotaExceeded, ErrorClassQuota},
+		{ErrCodeCustomSendOutOfLimit, ErrorClassQuota},
+		{ErrCodeAPIFreqOutOfLimit, ErrorClassSystemBusy},
+		{ErrCodeRequireSubscribe, ErrorClassUserPermission},
+		{ErrCodeUserRefused, ErrorClassUserPermission},
+		{ErrCodeResponseOutOfTime, ErrorClassUserPermission},
+		{ErrCodeAPIUnauthorized, ErrorClassAPIPermission},
+		{ErrCodeUserUnauthorized, ErrorClassAPIPermission},
+		{ErrCodeUserLimited, ErrorClassAPIPermission},
+		{ErrCodeIPNotInWhitelist, ErrorClassAPIPermission},
+		{ErrCodeInvalidGrantType, ErrorClassInvalidRequest},
+		{ErrCodeInvalidOpenId, ErrorClassInvalidRequest},
+		{ErrCodeInvalidAppId, ErrorClassInvalidRequest},
+		{ErrCodeInvalidOAuthCode, ErrorClassInvalidRequest},
+		{ErrCodeInvalidAppSecret, ErrorClassInvalidRequest},
+		{ErrCodeRefreshTokenTimeout, ErrorClassInvalidRequest},
+		{ErrCodeOAuthCodeTimeout, ErrorClassInvalidRequest},
+		{ErrCodeUserNotExist, ErrorClassInvalidRequest},
+		{99999, ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		if class := ErrCodeClass(tt.errCode); class != tt.class {
+			t.Errorf("ErrCodeClass(%d) mismatch, have: %v, want: %v", tt.errCode, class, tt.class)
+		}
+		desc := ErrCodeDescription(tt.errCode)
+		if known := tt.class != ErrorClassUnknown; known != (desc != "") {
+			t.Errorf("ErrCodeDescription(%d) mismatch, have: %q", tt.errCode, desc)
+		}
+		if class := ClassOf(fmt.Errorf("wrapped: %w", &Error{ErrCode: tt.errCode})); class != tt.class {
+			t.Errorf("ClassOf(%d) mismatch, have: %v, want: %v", tt.errCode, class, tt.class)
+		}
+	}
+
+	// 每个已知的错误码都要有分类和说明
+	for errCode, info := range errCodeTable {
+		if info.class == ErrorClassUnknown || info.desc == "" {
+			t.Errorf("errCodeTable[%d] is incomplete: %+v", errCode, info)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		class ErrorClass
+		str   string
+	}{
+		{ErrorClassUnknown, "unknown"},
+		{ErrorClassTransport, "transport"},
+		{ErrorClassSystemBusy, "system busy"},
+		{ErrorClassToken, "token"},
+		{ErrorClassQuota, "quota"},
+		{ErrorClassUserPermission, "user permission"},
+		{ErrorClassAPIPermission, "api permission"},
+		{ErrorClassInvalidRequest, "invalid request"},
+		{ErrorClass(100), "ErrorClass(100)"},
+		{ErrorClass(-1), "ErrorClass(-1)"},
+	}
+	for _, tt := range tests {
+		if str := tt.class.String(); str != tt.str {
+			t.Errorf("String() mismatch, have: %q, want: %q", str, tt.str)
+		}
+		if str := tt.class.Error(); str != "mp: "+tt.str+" error" {
+			t.Errorf("Error() mismatch, have: %q", str)
+		}
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &Error{ErrCode: ErrCodeAPIQuotaExceeded, ErrMsg: "api freq out of limit"})
+	tests := []struct {
+		target error
+		want   bool
+	}{
+		{&Error{ErrCode: ErrCodeAPIQuotaExceeded}, true},
+		{&Error{ErrCode: ErrCodeAPIFreqOutOfLimit}, false},
+		{(*Error)(nil), false},
+		{ErrorClassQuota, true},
+		{ErrorClassSystemBusy, false},
+		{ErrorClassTransport, false},
+		{io.EOF, false},
+	}
+	for _, tt := range tests {
+		if have := errors.Is(err, tt.target); have != tt.want {
+			t.Errorf("errors.Is(err, %#v) mismatch, have: %t, want: %t", tt.target, have, tt.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestTransportErrorRetryable(t *testing.T) {
+	rawURL := "https://api.weixin.qq.com/cgi-bin/menu/get?access_token=TOKEN"
+	tests := []struct {
+		name       string
+		statusCode int
+		err        error
+		want       bool
+	}{
+		{"500", 500, errors.New("http.Status: 500 Internal Server Error"), true},
+		{"502", 502, errors.New("http.Status: 502 Bad Gateway"), true},
+		{"404", 404, errors.New("http.Status: 404 Not Found"), false},
+		{"bad json", 200, errors.New("invalid character '<'"), false},
+		{"timeout", 0, &url.Error{Op: "Get", URL: rawURL, Err: timeoutError{}}, true},
+		{"net error", 0, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"eof", 0, &url.Error{Op: "Get", URL: rawURL, Err: io.EOF}, true},
+		{"unexpected eof", 0, io.ErrUnexpectedEOF, true},
+		{"canceled", 0, &url.Error{Op: "Get", URL: rawURL, Err: context.Canceled}, false},
+		{"canceled 500", 500, context.Canceled, false},
+		{"unknown", 0, errors.New("unknown"), false},
+	}
+	for _, tt := range tests {
+		err := NewTransportError(rawURL, tt.statusCode, tt.err)
+		if have := err.Retryable(); have != tt.want {
+			t.Errorf("%s: Retryable() mismatch, have: %t, want: %t", tt.name, have, tt.want)
+		}
+		if have := IsRetryable(fmt.Errorf("wrapped: %w", err)); have != tt.want {
+			t.Errorf("%s: IsRetryable() mismatch, have: %t, want: %t", tt.name, have, tt.want)
+		}
+		if !errors.Is(err, ErrorClassTransport) || ClassOf(err) != ErrorClassTransport {
+			t.Errorf("%s: the class of TransportError mismatch", tt.name)
+		}
+		if strings.Contains(err.Error(), "TOKEN") {
+			t.Errorf("%s: access_token is not redacted: %s", tt.name, err)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   string
+	}{
+		{
+			"https://api.weixin.qq.com/cgi-bin/menu/get?access_token=TOKEN",
+			"https://api.weixin.qq.com/cgi-bin/menu/get?access_token=%2A%2A%2A",
+		},
+		{
+			"https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=APPID&secret=SECRET",
+			"https://api.weixin.qq.com/cgi-bin/token?appid=APPID&grant_type=client_credential&secret=%2A%2A%2A",
+		},
+		{
+			"https://api.weixin.qq.com/sns/oauth2/access_token?appid=APPID&appsecret=SECRET&code=CODE",
+			"https://api.weixin.qq.com/sns/oauth2/access_token?appid=APPID&appsecret=%2A%2A%2A&code=CODE",
+		},
+		{
+			"https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=CORPID&corpsecret=SECRET",
+			"https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=CORPID&corpsecret=%2A%2A%2A",
+		},
+		{
+			"https://api.weixin.qq.com/cgi-bin/menu/get",
+			"https://api.weixin.qq.com/cgi-bin/menu/get",
+		},
+		{
+			"https://api.weixin.qq.com/cgi-bin/user/info?openid=OPENID&lang=zh_CN",
+			"https://api.weixin.qq.com/cgi-bin/user/info?openid=OPENID&lang=zh_CN",
+		},
+		// 无法解析的 URL 去掉整个查询参数
+		{
+			"https://api.weixin.qq.com/%zz?access_token=TOKEN",
+			"https://api.weixin.qq.com/%zz",
+		},
+	}
+	for _, tt := range tests {
+		have := redactURL(tt.rawURL)
+		if have != tt.want {
+			t.Errorf("redactURL(%q) mismatch\nhave: %s\nwant: %s", tt.rawURL, have, tt.want)
+		}
+		if strings.Contains(have, "TOKEN") || strings.Contains(have, "SECRET") {
+			t.Errorf("redactURL(%q) leaks sensitive value: %s", tt.rawURL, have)
+		}
+	}
+
+	// *url.Error 里的 URL 也要去掉
+	err := NewTransportError("https://api.weixin.qq.com/cgi-bin/token?appid=APPID&secret=SECRET", 0,
+		&url.Error{Op: "Get", URL: "https://api.weixin.qq.com/cgi-bin/token?appid=APPID&secret=SECRET", Err: io.EOF})
+	if strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("secret is not redacted: %s", err)
+	}
+}
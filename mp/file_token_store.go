@@ -0,0 +1,174 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	fileLockStaleTimeout = 10 * time.Second // 锁文件超过这个时间还存在, 则认为持有者已经崩溃
+	fileLockWaitTimeout  = 5 * time.Second  // 等待锁文件的最长时间
+)
+
+var _ TokenStore = new(FileTokenStore)
+
+// 基于文件的 TokenStore, 用于同一台机器(或者共享文件系统)上的多个进程.
+//  每个 key 对应目录下的一个 JSON 文件, 修改的时候用 O_EXCL 创建的锁文件互斥,
+//  写入的时候先写临时文件然后 rename, 所以读取不需要加锁.
+type FileTokenStore struct {
+	dir string
+}
+
+// 创建一个新的 FileTokenStore, dir 不存在则自动创建.
+func NewFileTokenStore(dir string) (store *FileTokenStore, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	store = &FileTokenStore{dir: dir}
+	return
+}
+
+// 文件里保存的内容
+type fileTokenState struct {
+	Entry *TokenEntry `json:"entry,omitempty"`
+	Lease tokenLease  `json:"lease"`
+}
+
+func (store *FileTokenStore) path(key string) string {
+	return filepath.Join(store.dir, url.PathEscape(key)+".json")
+}
+
+func (store *FileTokenStore) readState(key string) (state fileTokenState, err error) {
+	data, err := ioutil.ReadFile(store.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	return
+}
+
+func (store *FileTokenStore) writeState(key string, state *fileTokenState) (err error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+
+	path := store.path(key)
+	tmpFile, err := ioutil.TempFile(store.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	tmpPath := tmpFile.Name()
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+	}
+	return
+}
+
+// 获取 key 的锁文件, 返回释放锁的函数.
+func (store *FileTokenStore) lock(key string) (unlock func(), err error) {
+	lockPath := store.path(key) + ".lock"
+	deadline := time.Now().Add(fileLockWaitTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// 持有者崩溃了, 锁文件没有删除
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > fileLockStaleTimeout {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("mp: timeout waiting for lock file " + lockPath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 在锁的保护下修改 key 对应的内容, update 返回 true 则写回文件.
+func (store *FileTokenStore) update(key string, update func(state *fileTokenState) bool) (err error) {
+	unlock, err := store.lock(key)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	state, err := store.readState(key)
+	if err != nil {
+		return
+	}
+	if !update(&state) {
+		return
+	}
+	return store.writeState(key, &state)
+}
+
+func (store *FileTokenStore) Load(key string) (entry *TokenEntry, err error) {
+	state, err := store.readState(key)
+	if err != nil {
+		return
+	}
+	entry = state.Entry
+	return
+}
+
+func (store *FileTokenStore) Save(key string, entry *TokenEntry) error {
+	return store.update(key, func(state *fileTokenState) bool {
+		state.Entry = entry
+		return true
+	})
+}
+
+func (store *FileTokenStore) AcquireLease(key, owner string, ttl time.Duration) (ok bool, err error) {
+	err = store.update(key, func(state *fileTokenState) bool {
+		now := time.Now()
+		if !state.Lease.available(owner, now) {
+			return false
+		}
+		state.Lease = tokenLease{Owner: owner, ExpiresAt: now.Add(ttl)}
+		ok = true
+		return true
+	})
+	if err != nil {
+		ok = false
+	}
+	return
+}
+
+func (store *FileTokenStore) ReleaseLease(key, owner string) error {
+	return store.update(key, func(state *fileTokenState) bool {
+		if state.Lease.Owner != owner {
+			return false
+		}
+		state.Lease = tokenLease{}
+		return true
+	})
+}
@@ -0,0 +1,151 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// access_token, jsapi_ticket 等凭证的刷新状态.
+type RefreshStatus struct {
+	LastRefresh         time.Time // 最后一次从微信服务器获取的时间, 不管成功失败
+	LastSuccess         time.Time // 最后一次成功获取的时间
+	ExpiresAt           time.Time // 最后一次成功获取的凭证的过期时间, 已经减去了缓冲的时间
+	ConsecutiveFailures int       // 连续失败的次数, 成功之后清零
+	LastError           error     // 最后一次失败的错误, 成功之后清空
+}
+
+// 根据一次刷新的结果更新 status, 实现自己的 TokenServer 的时候也可以使用.
+func (status *RefreshStatus) Update(event RefreshEvent) {
+	status.LastRefresh = event.Time
+	if event.Err != nil {
+		status.ConsecutiveFailures++
+		status.LastError = event.Err
+		return
+	}
+	status.LastSuccess = event.Time
+	status.ExpiresAt = event.Time.Add(event.ExpiresIn)
+	status.ConsecutiveFailures = 0
+	status.LastError = nil
+}
+
+// 凭证在 now 时刻是否健康: 没有过期并且最后一次刷新没有失败.
+func (status *RefreshStatus) Healthy(now time.Time) bool {
+	return status.ConsecutiveFailures == 0 && now.Before(status.ExpiresAt)
+}
+
+// 可以报告刷新状态的对象, 比如 DefaultTokenServer, jssdk.DefaultTicketServer.
+type StatusReporter interface {
+	Status() RefreshStatus
+}
+
+// 报告所有注册的 StatusReporter 的健康状态的 http.Handler.
+//  所有的凭证都健康则返回 200, 否则返回 503; body 是 JSON:
+//
+//  {
+//      "healthy": false,
+//      "items": [
+//          {
+//              "name": "wx1234567890/access_token",
+//              "healthy": false,
+//              "last_refresh": "2015-03-01T12:00:00+08:00",
+//              "last_success": "2015-03-01T10:00:00+08:00",
+//              "expires_at": "2015-03-01T11:50:00+08:00",
+//              "consecutive_failures": 3,
+//              "last_error": "errcode: 40013, errmsg: invalid appid"
+//          }
+//      ]
+//  }
+type HealthHandler struct {
+	mutex     sync.RWMutex
+	reporters map[string]StatusReporter
+}
+
+var _ http.Handler = new(HealthHandler)
+
+func NewHealthHandler() *HealthHandler {
+	return &HealthHandler{
+		reporters: make(map[string]StatusReporter),
+	}
+}
+
+// 注册 reporter, name 一般是 "appid/access_token", "appid/jsapi_ticket" 这样的格式;
+// 如果 name 已经注册了则替换.
+func (handler *HealthHandler) Register(name string, reporter StatusReporter) {
+	if reporter == nil {
+		panic("mp: nil StatusReporter")
+	}
+	handler.mutex.Lock()
+	handler.reporters[name] = reporter
+	handler.mutex.Unlock()
+}
+
+// 注销 name 对应的 reporter.
+func (handler *HealthHandler) Unregister(name string) {
+	handler.mutex.Lock()
+	delete(handler.reporters, name)
+	handler.mutex.Unlock()
+}
+
+type healthItem struct {
+	Name                string    `json:"name"`
+	Healthy             bool      `json:"healthy"`
+	LastRefresh         time.Time `json:"last_refresh"`
+	LastSuccess         time.Time `json:"last_success"`
+	ExpiresAt           time.Time `json:"expires_at"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+func (handler *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	handler.mutex.RLock()
+	items := make([]healthItem, 0, len(handler.reporters))
+	for name, reporter := range handler.reporters {
+		status := reporter.Status()
+		item := healthItem{
+			Name:                name,
+			Healthy:             status.Healthy(now),
+			LastRefresh:         status.LastRefresh,
+			LastSuccess:         status.LastSuccess,
+			ExpiresAt:           status.ExpiresAt,
+			ConsecutiveFailures: status.ConsecutiveFailures,
+		}
+		if status.LastError != nil {
+			item.LastError = status.LastError.Error()
+		}
+		items = append(items, item)
+	}
+	handler.mutex.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	healthy := true
+	for i := range items {
+		if !items[i].Healthy {
+			healthy = false
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Healthy bool         `json:"healthy"`
+		Items   []healthItem `json:"items"`
+	}{
+		Healthy: healthy,
+		Items:   items,
+	})
+}
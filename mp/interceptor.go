@@ -0,0 +1,47 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"net/http"
+)
+
+// 一次 API 调用, 传递给 Interceptor.
+type Call struct {
+	API    string      // URL 的 path, 比如 "/cgi-bin/menu/create"
+	URL    string      // 调用的 URL, 不包含 access_token 的值
+	Method string      // "GET" 或者 "POST"
+	Header http.Header // 附加到每次 http 请求(包括重试)上的 header, 比如 tracing 的 header
+
+	Request  interface{} // PostJSON 的 request, GetJSON 和上传文件的时候为 nil; 拦截器可以修改或者替换
+	Response Response    // 解析后的回复, 调用 Invoker 之后可以通过 Response.APIError() 获取错误码
+}
+
+// 执行 API 调用, 包括获取 access_token, 限流, 重试等.
+type Invoker func(ctx context.Context, call *Call) error
+
+// API 调用的拦截器, 可以用来添加 tracing header, 记录日志, 统计, 故障注入等.
+//  拦截器可以在调用 invoker 之前修改 call(比如 call.Header), 也可以不调用 invoker 直接返回.
+//
+//  func(ctx context.Context, call *Call, invoker Invoker) error {
+//      start := time.Now()
+//      err := invoker(ctx, call)
+//      log.Println(call.API, call.Response.APIError().ErrCode, time.Since(start), err)
+//      return err
+//  }
+type Interceptor func(ctx context.Context, call *Call, invoker Invoker) error
+
+// 把 interceptors 和 invoker 串联成一个 Invoker, interceptors[0] 在最外层.
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, call *Call) error {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return invoker
+}
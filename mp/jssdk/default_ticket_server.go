@@ -6,42 +6,56 @@
 package jssdk
 
 import (
-	"errors"
+	"context"
 	"net/http"
-	"strconv"
-	"sync"
+	"net/url"
 	"time"
 
 	"github.com/philsong/wechat2/mp"
 )
 
-const defaultTickDuration = time.Minute // 获取 jsapi_ticket 失败时尝试获取的间隔时间.
+const (
+	TicketTypeJSAPI  = "jsapi"   // wx.config 签名用的 jsapi_ticket
+	TicketTypeWxCard = "wx_card" // 卡券签名用的 api_ticket
+)
 
 var _ TicketServer = new(DefaultTicketServer)
 
-// TicketServer 的简单实现.
+// TicketServer 的简单实现, 支持 jsapi_ticket 和卡券的 api_ticket 等类型.
 //  NOTE:
-//  一般用于单进程环境, 因为 DefaultTicketServer 同时也实现了一个简单的中控服务器, 而不是简单的
-//  实现了 TicketServer 接口, 所以整个系统只能存在一个 DefaultTicketServer 实例!!!
+//  1. 一般用于单进程环境, 因为 DefaultTicketServer 同时也实现了一个简单的中控服务器, 而不是简单的
+//     实现了 TicketServer 接口, 所以整个系统每种类型的 ticket 只能存在一个 DefaultTicketServer 实例!!!
+//     多进程环境请调用 SetStore 通过 mp.TokenStore 共享 ticket;
+//  2. 第一次调用 Ticket() 或者 TicketRefresh() 的时候才会获取 ticket 并启动后台的 goroutine,
+//     不再使用的时候请调用 Close() 或者 Stop(ctx) 停止这个 goroutine.
 type DefaultTicketServer struct {
 	mp.WechatClient
 
-	// 缓存最后一次从微信服务器获取的 jsapi_ticket 的结果.
-	// goroutine ticketAutoUpdate() 里有个定时器, 每次触发都会更新 currentTicket.
-	currentTicket struct {
-		rwmutex sync.RWMutex
-		ticket  string
-		err     error
-	}
+	ticketType string
+	refresher  *mp.CredentialRefresher
+
+	// 每次成功从微信服务器获取 ticket 之后调用, 参数是更新后的状态.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnRefresh func(status mp.RefreshStatus)
 
-	// goroutine ticketAutoUpdate() 监听 resetTicketRefreshTickChan,
-	// 如果有新的数据, 则重置定时器, 定时时间为 resetTicketRefreshTickChan 传过来的数据.
-	resetTicketRefreshTickChan chan time.Duration
+	// 每次从微信服务器获取 ticket 失败之后调用, status.LastError 是这次的错误,
+	// status.ConsecutiveFailures 是连续失败的次数.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnError func(status mp.RefreshStatus)
 }
 
-// 创建一个新的 DefaultTicketServer.
+// 创建一个新的获取 jsapi_ticket 的 DefaultTicketServer.
 //  如果 httpClient == nil 则默认使用 http.DefaultClient.
+//  NOTE: 创建的时候不会获取 jsapi_ticket, 第一次使用的时候才获取.
 func NewDefaultTicketServer(tokenServer mp.TokenServer, httpClient *http.Client) (srv *DefaultTicketServer) {
+	return NewTicketServer(TicketTypeJSAPI, tokenServer, httpClient)
+}
+
+// 创建一个新的获取 ticketType 类型的 ticket 的 DefaultTicketServer,
+// ticketType 一般是 TicketTypeJSAPI 或者 TicketTypeWxCard.
+//  如果 httpClient == nil 则默认使用 http.DefaultClient.
+//  NOTE: 创建的时候不会获取 ticket, 第一次使用的时候才获取.
+func NewTicketServer(ticketType string, tokenServer mp.TokenServer, httpClient *http.Client) (srv *DefaultTicketServer) {
 	if tokenServer == nil {
 		panic("nil tokenServer")
 	}
@@ -54,112 +68,86 @@ func NewDefaultTicketServer(tokenServer mp.TokenServer, httpClient *http.Client)
 			TokenServer: tokenServer,
 			HttpClient:  httpClient,
 		},
-		resetTicketRefreshTickChan: make(chan time.Duration),
+		ticketType: ticketType,
 	}
-
-	// 获取 jsapi_ticket 并启动 goroutine ticketAutoUpdate
-	resp, err := srv.getTicket()
-	if err != nil {
-		srv.currentTicket.ticket = ""
-		srv.currentTicket.err = err
-		go srv.ticketAutoUpdate(defaultTickDuration)
-	} else {
-		srv.currentTicket.ticket = resp.Ticket
-		srv.currentTicket.err = nil
-		go srv.ticketAutoUpdate(time.Duration(resp.ExpiresIn) * time.Second)
+	srv.refresher = mp.NewCredentialRefresher(srv.getTicket)
+	srv.refresher.OnRefresh = func(status mp.RefreshStatus) {
+		if srv.OnRefresh != nil {
+			srv.OnRefresh(status)
+		}
+	}
+	srv.refresher.OnError = func(status mp.RefreshStatus) {
+		if srv.OnError != nil {
+			srv.OnError(status)
+		}
 	}
-
 	return
 }
 
-func (srv *DefaultTicketServer) Ticket() (ticket string, err error) {
-	srv.currentTicket.rwmutex.RLock()
-	ticket = srv.currentTicket.ticket
-	err = srv.currentTicket.err
-	srv.currentTicket.rwmutex.RUnlock()
-	return
+// 获取 ticket 的类型.
+func (srv *DefaultTicketServer) TicketType() string {
+	return srv.ticketType
 }
 
-func (srv *DefaultTicketServer) TicketRefresh() (ticket string, err error) {
-	resp, err := srv.getTicket()
-	if err != nil {
-		srv.currentTicket.rwmutex.Lock()
-		srv.currentTicket.ticket = ""
-		srv.currentTicket.err = err
-		srv.currentTicket.rwmutex.Unlock()
-
-		srv.resetTicketRefreshTickChan <- defaultTickDuration
-		return
-	} else {
-		srv.currentTicket.rwmutex.Lock()
-		srv.currentTicket.ticket = resp.Ticket
-		srv.currentTicket.err = nil
-		srv.currentTicket.rwmutex.Unlock()
-
-		ticket = resp.Ticket
-		srv.resetTicketRefreshTickChan <- time.Duration(resp.ExpiresIn) * time.Second
-		return
-	}
+// 通过 store 和其他副本共享 ticket, key 是 ticket 在 store 里的 key, 比如 "appid/jsapi_ticket".
+//  NOTE: 请在第一次使用之前调用.
+func (srv *DefaultTicketServer) SetStore(store mp.TokenStore, key string) {
+	srv.refresher.SetStore(store, key)
 }
 
-// 单独一个 goroutine 来定时获取 jsapi_ticket.
-//  tickDuration: 启动后初始 tickDuration.
-func (srv *DefaultTicketServer) ticketAutoUpdate(tickDuration time.Duration) {
-	var ticker *time.Ticker
-
-NEW_TICK_DURATION:
-	ticker = time.NewTicker(tickDuration)
-	for {
-		select {
-		case tickDuration = <-srv.resetTicketRefreshTickChan:
-			ticker.Stop()
-			goto NEW_TICK_DURATION
-
-		case <-ticker.C:
-			resp, err := srv.getTicket()
-			if err != nil {
-				srv.currentTicket.rwmutex.Lock()
-				srv.currentTicket.ticket = ""
-				srv.currentTicket.err = err
-				srv.currentTicket.rwmutex.Unlock()
-
-				// 出错则重置到 defaultTickDuration
-				if tickDuration != defaultTickDuration {
-					ticker.Stop()
-					tickDuration = defaultTickDuration
-					goto NEW_TICK_DURATION
-				}
-			} else {
-				srv.currentTicket.rwmutex.Lock()
-				srv.currentTicket.ticket = resp.Ticket
-				srv.currentTicket.err = nil
-				srv.currentTicket.rwmutex.Unlock()
-
-				newTickDuration := time.Duration(resp.ExpiresIn) * time.Second
-				if tickDuration != newTickDuration {
-					ticker.Stop()
-					tickDuration = newTickDuration
-					goto NEW_TICK_DURATION
-				}
-			}
-		}
-	}
+// 停止后台的 goroutine, 并等待它退出或者 ctx 结束.
+//  Stop 之后 Ticket() 返回最后一次获取的结果, TicketRefresh() 仍然可以同步的获取 ticket.
+//  可以多次调用.
+func (srv *DefaultTicketServer) Stop(ctx context.Context) error {
+	return srv.refresher.Stop(ctx)
 }
 
-type ticketResponse struct {
-	Ticket    string `json:"ticket"`     // 获取到的 jsapi_ticket
-	ExpiresIn int64  `json:"expires_in"` // jsapi_ticket 的有效时间，单位：秒
+// 停止后台的 goroutine 并等待它退出, 实现了 io.Closer.
+func (srv *DefaultTicketServer) Close() error {
+	return srv.refresher.Close()
 }
 
-// 从微信服务器获取 jsapi_ticket.
-func (srv *DefaultTicketServer) getTicket() (resp *ticketResponse, err error) {
+// 每次从微信服务器获取 ticket 之后(不管成功失败)都会往 ch 发送一个 mp.RefreshEvent.
+//  发送是非阻塞的, 如果 ch 满了则丢弃这个事件, 所以 ch 一般要有缓冲, 参考 signal.Notify.
+func (srv *DefaultTicketServer) Notify(ch chan<- mp.RefreshEvent) {
+	srv.refresher.Notify(ch)
+}
+
+// 不再往 ch 发送 mp.RefreshEvent.
+func (srv *DefaultTicketServer) StopNotify(ch chan<- mp.RefreshEvent) {
+	srv.refresher.StopNotify(ch)
+}
+
+// 获取 ticket 的刷新状态, 实现了 mp.StatusReporter.
+func (srv *DefaultTicketServer) Status() mp.RefreshStatus {
+	return srv.refresher.Status()
+}
+
+func (srv *DefaultTicketServer) Ticket() (ticket string, err error) {
+	return srv.refresher.Credential()
+}
+
+// 同 Ticket, 同时返回 ticket 的过期时间(已经减去了缓冲的时间).
+func (srv *DefaultTicketServer) TicketWithExpiry() (ticket string, expiresAt time.Time, err error) {
+	return srv.refresher.CredentialWithExpiry()
+}
+
+// 如果 5 秒内从微信服务器获取过, 则直接返回原来获取的结果.
+func (srv *DefaultTicketServer) TicketRefresh() (ticket string, err error) {
+	return srv.refresher.Refresh()
+}
+
+// 从微信服务器获取 ticket, 实现了 mp.CredentialFetcher.
+func (srv *DefaultTicketServer) getTicket(ctx context.Context) (ticket string, expiresIn time.Duration, err error) {
 	var result struct {
 		mp.Error
-		ticketResponse
+		Ticket    string `json:"ticket"`     // 获取到的 ticket
+		ExpiresIn int64  `json:"expires_in"` // ticket 的有效时间，单位：秒
 	}
 
-	incompleteURL := "https://api.weixin.qq.com/cgi-bin/ticket/getticket?type=jsapi&access_token="
-	if err = srv.GetJSON(incompleteURL, &result); err != nil {
+	incompleteURL := "https://api.weixin.qq.com/cgi-bin/ticket/getticket?type=" +
+		url.QueryEscape(srv.ticketType) + "&access_token="
+	if err = srv.GetJSONContext(ctx, incompleteURL, &result); err != nil {
 		return
 	}
 
@@ -168,30 +156,9 @@ func (srv *DefaultTicketServer) getTicket() (resp *ticketResponse, err error) {
 		return
 	}
 
-	// 由于网络的延时, jsapi_ticket 过期时间留了一个缓冲区;
-	// 正常情况下微信服务器会返回 7200, 则缓冲区的大小为 10 分钟.
-	switch {
-	case result.ExpiresIn > 60*60:
-		result.ExpiresIn -= 60 * 10
-		resp = &result.ticketResponse
-		return
-	case result.ExpiresIn > 60*30:
-		result.ExpiresIn -= 60 * 5
-		resp = &result.ticketResponse
-		return
-	case result.ExpiresIn > 60*5:
-		result.ExpiresIn -= 60
-		resp = &result.ticketResponse
-		return
-	case result.ExpiresIn > 60:
-		result.ExpiresIn -= 10
-		resp = &result.ticketResponse
-		return
-	case result.ExpiresIn > 0:
-		resp = &result.ticketResponse
-		return
-	default:
-		err = errors.New("invalid expires_in: " + strconv.FormatInt(result.ExpiresIn, 10))
+	if expiresIn, err = mp.BufferedExpiresIn(result.ExpiresIn); err != nil {
 		return
 	}
+	ticket = result.Ticket
+	return
 }
@@ -8,6 +8,8 @@ package jssdk
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"sort"
+	"strings"
 )
 
 // 微信 js-sdk wx.config 的参数签名.
@@ -31,3 +33,16 @@ func WXConfigSign(jsapiTicket, nonceStr, timestamp, url string) (signature strin
 	hashsum := sha1.Sum(buf)
 	return hex.EncodeToString(hashsum[:])
 }
+
+// 微信卡券的签名, 把 apiTicket 和 strs 按照字典序排序之后拼接起来, 然后 sha1.
+//  apiTicket 是 TicketTypeWxCard 类型的 ticket;
+//  strs 一般是 timestamp, nonce_str, card_id, code, openid 等参数的值, 空的参数不要传入.
+func WXCardSign(apiTicket string, strs ...string) (signature string) {
+	values := make([]string, 0, len(strs)+1)
+	values = append(values, apiTicket)
+	values = append(values, strs...)
+	sort.Strings(values)
+
+	hashsum := sha1.Sum([]byte(strings.Join(values, "")))
+	return hex.EncodeToString(hashsum[:])
+}
@@ -5,11 +5,11 @@
 
 package jssdk
 
-// jsapi_ticket 中控服务器接口.
+// jsapi_ticket, 卡券 api_ticket 等 ticket 的中控服务器接口.
 type TicketServer interface {
-	// 从中控服务器获取 jsapi_ticket, 该 jsapi_ticket 一般缓存在某个地方.
+	// 从中控服务器获取 ticket, 该 ticket 一般缓存在某个地方.
 	Ticket() (ticket string, err error)
 
-	// 请求 jsapi_ticket 中控服务器到微信服务器刷新 jsapi_ticket.
+	// 请求 ticket 中控服务器到微信服务器刷新 ticket.
 	TicketRefresh() (ticket string, err error)
 }
@@ -0,0 +1,245 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 客户端的限流器, WechatClient 每次发送请求之前(包括重试)都会调用 Wait.
+type Limiter interface {
+	// api 是 URL 的 path, 比如 "/cgi-bin/menu/create".
+	//  返回 nil 表示可以发送请求, 否则 WechatClient 直接返回这个错误, 不会发送请求.
+	Wait(ctx context.Context, api string) error
+}
+
+// Limiter 可以同时实现 QuotaObserver, 微信服务器返回 45009(接口调用超过限制)的时候,
+// WechatClient 和 TokenServer 会调用 QuotaExhausted 通知 Limiter.
+type QuotaObserver interface {
+	// 微信服务器认为 api 当天的配额已经用完, 之后当天的 Wait(ctx, api) 应该直接返回错误.
+	QuotaExhausted(api string)
+}
+
+// 如果 err 是 45009 并且 limiter 实现了 QuotaObserver, 则通知 limiter.
+func observeQuota(limiter Limiter, api string, err error) {
+	if limiter == nil {
+		return
+	}
+	observer, ok := limiter.(QuotaObserver)
+	if !ok {
+		return
+	}
+	var wxErr *Error
+	if errors.As(err, &wxErr) && wxErr.ErrCode == ErrCodeAPIQuotaExceeded {
+		observer.QuotaExhausted(api)
+	}
+}
+
+// QuotaLimiter.Delay == false 时, 调用速率超过限制返回这个错误.
+var ErrRateLimited = errors.New("mp: rate limit exceeded")
+
+// 客户端统计的调用次数超过了每日的配额.
+//  errors.Is(err, ErrorClassQuota) 返回 true, IsQuotaError(err) 也返回 true.
+type QuotaExceededError struct {
+	API   string
+	Quota int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("mp: daily quota of %s exceeded, quota: %d", e.API, e.Quota)
+}
+
+func (e *QuotaExceededError) Is(target error) bool {
+	return target == ErrorClassQuota
+}
+
+// 微信公众平台常用 API 每日调用次数的默认配额, key 是 URL 的 path.
+//  实际的配额以微信公众平台后台显示的为准(认证, 服务号等会有不同), 请根据需要修改.
+var DefaultQuotas = map[string]int{
+	"/cgi-bin/token":                     2000,
+	"/cgi-bin/menu/create":               1000,
+	"/cgi-bin/menu/get":                  10000,
+	"/cgi-bin/menu/delete":               1000,
+	"/cgi-bin/groups/create":             1000,
+	"/cgi-bin/groups/get":                1000,
+	"/cgi-bin/groups/getid":              10000,
+	"/cgi-bin/groups/update":             1000,
+	"/cgi-bin/groups/members/update":     10000,
+	"/cgi-bin/user/info/updateremark":    10000,
+	"/cgi-bin/user/info":                 5000000,
+	"/cgi-bin/user/get":                  500,
+	"/cgi-bin/qrcode/create":             100000,
+	"/cgi-bin/shorturl":                  1000,
+	"/cgi-bin/media/upload":              100000,
+	"/cgi-bin/media/get":                 200000,
+	"/cgi-bin/message/custom/send":       500000,
+	"/cgi-bin/message/mass/sendall":      100,
+	"/cgi-bin/message/mass/send":         100,
+	"/cgi-bin/message/mass/preview":      100,
+	"/cgi-bin/message/template/send":     100000,
+	"/cgi-bin/template/api_add_template": 1000,
+	"/cgi-bin/ticket/getticket":          2000,
+	"/cgi-bin/getcallbackip":             1000,
+}
+
+// 微信的配额在北京时间每天零点重置
+var beijingLocation = time.FixedZone("CST", 8*60*60)
+
+// 按 API 统计每日调用次数的限流器, 同时用令牌桶限制所有 API 总的调用速率.
+//  可以被多个 WechatClient 共享, 并发安全.
+type QuotaLimiter struct {
+	quotas map[string]int
+	rate   float64 // 每秒产生的令牌数, <= 0 表示不限制速率
+	burst  int     // 令牌桶的容量
+
+	// 调用速率超过限制的时候是否等待, false 则直接返回 ErrRateLimited.
+	//  请在使用之前设置.
+	Delay bool
+
+	mutex     sync.Mutex
+	day       string          // 当前统计的日期, 北京时间
+	usage     map[string]int  // 当天每个 API 的调用次数
+	exhausted map[string]bool // 当天微信服务器返回了 45009 的 API
+	tokens    float64         // 令牌桶里剩余的令牌
+	last      time.Time       // 上次更新令牌的时间
+
+	now func() time.Time // 测试的时候替换
+}
+
+// 新建一个 QuotaLimiter.
+//  quotas: 每个 API 每日调用次数的配额, 没有列出的 API 不限制次数, 可以是 DefaultQuotas;
+//  rate:   每秒允许的调用次数, <= 0 表示不限制速率;
+//  burst:  允许的突发调用次数, <= 0 则为 1.
+func NewQuotaLimiter(quotas map[string]int, rate float64, burst int) *QuotaLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	quotasCopy := make(map[string]int, len(quotas))
+	for api, quota := range quotas {
+		quotasCopy[api] = quota
+	}
+	return &QuotaLimiter{
+		quotas: quotasCopy,
+		rate:   rate,
+		burst:  burst,
+		usage:  make(map[string]int),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+func (limiter *QuotaLimiter) Wait(ctx context.Context, api string) error {
+	for {
+		limiter.mutex.Lock()
+		now := limiter.now()
+		limiter.resetIfNewDay(now)
+
+		if quota, ok := limiter.quotas[api]; (ok && limiter.usage[api] >= quota) || limiter.exhausted[api] {
+			limiter.mutex.Unlock()
+			return &QuotaExceededError{API: api, Quota: quota}
+		}
+		wait := limiter.takeToken(now)
+		if wait <= 0 {
+			limiter.usage[api]++
+			limiter.mutex.Unlock()
+			return nil
+		}
+		limiter.mutex.Unlock()
+
+		if !limiter.Delay {
+			return ErrRateLimited
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// 到了新的一天则清空调用次数.
+//  NOTE: 调用者要先锁定 limiter.mutex
+func (limiter *QuotaLimiter) resetIfNewDay(now time.Time) {
+	day := now.In(beijingLocation).Format("2006-01-02")
+	if day != limiter.day {
+		limiter.day = day
+		limiter.usage = make(map[string]int)
+		limiter.exhausted = nil
+	}
+}
+
+// 标记 api 当天(北京时间)的配额已经用完, 实现了 QuotaObserver.
+//  客户端的统计可能和微信服务器不一致(比如多个进程共用一个公众号), 以微信服务器返回的 45009 为准.
+func (limiter *QuotaLimiter) QuotaExhausted(api string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.resetIfNewDay(limiter.now())
+	if limiter.exhausted == nil {
+		limiter.exhausted = make(map[string]bool)
+	}
+	limiter.exhausted[api] = true
+}
+
+// 从令牌桶取一个令牌, 成功返回 0, 否则返回需要等待的时间.
+//  NOTE: 调用者要先锁定 limiter.mutex
+func (limiter *QuotaLimiter) takeToken(now time.Time) time.Duration {
+	if limiter.rate <= 0 {
+		return 0
+	}
+	if !limiter.last.IsZero() {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		if limiter.tokens > float64(limiter.burst) {
+			limiter.tokens = float64(limiter.burst)
+		}
+	}
+	limiter.last = now
+
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - limiter.tokens) / limiter.rate * float64(time.Second))
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// 某个 API 当天的调用情况.
+type APIUsage struct {
+	API   string `json:"api"`
+	Count int    `json:"count"` // 当天已经调用的次数
+	Quota int    `json:"quota"` // 每日的配额, 0 表示没有配额限制
+}
+
+// 返回当天(北京时间)所有 API 的调用情况, 按 API 排序, 可以用于监控面板.
+//  有配额的 API 即使还没有调用也会返回.
+func (limiter *QuotaLimiter) Usage() []APIUsage {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.resetIfNewDay(limiter.now())
+
+	usages := make([]APIUsage, 0, len(limiter.quotas)+len(limiter.usage))
+	for api, quota := range limiter.quotas {
+		usages = append(usages, APIUsage{API: api, Count: limiter.usage[api], Quota: quota})
+	}
+	for api, count := range limiter.usage {
+		if _, ok := limiter.quotas[api]; !ok {
+			usages = append(usages, APIUsage{API: api, Count: count})
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].API < usages[j].API })
+	return usages
+}
@@ -0,0 +1,107 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuotaLimiter(t *testing.T) {
+	now := time.Date(2015, 3, 1, 23, 59, 0, 0, beijingLocation)
+	limiter := NewQuotaLimiter(map[string]int{"/cgi-bin/menu/create": 2}, 1, 2)
+	limiter.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := limiter.Wait(ctx, "/cgi-bin/menu/create"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 令牌桶已经空了
+	if err := limiter.Wait(ctx, "/cgi-bin/menu/get"); err != ErrRateLimited {
+		t.Errorf("err mismatch, have: %v, want: %v", err, ErrRateLimited)
+	}
+
+	now = now.Add(30 * time.Second)
+	err := limiter.Wait(ctx, "/cgi-bin/menu/create")
+	if !errors.Is(err, ErrorClassQuota) || !IsQuotaError(err) {
+		t.Errorf("err mismatch, have: %v, want: QuotaExceededError", err)
+	}
+
+	usages := limiter.Usage()
+	if len(usages) != 1 || usages[0].Count != 2 || usages[0].Quota != 2 {
+		t.Errorf("unexpected usage: %+v", usages)
+	}
+
+	// 北京时间零点之后配额重置
+	now = now.Add(time.Minute)
+	if err := limiter.Wait(ctx, "/cgi-bin/menu/create"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaLimiterExhausted(t *testing.T) {
+	now := time.Date(2015, 3, 1, 23, 0, 0, 0, beijingLocation)
+	limiter := NewQuotaLimiter(DefaultQuotas, 0, 0)
+	limiter.now = func() time.Time { return now }
+
+	var requestCount int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		io.WriteString(w, `{"errcode":45009,"errmsg":"reach max api daily quota limit"}`)
+	}))
+	defer server.Close()
+
+	// 获取 access_token 也计入配额, 45009 之后当天不再请求
+	for i := 0; i < 2; i++ {
+		_, err := getToken(context.Background(), server.Client(), &Endpoint{APIBaseURL: server.URL}, limiter, "appid", "secret")
+		if !IsQuotaError(err) {
+			t.Errorf("err mismatch, have: %v, want: quota error", err)
+		}
+	}
+	if requestCount != 1 {
+		t.Errorf("requestCount mismatch, have: %d, want: 1", requestCount)
+	}
+
+	clt := &WechatClient{
+		TokenServer: &testTokenServer{token: "token"},
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+		Limiter:     limiter,
+	}
+	for i := 0; i < 2; i++ {
+		var result Error
+		err := clt.GetJSON("https://api.weixin.qq.com/cgi-bin/unknown?access_token=", &result)
+		if i == 0 && (err != nil || result.ErrCode != ErrCodeAPIQuotaExceeded) {
+			t.Errorf("unexpected result: %+v, err: %v", result, err)
+		}
+		if i == 1 && !IsQuotaError(err) {
+			t.Errorf("err mismatch, have: %v, want: quota error", err)
+		}
+	}
+	if requestCount != 2 {
+		t.Errorf("requestCount mismatch, have: %d, want: 2", requestCount)
+	}
+
+	for _, usage := range limiter.Usage() {
+		if usage.API == tokenAPI && (usage.Count != 1 || usage.Quota != 2000) {
+			t.Errorf("unexpected usage: %+v", usage)
+		}
+	}
+
+	// 北京时间零点之后重置
+	now = now.Add(2 * time.Hour)
+	if err := limiter.Wait(context.Background(), tokenAPI); err != nil {
+		t.Error(err)
+	}
+}
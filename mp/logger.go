@@ -0,0 +1,44 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+// WechatServer 实现了这个接口则 ServeHTTP 通过它输出日志, 参考 DefaultWechatServer.SetLogger.
+//  ServeHTTP 只输出 appid, openid, msgtype, event, latency 等字段, 不会输出消息的内容和签名.
+type LoggerProvider interface {
+	Logger() util.Logger // 返回 nil 表示不输出日志
+}
+
+// 获取 wechatServer 的 Logger, 没有则返回 util.NopLogger.
+func serverLogger(wechatServer WechatServer) util.Logger {
+	if provider, ok := wechatServer.(LoggerProvider); ok {
+		if logger := provider.Logger(); logger != nil {
+			return logger
+		}
+	}
+	return util.NopLogger
+}
+
+// 输出一条 MessageHandler 处理完消息的 Debug 日志.
+func logMessageServed(logger util.Logger, r *Request, start time.Time) {
+	util.LogMessageServed(logger, start,
+		util.LogField{Key: "appid", Value: r.WechatAppId},
+		util.LogField{Key: "openid", Value: r.MixedMsg.FromUserName},
+		util.LogField{Key: "msgtype", Value: r.MixedMsg.MsgType},
+		util.LogField{Key: "event", Value: r.MixedMsg.Event},
+		util.LogField{Key: "encrypt_type", Value: r.EncryptType},
+	)
+}
+
+// 输出一次 API 调用的日志, 参考 util.LogAPICall.
+func logAPICall(logger util.Logger, call *Call, start time.Time, err error) {
+	util.LogAPICall(logger, call.API, call.Method, start, call.Response.APIError().ErrCode, err)
+}
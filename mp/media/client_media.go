@@ -45,17 +45,21 @@ func (clt *Client) downloadMediaToWriter(mediaId string, writer io.Writer) (err
 
 	hasRetried := false
 RETRY:
-	finalURL := "http://file.api.weixin.qq.com/cgi-bin/media/get?media_id=" + mediaId +
+	finalURL := clt.ResolveURL("http://file.api.weixin.qq.com/cgi-bin/media/get?media_id="+mediaId) +
 		"&access_token=" + token
 
-	httpResp, err := clt.HttpClient.Get(finalURL)
+	httpReq, err := http.NewRequestWithContext(clt.Context(), "GET", finalURL, nil)
 	if err != nil {
 		return
 	}
+	httpResp, err := clt.HttpClient.Do(httpReq)
+	if err != nil {
+		return mp.NewTransportError(finalURL, 0, err)
+	}
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http.Status: %s", httpResp.Status)
+		return mp.NewTransportError(finalURL, httpResp.StatusCode, fmt.Errorf("http.Status: %s", httpResp.Status))
 	}
 
 	ContentType, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type"))
@@ -68,7 +72,7 @@ RETRY:
 	// 返回的是错误信息
 	var result mp.Error
 	if err = json.NewDecoder(httpResp.Body).Decode(&result); err != nil {
-		return
+		return mp.NewTransportError(finalURL, httpResp.StatusCode, err)
 	}
 
 	switch result.ErrCode {
@@ -78,7 +82,10 @@ RETRY:
 		if !hasRetried {
 			hasRetried = true
 
-			if token, err = clt.GetNewToken(); err != nil {
+			if err = clt.Context().Err(); err != nil {
+				return
+			}
+			if token, err = clt.RenewToken(token); err != nil {
 				return
 			}
 			goto RETRY
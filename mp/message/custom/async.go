@@ -0,0 +1,201 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package custom
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/philsong/wechat2/mp"
+)
+
+const (
+	DefaultAsyncWorkers     = 16
+	DefaultAsyncQueueSize   = 1024
+	DefaultAsyncSendTimeout = 10 * time.Second // 发送一条客服消息的超时
+)
+
+// 异步回复模式的 MessageHandler, 一般包裹 MessageServeMux:
+//
+//    asyncHandler := custom.NewAsyncHandler(messageServeMux, custom.NewClient(tokenServer, nil), 0, 0)
+//    defer asyncHandler.Close()
+//    wechatServer := mp.NewDefaultWechatServer("id", "token", "appid", aesKey, asyncHandler)
+//
+//  收到消息后立即回复 "success", 然后在后台的 worker 里调用 Handler; Handler 像平常一样写入被动回复
+// (mp.WriteRawResponse, mp.WriteAESResponse 都可以), 写入的回复会转换为对应的客服消息通过 Client 发送,
+// 这样 Handler 就不受微信服务器 5 秒超时的限制; 没有写入或者只写入了 "success" 表示不回复.
+//  NOTE:
+//  1. 异步调用 Handler 的时候 Request.HttpRequest 为 nil, http.ResponseWriter 只是记录写入的回复;
+//  2. 客服消息只能在用户和公众号互动后的 48 小时内发送, 事件推送(比如关注)一般都满足这个条件;
+//  3. 队列满了或者已经 Close 的时候同步调用 Handler, 和没有异步模式一样.
+type AsyncHandler struct {
+	handler mp.MessageHandler
+	clt     *Client
+
+	jobs chan *mp.Request
+	wg   sync.WaitGroup
+
+	closeMutex sync.RWMutex
+	closed     bool
+
+	// 异步回复失败的时候调用, 比如 Handler panic, 回复无法转换为客服消息或者发送客服消息失败; 可以为 nil.
+	//  NOTE: 请在第一次使用之前设置; 在 worker 里同步调用.
+	OnError func(r *mp.Request, err error)
+
+	// 发送一条客服消息的超时, <= 0 表示使用 DefaultAsyncSendTimeout.
+	//  NOTE: 请在第一次使用之前设置.
+	SendTimeout time.Duration
+}
+
+var _ mp.MessageHandler = new(AsyncHandler)
+
+// 创建一个新的 AsyncHandler 并启动 workers 个 worker, 队列最多缓存 queueSize 个消息.
+//  workers <= 0 则使用 DefaultAsyncWorkers, queueSize <= 0 则使用 DefaultAsyncQueueSize.
+func NewAsyncHandler(handler mp.MessageHandler, clt *Client, workers, queueSize int) *AsyncHandler {
+	if handler == nil {
+		panic("custom: nil handler")
+	}
+	if clt == nil {
+		panic("custom: nil Client")
+	}
+	if workers <= 0 {
+		workers = DefaultAsyncWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultAsyncQueueSize
+	}
+
+	h := &AsyncHandler{
+		handler: handler,
+		clt:     clt,
+		jobs:    make(chan *mp.Request, queueSize),
+	}
+	h.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go h.worker()
+	}
+	return h
+}
+
+func (h *AsyncHandler) ServeMessage(w http.ResponseWriter, r *mp.Request) {
+	h.closeMutex.RLock()
+	if !h.closed {
+		req := *r
+		req.HttpRequest = nil
+
+		select {
+		case h.jobs <- &req:
+			h.closeMutex.RUnlock()
+			io.WriteString(w, "success")
+			return
+		default:
+		}
+	}
+	h.closeMutex.RUnlock()
+
+	h.handler.ServeMessage(w, r)
+}
+
+// 不再接收新的消息, 等待队列里的消息处理完成后返回, 实现了 io.Closer.
+//  可以多次调用.
+func (h *AsyncHandler) Close() error {
+	h.closeMutex.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.jobs)
+	}
+	h.closeMutex.Unlock()
+
+	h.wg.Wait()
+	return nil
+}
+
+func (h *AsyncHandler) worker() {
+	defer h.wg.Done()
+
+	for r := range h.jobs {
+		if err := h.serve(r); err != nil && h.OnError != nil {
+			h.OnError(r, err)
+		}
+	}
+}
+
+// 处理一个消息, Handler 的 panic 转换为错误返回, 不会导致 worker 退出.
+func (h *AsyncHandler) serve(r *mp.Request) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("custom: AsyncHandler panic: %v", v)
+		}
+	}()
+
+	recorder := newResponseRecorder()
+	h.handler.ServeMessage(recorder, r)
+
+	msg, err := parseResponse(bytes.TrimSpace(recorder.body.Bytes()), r)
+	if err != nil {
+		return
+	}
+	if msg == nil { // Handler 没有回复
+		return
+	}
+	customMsg, err := FromResponse(msg)
+	if err != nil {
+		return
+	}
+
+	timeout := h.SendTimeout
+	if timeout <= 0 {
+		timeout = DefaultAsyncSendTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return h.clt.WithContext(ctx).sendCustomMessage(customMsg)
+}
+
+// 异步调用 Handler 时使用的 http.ResponseWriter, 只记录写入的 body.
+type responseRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *responseRecorder) WriteHeader(int) {}
+
+// 发送 FromResponse 转换后的客服消息.
+func (clt *Client) sendCustomMessage(msg interface{}) error {
+	switch msg := msg.(type) {
+	case *Text:
+		return clt.SendText(msg)
+	case *Image:
+		return clt.SendImage(msg)
+	case *Voice:
+		return clt.SendVoice(msg)
+	case *Video:
+		return clt.SendVideo(msg)
+	case *Music:
+		return clt.SendMusic(msg)
+	case *News:
+		return clt.SendNews(msg)
+	default:
+		return fmt.Errorf("unsupported custom message type: %T", msg)
+	}
+}
@@ -0,0 +1,152 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package custom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philsong/wechat2/mp"
+	"github.com/philsong/wechat2/mp/message/response"
+)
+
+type testTokenServer struct{}
+
+func (testTokenServer) Token() (string, error)        { return "token", nil }
+func (testTokenServer) TokenRefresh() (string, error) { return "token", nil }
+
+func TestAsyncHandler(t *testing.T) {
+	sent := make(chan Text, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var text Text
+		if err := json.NewDecoder(r.Body).Decode(&text); err != nil {
+			t.Error(err)
+		}
+		sent <- text
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}))
+	defer server.Close()
+
+	clt := &Client{
+		WechatClient: mp.WechatClient{
+			TokenServer: testTokenServer{},
+			HttpClient:  server.Client(),
+			Endpoint:    &mp.Endpoint{APIBaseURL: server.URL},
+		},
+	}
+	handler := mp.MessageHandlerFunc(func(w http.ResponseWriter, r *mp.Request) {
+		mp.WriteAESResponse(w, r, response.NewText("openid", r.WechatId, "hello", r.TimeStamp))
+	})
+	asyncHandler := NewAsyncHandler(handler, clt, 1, 1)
+
+	r := &mp.Request{
+		TimeStamp:   1420000000,
+		Nonce:       "nonce",
+		EncryptType: "aes",
+		Random:      []byte("0123456789abcdef"),
+		WechatId:    "gh_id",
+		WechatToken: "token",
+		WechatAppId: "appid",
+	}
+	w := httptest.NewRecorder()
+	asyncHandler.ServeMessage(w, r)
+	if body := w.Body.String(); body != "success" {
+		t.Errorf("body mismatch, have: %q, want: %q", body, "success")
+	}
+
+	asyncHandler.Close()
+	select {
+	case text := <-sent:
+		if text.ToUser != "openid" || text.MsgType != MsgTypeText || text.Text.Content != "hello" {
+			t.Errorf("unexpected custom message: %+v", text)
+		}
+	default:
+		t.Error("custom message not sent")
+	}
+}
+
+func TestAsyncHandlerPanicAndTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	clt := &Client{
+		WechatClient: mp.WechatClient{
+			TokenServer: testTokenServer{},
+			HttpClient:  server.Client(),
+			Endpoint:    &mp.Endpoint{APIBaseURL: server.URL},
+		},
+	}
+	handler := mp.MessageHandlerFunc(func(w http.ResponseWriter, r *mp.Request) {
+		if r.Nonce == "panic" {
+			panic("boom")
+		}
+		mp.WriteRawResponse(w, r, response.NewText("openid", r.WechatId, "hello", r.TimeStamp))
+	})
+	asyncHandler := NewAsyncHandler(handler, clt, 1, 2)
+	asyncHandler.SendTimeout = 10 * time.Millisecond
+
+	var errs []error
+	asyncHandler.OnError = func(r *mp.Request, err error) {
+		errs = append(errs, err)
+	}
+
+	// panic 之后 worker 还要继续处理下一个消息
+	asyncHandler.ServeMessage(httptest.NewRecorder(), &mp.Request{Nonce: "panic", WechatId: "gh_id"})
+	asyncHandler.ServeMessage(httptest.NewRecorder(), &mp.Request{Nonce: "slow", WechatId: "gh_id"})
+	asyncHandler.Close()
+
+	if len(errs) != 2 {
+		t.Fatalf("errors mismatch, have: %v, want: 2 errors", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "boom") {
+		t.Errorf("the panic is not reported: %v", errs[0])
+	}
+	if !errors.Is(errs[1], context.DeadlineExceeded) {
+		t.Errorf("the send is not bounded by SendTimeout: %v", errs[1])
+	}
+}
+
+func TestAsyncHandlerSuccessResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("no custom message should be sent")
+	}))
+	defer server.Close()
+
+	clt := &Client{
+		WechatClient: mp.WechatClient{
+			TokenServer: testTokenServer{},
+			HttpClient:  server.Client(),
+			Endpoint:    &mp.Endpoint{APIBaseURL: server.URL},
+		},
+	}
+	// 按照约定回复 "success" 表示不回复, 不是错误
+	handler := mp.MessageHandlerFunc(func(w http.ResponseWriter, r *mp.Request) {
+		w.Write([]byte("success\n"))
+	})
+	asyncHandler := NewAsyncHandler(handler, clt, 1, 1)
+
+	var errs []error
+	asyncHandler.OnError = func(r *mp.Request, err error) {
+		errs = append(errs, err)
+	}
+	asyncHandler.ServeMessage(httptest.NewRecorder(), &mp.Request{WechatId: "gh_id"})
+	asyncHandler.Close()
+
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
@@ -0,0 +1,102 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package custom
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/philsong/wechat2/mp"
+	"github.com/philsong/wechat2/mp/message/response"
+	"github.com/philsong/wechat2/util"
+)
+
+// 把被动回复的消息(response.Text, response.News 等的指针)转换为对应的客服消息(*Text, *News 等).
+//  接收方是 msg 的 ToUserName; response.TransferToCustomerService 没有对应的客服消息, 返回错误.
+func FromResponse(msg interface{}) (customMsg interface{}, err error) {
+	switch msg := msg.(type) {
+	case *response.Text:
+		return NewText(msg.ToUserName, msg.Content, ""), nil
+	case *response.Image:
+		return NewImage(msg.ToUserName, msg.Image.MediaId, ""), nil
+	case *response.Voice:
+		return NewVoice(msg.ToUserName, msg.Voice.MediaId, ""), nil
+	case *response.Video:
+		return NewVideo(msg.ToUserName, msg.Video.MediaId, "", msg.Video.Title, msg.Video.Description, ""), nil
+	case *response.Music:
+		return NewMusic(msg.ToUserName, msg.Music.ThumbMediaId, msg.Music.MusicURL, msg.Music.HQMusicURL,
+			msg.Music.Title, msg.Music.Description, ""), nil
+	case *response.News:
+		articles := make([]NewsArticle, len(msg.Articles))
+		for i, article := range msg.Articles {
+			articles[i] = NewsArticle{
+				Title:       article.Title,
+				Description: article.Description,
+				URL:         article.URL,
+				PicURL:      article.PicURL,
+			}
+		}
+		return NewNews(msg.ToUserName, articles, ""), nil
+	case *response.TransferToCustomerService:
+		return nil, errors.New("transfer_customer_service can not be sent as custom message")
+	default:
+		return nil, fmt.Errorf("unsupported response message type: %T", msg)
+	}
+}
+
+// 解析 MessageHandler 写入的被动回复的 XML, 安全模式的回复会先解密.
+//  body 为空或者是 "success"(微信约定的不回复) 则返回 nil, nil.
+func parseResponse(body []byte, r *mp.Request) (msg interface{}, err error) {
+	if len(body) == 0 || string(body) == "success" {
+		return
+	}
+
+	var header struct {
+		mp.CommonMessageHeader
+		EncryptedMsg string `xml:"Encrypt"`
+	}
+	if err = xml.Unmarshal(body, &header); err != nil {
+		return
+	}
+
+	if header.EncryptedMsg != "" {
+		encryptedMsgBytes, err := base64.StdEncoding.DecodeString(header.EncryptedMsg)
+		if err != nil {
+			return nil, err
+		}
+		if _, body, err = util.AESDecryptMsg(encryptedMsgBytes, r.WechatAppId, r.AESKey); err != nil {
+			return nil, err
+		}
+		if err = xml.Unmarshal(body, &header); err != nil {
+			return nil, err
+		}
+	}
+
+	switch header.MsgType {
+	case response.MsgTypeText:
+		msg = new(response.Text)
+	case response.MsgTypeImage:
+		msg = new(response.Image)
+	case response.MsgTypeVoice:
+		msg = new(response.Voice)
+	case response.MsgTypeVideo:
+		msg = new(response.Video)
+	case response.MsgTypeMusic:
+		msg = new(response.Music)
+	case response.MsgTypeNews:
+		msg = new(response.News)
+	case response.MsgTypeTransferCustomerService:
+		msg = new(response.TransferToCustomerService)
+	default:
+		return nil, fmt.Errorf("unknown response MsgType: %q", header.MsgType)
+	}
+	if err = xml.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,84 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package dispatch
+
+import (
+	"context"
+	"time"
+
+	"github.com/philsong/wechat2/mp"
+	"github.com/philsong/wechat2/mp/message/response"
+)
+
+// 被动回复的消息, 是 response.Text, response.News 等的指针, nil 表示回复空串.
+//  可以通过 Context 的 Text, News 等方法创建.
+type Reply interface{}
+
+// 处理函数的上下文.
+type Context struct {
+	context.Context // Request.HttpRequest 的 context, HttpRequest == nil 的时候是 context.Background()
+
+	Request *mp.Request
+}
+
+func newContext(r *mp.Request) *Context {
+	ctx := context.Background()
+	if r.HttpRequest != nil {
+		ctx = r.HttpRequest.Context()
+	}
+	return &Context{
+		Context: ctx,
+		Request: r,
+	}
+}
+
+// 回复给发送消息的用户的 to, from 和 timestamp.
+func (ctx *Context) replyHeader() (to, from string, timestamp int64) {
+	msg := ctx.Request.MixedMsg
+	return msg.FromUserName, msg.ToUserName, time.Now().Unix()
+}
+
+// 回复文本消息.
+func (ctx *Context) Text(content string) Reply {
+	to, from, timestamp := ctx.replyHeader()
+	return response.NewText(to, from, content, timestamp)
+}
+
+// 回复图片消息.
+func (ctx *Context) Image(mediaId string) Reply {
+	to, from, timestamp := ctx.replyHeader()
+	return response.NewImage(to, from, mediaId, timestamp)
+}
+
+// 回复语音消息.
+func (ctx *Context) Voice(mediaId string) Reply {
+	to, from, timestamp := ctx.replyHeader()
+	return response.NewVoice(to, from, mediaId, timestamp)
+}
+
+// 回复视频消息.
+func (ctx *Context) Video(mediaId, title, description string) Reply {
+	to, from, timestamp := ctx.replyHeader()
+	return response.NewVideo(to, from, mediaId, title, description, timestamp)
+}
+
+// 回复音乐消息.
+func (ctx *Context) Music(thumbMediaId, musicURL, HQMusicURL, title, description string) Reply {
+	to, from, timestamp := ctx.replyHeader()
+	return response.NewMusic(to, from, thumbMediaId, musicURL, HQMusicURL, title, description, timestamp)
+}
+
+// 回复图文消息.
+func (ctx *Context) News(articles ...response.NewsArticle) Reply {
+	to, from, timestamp := ctx.replyHeader()
+	return response.NewNews(to, from, articles, timestamp)
+}
+
+// 将消息转发到多客服, kfAccount 为空则不指定客服.
+func (ctx *Context) TransferToCustomerService(kfAccount string) Reply {
+	to, from, timestamp := ctx.replyHeader()
+	return response.NewTransferToCustomerService(to, from, timestamp, kfAccount)
+}
@@ -0,0 +1,11 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+// 按消息(事件)的类型注册处理函数, 处理函数的参数是解析后的消息(事件)结构, 返回值是被动回复的消息.
+//
+// Mux 是推荐的消息注册方式, 取代 mp.MessageServeMux 的 MessageHandleFunc, EventHandleFunc(已经废弃).
+// 需要按其他条件路由, 或者注册 Mux 没有覆盖的消息(事件), 通过 Mux.ServeMux 拿到底层的 mp.MessageServeMux,
+// 使用 Route, MessageHandle, EventHandle, DefaultMessageHandle, DefaultEventHandle 注册 mp.MessageHandler.
+package dispatch
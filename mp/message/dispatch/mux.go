@@ -0,0 +1,225 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package dispatch
+
+import (
+	"net/http"
+
+	"github.com/philsong/wechat2/mp"
+	"github.com/philsong/wechat2/mp/menu"
+	"github.com/philsong/wechat2/mp/message/mass"
+	"github.com/philsong/wechat2/mp/message/request"
+	"github.com/philsong/wechat2/mp/message/template"
+)
+
+var _ mp.MessageHandler = new(Mux)
+
+// 在 mp.MessageServeMux 上按类型注册处理函数(推荐的注册方式, 参考包文档), 由 Mux 把 MixedMessage 转换为对应的消息(事件)结构,
+// 并且把处理函数返回的 Reply 通过 mp.Reply 写入:
+//
+//    mux := dispatch.NewMux(nil)
+//    mux.OnSubscribe(func(ctx *dispatch.Context, event *request.SubscribeEvent) dispatch.Reply {
+//        return ctx.Text("欢迎关注")
+//    })
+//    mux.OnClick("V1001_TODAY_MUSIC", func(ctx *dispatch.Context, event *menu.ClickEvent) dispatch.Reply {
+//        return ctx.Text("今日歌曲")
+//    })
+//    wechatServer := mp.NewDefaultWechatServer("id", "token", "appid", aesKey, mux)
+//
+//  NOTE: 带 key 的注册(比如 OnClick 的 key 不为空)是 priority 为 0 的 mp.MessageServeMux.Route 路由,
+//  优先于同类型不带 key 的注册, 参考 mp.MessageServeMux.Route.
+type Mux struct {
+	serveMux *mp.MessageServeMux
+
+	// 写入回复失败(比如 mp.Reply 校验失败)的时候调用, 可以为 nil.
+	OnError func(r *mp.Request, err error)
+}
+
+// 创建一个在 serveMux 上注册的 Mux, 如果 serveMux == nil 则创建一个新的 mp.MessageServeMux.
+func NewMux(serveMux *mp.MessageServeMux) *Mux {
+	if serveMux == nil {
+		serveMux = mp.NewMessageServeMux()
+	}
+	return &Mux{serveMux: serveMux}
+}
+
+// 获取底层的 mp.MessageServeMux, 可以继续注册普通的 MessageHandler.
+func (mux *Mux) ServeMux() *mp.MessageServeMux {
+	return mux.serveMux
+}
+
+func (mux *Mux) ServeMessage(w http.ResponseWriter, r *mp.Request) {
+	mux.serveMux.ServeMessage(w, r)
+}
+
+// 把返回 Reply 的处理函数包装成 mp.MessageHandler.
+func (mux *Mux) handler(fn func(ctx *Context) Reply) mp.MessageHandler {
+	return mp.MessageHandlerFunc(func(w http.ResponseWriter, r *mp.Request) {
+		reply := fn(newContext(r))
+		if reply == nil {
+			return
+		}
+		if err := mp.Reply(w, r, reply); err != nil && mux.OnError != nil {
+			mux.OnError(r, err)
+		}
+	})
+}
+
+func (mux *Mux) onMessage(msgType mp.MessageType, fn func(ctx *Context) Reply) {
+	mux.serveMux.MessageHandle(msgType, mux.handler(fn))
+}
+
+// key 为空则处理所有 eventType 类型的事件, 否则只处理 EventKey 等于 key 的事件.
+func (mux *Mux) onEvent(eventType mp.EventType, key string, fn func(ctx *Context) Reply) {
+	if key == "" {
+		mux.serveMux.EventHandle(eventType, mux.handler(fn))
+		return
+	}
+	mux.serveMux.Route(0, mp.MatchEventKey(eventType, key), mux.handler(fn))
+}
+
+// =============================================================================
+// 普通消息
+
+func (mux *Mux) OnText(fn func(ctx *Context, msg *request.Text) Reply) {
+	mux.onMessage(request.MsgTypeText, func(ctx *Context) Reply {
+		return fn(ctx, request.GetText(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnImage(fn func(ctx *Context, msg *request.Image) Reply) {
+	mux.onMessage(request.MsgTypeImage, func(ctx *Context) Reply {
+		return fn(ctx, request.GetImage(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnVoice(fn func(ctx *Context, msg *request.Voice) Reply) {
+	mux.onMessage(request.MsgTypeVoice, func(ctx *Context) Reply {
+		return fn(ctx, request.GetVoice(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnVideo(fn func(ctx *Context, msg *request.Video) Reply) {
+	mux.onMessage(request.MsgTypeVideo, func(ctx *Context) Reply {
+		return fn(ctx, request.GetVideo(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnLocation(fn func(ctx *Context, msg *request.Location) Reply) {
+	mux.onMessage(request.MsgTypeLocation, func(ctx *Context) Reply {
+		return fn(ctx, request.GetLocation(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnLink(fn func(ctx *Context, msg *request.Link) Reply) {
+	mux.onMessage(request.MsgTypeLink, func(ctx *Context) Reply {
+		return fn(ctx, request.GetLink(ctx.Request.MixedMsg))
+	})
+}
+
+// =============================================================================
+// 关注, 扫码, 上报地理位置事件
+
+// 关注事件, 如果注册了 OnSubscribeByScan 则不包括扫描带参数二维码的关注.
+func (mux *Mux) OnSubscribe(fn func(ctx *Context, event *request.SubscribeEvent) Reply) {
+	mux.onEvent(request.EventTypeSubscribe, "", func(ctx *Context) Reply {
+		return fn(ctx, request.GetSubscribeEvent(ctx.Request.MixedMsg))
+	})
+}
+
+// 未关注用户扫描带参数二维码关注的事件(EventKey 以 "qrscene_" 开头的 subscribe 事件).
+func (mux *Mux) OnSubscribeByScan(fn func(ctx *Context, event *request.SubscribeByScanEvent) Reply) {
+	matcher := mp.MatchEventKeyPrefix(request.EventTypeSubscribe, "qrscene_")
+	mux.serveMux.Route(0, matcher, mux.handler(func(ctx *Context) Reply {
+		return fn(ctx, request.GetSubscribeByScanEvent(ctx.Request.MixedMsg))
+	}))
+}
+
+func (mux *Mux) OnUnsubscribe(fn func(ctx *Context, event *request.UnsubscribeEvent) Reply) {
+	mux.onEvent(request.EventTypeUnsubscribe, "", func(ctx *Context) Reply {
+		return fn(ctx, request.GetUnsubscribeEvent(ctx.Request.MixedMsg))
+	})
+}
+
+// 已关注用户扫描带参数二维码的事件.
+func (mux *Mux) OnScan(fn func(ctx *Context, event *request.ScanEvent) Reply) {
+	mux.onEvent(request.EventTypeScan, "", func(ctx *Context) Reply {
+		return fn(ctx, request.GetScanEvent(ctx.Request.MixedMsg))
+	})
+}
+
+// 上报地理位置事件, 注意和 OnLocation(地理位置消息) 的区别.
+func (mux *Mux) OnLocationEvent(fn func(ctx *Context, event *request.LocationEvent) Reply) {
+	mux.onEvent(request.EventTypeLocation, "", func(ctx *Context) Reply {
+		return fn(ctx, request.GetLocationEvent(ctx.Request.MixedMsg))
+	})
+}
+
+// =============================================================================
+// 自定义菜单事件, key 是菜单的 key(VIEW 事件是 url), 为空则处理所有的菜单
+
+func (mux *Mux) OnClick(key string, fn func(ctx *Context, event *menu.ClickEvent) Reply) {
+	mux.onEvent(menu.EventTypeClick, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetClickEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnView(key string, fn func(ctx *Context, event *menu.ViewEvent) Reply) {
+	mux.onEvent(menu.EventTypeView, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetViewEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnScanCodePush(key string, fn func(ctx *Context, event *menu.ScanCodePushEvent) Reply) {
+	mux.onEvent(menu.EventTypeScanCodePush, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetScanCodePushEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnScanCodeWaitMsg(key string, fn func(ctx *Context, event *menu.ScanCodeWaitMsgEvent) Reply) {
+	mux.onEvent(menu.EventTypeScanCodeWaitMsg, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetScanCodeWaitMsgEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnPicSysPhoto(key string, fn func(ctx *Context, event *menu.PicSysPhotoEvent) Reply) {
+	mux.onEvent(menu.EventTypePicSysPhoto, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetPicSysPhotoEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnPicPhotoOrAlbum(key string, fn func(ctx *Context, event *menu.PicPhotoOrAlbumEvent) Reply) {
+	mux.onEvent(menu.EventTypePicPhotoOrAlbum, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetPicPhotoOrAlbumEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnPicWeixin(key string, fn func(ctx *Context, event *menu.PicWeixinEvent) Reply) {
+	mux.onEvent(menu.EventTypePicWeixin, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetPicWeixinEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnLocationSelect(key string, fn func(ctx *Context, event *menu.LocationSelectEvent) Reply) {
+	mux.onEvent(menu.EventTypeLocationSelect, key, func(ctx *Context) Reply {
+		return fn(ctx, menu.GetLocationSelectEvent(ctx.Request.MixedMsg))
+	})
+}
+
+// =============================================================================
+// 群发和模板消息的结果通知, 回复会被微信服务器忽略, 一般返回 nil
+
+func (mux *Mux) OnMassSendJobFinish(fn func(ctx *Context, event *mass.MassSendJobFinishEvent) Reply) {
+	mux.onEvent(mass.EventTypeMassSendJobFinish, "", func(ctx *Context) Reply {
+		return fn(ctx, mass.GetMassSendJobFinishEvent(ctx.Request.MixedMsg))
+	})
+}
+
+func (mux *Mux) OnTemplateSendJobFinish(fn func(ctx *Context, event *template.TemplateSendJobFinishEvent) Reply) {
+	mux.onEvent(template.EventTypeTemplateSendJobFinish, "", func(ctx *Context) Reply {
+		return fn(ctx, template.GetTemplateSendJobFinishEvent(ctx.Request.MixedMsg))
+	})
+}
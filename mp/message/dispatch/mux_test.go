@@ -0,0 +1,63 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package dispatch
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philsong/wechat2/mp"
+	"github.com/philsong/wechat2/mp/menu"
+	"github.com/philsong/wechat2/mp/message/request"
+	"github.com/philsong/wechat2/mp/message/response"
+)
+
+func TestMux(t *testing.T) {
+	mux := NewMux(nil)
+	mux.OnSubscribe(func(ctx *Context, event *request.SubscribeEvent) Reply {
+		return ctx.Text("welcome " + event.FromUserName)
+	})
+	mux.OnClick("", func(ctx *Context, event *menu.ClickEvent) Reply {
+		return ctx.Text("click " + event.EventKey)
+	})
+	mux.OnClick("HELP", func(ctx *Context, event *menu.ClickEvent) Reply {
+		return ctx.Text("help")
+	})
+
+	serve := func(event, key string) (text response.Text) {
+		r := &mp.Request{
+			MixedMsg: &mp.MixedMessage{
+				CommonMessageHeader: mp.CommonMessageHeader{
+					ToUserName:   "gh_test",
+					FromUserName: "openid",
+					MsgType:      "event",
+				},
+				Event:    event,
+				EventKey: key,
+			},
+		}
+		w := httptest.NewRecorder()
+		mux.ServeMessage(w, r)
+		if err := xml.Unmarshal(w.Body.Bytes(), &text); err != nil {
+			t.Fatal(err)
+		}
+		if text.ToUserName != "openid" || text.FromUserName != "gh_test" {
+			t.Errorf("unexpected reply header: %+v", text.CommonMessageHeader)
+		}
+		return
+	}
+
+	if text := serve("subscribe", ""); text.Content != "welcome openid" {
+		t.Errorf("content mismatch, have: %q", text.Content)
+	}
+	if text := serve("CLICK", "MUSIC"); text.Content != "click MUSIC" {
+		t.Errorf("content mismatch, have: %q", text.Content)
+	}
+	if text := serve("CLICK", "HELP"); text.Content != "help" {
+		t.Errorf("content mismatch, have: %q", text.Content)
+	}
+}
@@ -6,6 +6,7 @@
 package mass
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/philsong/wechat2/mp"
@@ -33,6 +34,13 @@ func NewClient(TokenServer mp.TokenServer, HttpClient *http.Client) *Client {
 	}
 }
 
+// 返回 clt 的一个浅拷贝, 该拷贝发起的所有请求都绑定到 ctx 上.
+func (clt *Client) WithContext(ctx context.Context) *Client {
+	return &Client{
+		WechatClient: *clt.WechatClient.WithContext(ctx),
+	}
+}
+
 // 删除群发.
 //  请注意:
 //  只有已经发送成功的消息才能删除删除消息只是将消息的图文详情页失效，已经收到的用户，
@@ -6,6 +6,7 @@
 package masstoall
 
 import (
+	"context"
 	"errors"
 	"net/http"
 
@@ -34,6 +35,13 @@ func NewClient(TokenServer mp.TokenServer, HttpClient *http.Client) *Client {
 	}
 }
 
+// 返回 clt 的一个浅拷贝, 该拷贝发起的所有请求都绑定到 ctx 上.
+func (clt *Client) WithContext(ctx context.Context) *Client {
+	return &Client{
+		WechatClient: *clt.WechatClient.WithContext(ctx),
+	}
+}
+
 func (clt *Client) SendText(msg *Text) (msgid int64, err error) {
 	if msg == nil {
 		err = errors.New("msg == nil")
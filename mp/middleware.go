@@ -0,0 +1,165 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+// MessageHandler 的中间件, 返回包裹了 handler 的 MessageHandler.
+type Middleware func(handler MessageHandler) MessageHandler
+
+// 中间件链, 零值可以直接使用:
+//
+//    chain := mp.NewChain(mp.RecoverMiddleware(nil), mp.TimeoutMiddleware(4*time.Second))
+//    handler := chain.Then(messageServeMux)
+//
+//  第一个中间件在最外层, 最先收到请求.
+type Chain struct {
+	middlewares []Middleware
+}
+
+func NewChain(middlewares ...Middleware) Chain {
+	return Chain{middlewares: append([]Middleware(nil), middlewares...)}
+}
+
+// 返回在 chain 后面添加了 middlewares 的新的 Chain, chain 本身不变.
+func (chain Chain) Append(middlewares ...Middleware) Chain {
+	newMiddlewares := make([]Middleware, 0, len(chain.middlewares)+len(middlewares))
+	newMiddlewares = append(newMiddlewares, chain.middlewares...)
+	newMiddlewares = append(newMiddlewares, middlewares...)
+	return Chain{middlewares: newMiddlewares}
+}
+
+// 用 chain 包裹 handler.
+func (chain Chain) Then(handler MessageHandler) MessageHandler {
+	if handler == nil {
+		panic("mp: nil handler")
+	}
+	for i := len(chain.middlewares) - 1; i >= 0; i-- {
+		handler = chain.middlewares[i](handler)
+	}
+	return handler
+}
+
+// 同 Then, 参数是 MessageHandlerFunc.
+func (chain Chain) ThenFunc(handler func(http.ResponseWriter, *Request)) MessageHandler {
+	return chain.Then(MessageHandlerFunc(handler))
+}
+
+// 消息在中间件里统计和记录日志用的类型, 普通消息是 MsgType, 事件是 "event:" + Event.
+func messageLabel(r *Request) string {
+	if r.MixedMsg == nil {
+		return ""
+	}
+	if r.MixedMsg.MsgType == "event" {
+		return "event:" + r.MixedMsg.Event
+	}
+	return r.MixedMsg.MsgType
+}
+
+// 捕获 handler 的 panic, 回复空串(符合微信协议), 而不是让 http 连接直接断开.
+//  onPanic 可以为 nil, 一般用于记录日志.
+//  handler 的回复先缓存起来, 正常返回才写入, 所以 panic 之前写入的部分回复会被丢弃.
+func RecoverMiddleware(onPanic func(r *Request, v interface{})) Middleware {
+	return func(handler MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+			v := util.ServeRecover(w, func(w http.ResponseWriter) {
+				handler.ServeMessage(w, r)
+			})
+			if v != nil && onPanic != nil {
+				onPanic(r, v)
+			}
+		})
+	}
+}
+
+// 按消息类型记录 handler 的处理时间, observer 一般是 *util.LatencyHistogram.
+func MetricsMiddleware(observer util.LatencyObserver) Middleware {
+	if observer == nil {
+		panic("mp: nil observer")
+	}
+	return func(handler MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+			start := time.Now()
+			defer func() {
+				observer.ObserveLatency(messageLabel(r), time.Since(start))
+			}()
+			handler.ServeMessage(w, r)
+		})
+	}
+}
+
+// 每个消息处理完成后输出一条 Info 日志, 字段有 appid, openid, msgtype, latency, 不包含消息的内容.
+func LoggingMiddleware(logger util.Logger) Middleware {
+	if logger == nil {
+		panic("mp: nil logger")
+	}
+	return func(handler MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+			start := time.Now()
+			handler.ServeMessage(w, r)
+
+			var openId string
+			if r.MixedMsg != nil {
+				openId = r.MixedMsg.FromUserName
+			}
+			logger.Log(util.LogLevelInfo, "message",
+				util.LogField{Key: "appid", Value: r.WechatAppId},
+				util.LogField{Key: "openid", Value: openId},
+				util.LogField{Key: "msgtype", Value: messageLabel(r)},
+				util.LogField{Key: "latency", Value: time.Since(start)},
+			)
+		})
+	}
+}
+
+// allow 返回 false 的消息不交给 handler 处理, 直接回复空串; 可以用于黑名单, 只处理指定的用户等.
+func FilterMiddleware(allow func(r *Request) bool) Middleware {
+	if allow == nil {
+		panic("mp: nil allow")
+	}
+	return func(handler MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+			if allow(r) {
+				handler.ServeMessage(w, r)
+			}
+		})
+	}
+}
+
+// handler 超过 timeout 没有处理完成则回复空串, 避免微信服务器 5 秒超时后重试.
+//  handler 在另外一个 goroutine 里执行, 写入的回复先缓存起来, 按时完成才写入 http.ResponseWriter,
+//  超时之后的写入会被丢弃; 如果 Request.HttpRequest != nil, 它的 context 会在超时的时候取消.
+//  NOTE: 超时之后 handler 的 panic 会被忽略, 按时完成的 panic 会在当前 goroutine 里重新抛出.
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	if timeout <= 0 {
+		panic("mp: invalid timeout")
+	}
+	return func(handler MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+			ctx := context.Background()
+			if r.HttpRequest != nil {
+				ctx = r.HttpRequest.Context()
+			}
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			r2 := *r
+			if r.HttpRequest != nil {
+				r2.HttpRequest = r.HttpRequest.WithContext(ctx)
+			}
+
+			util.ServeTimeout(ctx, w, func(w http.ResponseWriter) {
+				handler.ServeMessage(w, &r2)
+			})
+		})
+	}
+}
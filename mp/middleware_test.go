@@ -0,0 +1,74 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(handler MessageHandler) MessageHandler {
+			return MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+				order = append(order, name)
+				handler.ServeMessage(w, r)
+			})
+		}
+	}
+
+	var recovered interface{}
+	histogram := util.NewLatencyHistogram(nil)
+	handler := NewChain(tag("a"), RecoverMiddleware(func(r *Request, v interface{}) { recovered = v })).
+		Append(MetricsMiddleware(histogram), tag("b")).
+		ThenFunc(func(w http.ResponseWriter, r *Request) {
+			io.WriteString(w, "<xml>") // panic 之前写入的部分回复要被丢弃
+			panic("boom")
+		})
+
+	r := &Request{MixedMsg: &MixedMessage{CommonMessageHeader: CommonMessageHeader{MsgType: "event"}, Event: "subscribe"}}
+	w := httptest.NewRecorder()
+	handler.ServeMessage(w, r)
+
+	if len(order) != 2 || order[0] != "a" || order[1] != "b" {
+		t.Errorf("order mismatch: %v", order)
+	}
+	if recovered != "boom" || w.Body.Len() != 0 {
+		t.Errorf("recovered: %v, body: %q", recovered, w.Body.String())
+	}
+	if s := histogram.Snapshot()["event:subscribe"]; s.Count != 1 {
+		t.Errorf("histogram count mismatch, have: %d, want: 1", s.Count)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	handler := TimeoutMiddleware(20 * time.Millisecond)(MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+		if r.MixedMsg.MsgType == "slow" {
+			<-release
+		}
+		io.WriteString(w, "reply")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeMessage(w, &Request{MixedMsg: &MixedMessage{CommonMessageHeader: CommonMessageHeader{MsgType: "text"}}})
+	if w.Body.String() != "reply" {
+		t.Errorf("body mismatch, have: %q, want: %q", w.Body.String(), "reply")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeMessage(w, &Request{MixedMsg: &MixedMessage{CommonMessageHeader: CommonMessageHeader{MsgType: "slow"}}})
+	close(release)
+	if w.Body.Len() != 0 {
+		t.Errorf("timed out handler should reply empty, have: %q", w.Body.String())
+	}
+}
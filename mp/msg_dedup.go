@@ -0,0 +1,240 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+const (
+	DefaultDedupTTL         = time.Minute     // 微信服务器 3 次重试一般在 15 秒之内完成
+	DefaultDedupWaitTimeout = 4 * time.Second // 要小于微信服务器的 5 秒超时
+	dedupPollInterval       = 100 * time.Millisecond
+)
+
+// 消息去重的存储, 记录处理过的消息和第一次处理的回复, 参考 DedupHandler.
+//  实现必须是并发安全的; 多个进程处理同一个回调 URL 的时候要使用多个进程共享的实现, 比如基于 redis 的实现.
+type DedupStore interface {
+	// 如果 key 在 ttl 之内没有添加过, 则添加并返回 true, 否则返回 false.
+	//  NOTE: 检查和添加必须是原子的.
+	util.NonceCache
+
+	// 保存 key 对应的消息第一次处理的回复, ttl 之后过期.
+	SaveResponse(key string, response []byte, ttl time.Duration) error
+
+	// 读取 key 对应的回复, 第一次处理还没有完成(或者已经过期)则返回 nil, false, nil.
+	LoadResponse(key string) (response []byte, ok bool, err error)
+}
+
+// 返回消息去重用的 key: 普通消息用 MsgId, 事件用 FromUserName+CreateTime.
+//  不同的公众号的 key 不会冲突.
+func MessageDedupKey(r *Request) string {
+	msg := r.MixedMsg
+	if msg == nil {
+		return ""
+	}
+	if msgId := msg.MsgId; msgId != 0 {
+		return r.WechatId + ":msg:" + strconv.FormatInt(msgId, 10)
+	}
+	return r.WechatId + ":event:" + msg.FromUserName + ":" + strconv.FormatInt(msg.CreateTime, 10) + ":" + msg.Event
+}
+
+// 消息去重的 MessageHandler 中间件, 一般包裹 MessageServeMux:
+//
+//    handler := mp.NewDedupHandler(messageServeMux, new(mp.MemoryDedupStore))
+//    handler.ReplayResponse = true
+//    wechatServer := mp.NewDefaultWechatServer("id", "token", "appid", aesKey, handler)
+//
+//  微信服务器 5 秒内收不到回复会重试 3 次, DedupHandler 保证同一个消息(事件)只交给 Handler 处理一次,
+//  重复的消息默认回复空串; 设置了 ReplayResponse 则回复第一次处理的结果.
+//  NOTE: DedupStore 出错的时候不去重, 直接交给 Handler 处理.
+type DedupHandler struct {
+	handler MessageHandler
+	store   DedupStore
+
+	// 消息记录保存的时间, 默认 DefaultDedupTTL.
+	TTL time.Duration
+
+	// 重复的消息是否回复第一次处理的结果; 第一次还在处理的时候最多等待 WaitTimeout.
+	ReplayResponse bool
+
+	// 等待第一次处理完成的最长时间, 默认 DefaultDedupWaitTimeout; 超时则回复空串.
+	WaitTimeout time.Duration
+
+	// 收到重复的消息时调用, 可以用于统计; 可以为 nil.
+	OnDuplicate func(r *Request)
+}
+
+var _ MessageHandler = new(DedupHandler)
+
+// 创建一个新的 DedupHandler, 如果 store == nil 则使用 MemoryDedupStore.
+func NewDedupHandler(handler MessageHandler, store DedupStore) *DedupHandler {
+	if handler == nil {
+		panic("mp: nil handler")
+	}
+	if store == nil {
+		store = new(MemoryDedupStore)
+	}
+	return &DedupHandler{
+		handler: handler,
+		store:   store,
+	}
+}
+
+func (h *DedupHandler) ServeMessage(w http.ResponseWriter, r *Request) {
+	key := MessageDedupKey(r)
+	if key == "" {
+		h.handler.ServeMessage(w, r)
+		return
+	}
+
+	ttl := h.TTL
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+
+	added, err := h.store.Add(key, ttl)
+	if err != nil {
+		h.handler.ServeMessage(w, r)
+		return
+	}
+	if added {
+		if !h.ReplayResponse {
+			h.handler.ServeMessage(w, r)
+			return
+		}
+		recorder := &dedupResponseWriter{ResponseWriter: w}
+		h.handler.ServeMessage(recorder, r)
+		h.store.SaveResponse(key, recorder.body.Bytes(), ttl)
+		return
+	}
+
+	// 重复的消息
+	if h.OnDuplicate != nil {
+		h.OnDuplicate(r)
+	}
+	if !h.ReplayResponse {
+		return
+	}
+
+	waitTimeout := h.WaitTimeout
+	if waitTimeout <= 0 {
+		waitTimeout = DefaultDedupWaitTimeout
+	}
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		response, ok, err := h.store.LoadResponse(key)
+		if err != nil {
+			return
+		}
+		if ok {
+			w.Write(response)
+			return
+		}
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(dedupPollInterval)
+	}
+}
+
+// 记录写入的 body, 同时写入到原来的 http.ResponseWriter.
+//  实现了 http.Flusher, 这样 Handler 里面的 w.(http.Flusher) 不会因为包装而失效.
+type dedupResponseWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *dedupResponseWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// 原来的 ResponseWriter 不是 http.Flusher 则什么都不做.
+func (w *dedupResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+var _ DedupStore = new(MemoryDedupStore)
+
+// 进程内存里的 DedupStore, 零值可以直接使用.
+type MemoryDedupStore struct {
+	mutex     sync.Mutex
+	entries   map[string]*memoryDedupEntry
+	lastSweep time.Time
+}
+
+type memoryDedupEntry struct {
+	expiresAt time.Time
+	done      bool // 是否已经保存了回复
+	response  []byte
+}
+
+// 每分钟最多清理一次过期的记录.
+//  NOTE: 调用者要先锁定 store.mutex
+func (store *MemoryDedupStore) sweepLocked(now time.Time) {
+	if now.Sub(store.lastSweep) < time.Minute {
+		return
+	}
+	store.lastSweep = now
+	for key, entry := range store.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(store.entries, key)
+		}
+	}
+}
+
+func (store *MemoryDedupStore) Add(key string, ttl time.Duration) (added bool, err error) {
+	now := time.Now()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.entries == nil {
+		store.entries = make(map[string]*memoryDedupEntry)
+	}
+	store.sweepLocked(now)
+
+	if entry := store.entries[key]; entry != nil && now.Before(entry.expiresAt) {
+		return false, nil
+	}
+	store.entries[key] = &memoryDedupEntry{expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (store *MemoryDedupStore) SaveResponse(key string, response []byte, ttl time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.entries == nil {
+		store.entries = make(map[string]*memoryDedupEntry)
+	}
+	store.entries[key] = &memoryDedupEntry{
+		expiresAt: time.Now().Add(ttl),
+		done:      true,
+		response:  append([]byte(nil), response...),
+	}
+	return nil
+}
+
+func (store *MemoryDedupStore) LoadResponse(key string) (response []byte, ok bool, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entry := store.entries[key]
+	if entry == nil || !entry.done || !time.Now().Before(entry.expiresAt) {
+		return nil, false, nil
+	}
+	return entry.response, true, nil
+}
@@ -0,0 +1,82 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupHandler(t *testing.T) {
+	var served int32
+	handler := NewDedupHandler(MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+		atomic.AddInt32(&served, 1)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "reply:"+r.MixedMsg.Content)
+	}), nil)
+	handler.ReplayResponse = true
+
+	newRequest := func(msgId int64, content string) *Request {
+		msg := &MixedMessage{MsgId: msgId, Content: content}
+		msg.FromUserName = "user"
+		return &Request{WechatId: "gh_test", MixedMsg: msg}
+	}
+
+	// 第一次还在处理的时候收到了重试
+	recorders := make([]*httptest.ResponseRecorder, 3)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w http.ResponseWriter) {
+			defer wg.Done()
+			handler.ServeMessage(w, newRequest(1, "a"))
+		}(recorders[i])
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&served); n != 1 {
+		t.Errorf("served mismatch, have: %d, want: 1", n)
+	}
+	for i, recorder := range recorders {
+		if body := recorder.Body.String(); body != "reply:a" {
+			t.Errorf("response %d mismatch, have: %q, want: %q", i, body, "reply:a")
+		}
+	}
+
+	// 不同的消息正常处理
+	recorder := httptest.NewRecorder()
+	handler.ServeMessage(recorder, newRequest(2, "b"))
+	if n := atomic.LoadInt32(&served); n != 2 || recorder.Body.String() != "reply:b" {
+		t.Errorf("served: %d, response: %q", n, recorder.Body.String())
+	}
+}
+
+func TestDedupHandlerFlush(t *testing.T) {
+	handler := NewDedupHandler(MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {
+		io.WriteString(w, "reply")
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the ResponseWriter is not a http.Flusher")
+		}
+		flusher.Flush()
+	}), nil)
+	handler.ReplayResponse = true
+
+	msg := &MixedMessage{MsgId: 1}
+	msg.FromUserName = "user"
+	recorder := httptest.NewRecorder()
+	handler.ServeMessage(recorder, &Request{WechatId: "gh_test", MixedMsg: msg})
+	if !recorder.Flushed || recorder.Body.String() != "reply" {
+		t.Errorf("flushed: %t, response: %q", recorder.Flushed, recorder.Body.String())
+	}
+}
@@ -6,9 +6,10 @@
 package mp
 
 import (
-	//"fmt"
 	"io"
 	"net/http"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 微信服务器推送过来的消息(事件)处理接口
@@ -19,7 +20,6 @@ type MessageHandler interface {
 type MessageHandlerFunc func(http.ResponseWriter, *Request)
 
 func (fn MessageHandlerFunc) ServeMessage(w http.ResponseWriter, r *Request) {
-	//fmt.Println("MessageHandler ServeMessage...")
 	fn(w, r)
 }
 
@@ -62,6 +62,8 @@ type Request struct {
 	WechatId    string // 公众号的原始 id, 等于 MixedMessage.ToUserName
 	WechatToken string
 	WechatAppId string
+
+	logger util.Logger // 输出 ReplyHandlerFunc 的错误, ServeHTTP 设置为 WechatServer 的 Logger
 }
 
 // 微信服务器推送过来的消息(事件)通用的消息头
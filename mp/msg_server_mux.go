@@ -6,7 +6,6 @@
 package mp
 
 import (
-	"fmt"
 	"net/http"
 	"sync"
 )
@@ -19,8 +18,16 @@ type (
 var _ MessageHandler = new(MessageServeMux)
 
 // MessageServeMux 实现了一个简单的消息路由器, 同时也是一个 MessageHandler.
+//  除了按 MsgType, Event 路由, 还可以通过 Route 按 EventKey, 二维码场景值, 文本内容等路由, 参考 Route.
+//
+//  NOTE: 业务代码请使用 github.com/philsong/wechat2/mp/message/dispatch 包的 Mux 按类型注册处理函数,
+//  处理函数直接拿到解析后的消息(事件)结构, 返回值就是被动回复的消息. MessageServeMux 是 dispatch.Mux 的底层路由,
+//  MessageHandle, EventHandle, Route, DefaultMessageHandle, DefaultEventHandle 用来注册 MessageHandler 中间件
+//  或者 dispatch.Mux 没有覆盖的消息(事件); 按 MixedMessage 处理的 MessageHandleFunc, EventHandleFunc 已经废弃.
+//  (On* 方法不能放在 MessageServeMux 上, mp 包不能引用 mp/message/request, mp/menu 等包.)
 type MessageServeMux struct {
 	rwmutex               sync.RWMutex
+	routes                []route // 按 priority 从大到小排序, 只替换不修改
 	messageHandlers       map[MessageType]MessageHandler
 	eventHandlers         map[EventType]MessageHandler
 	defaultMessageHandler MessageHandler
@@ -50,6 +57,8 @@ func (mux *MessageServeMux) MessageHandle(msgType MessageType, handler MessageHa
 }
 
 // 注册 MessageHandlerFunc, 处理特定类型的消息.
+//
+// Deprecated: 使用 dispatch.Mux 的 OnText, OnImage 等方法按类型注册处理函数.
 func (mux *MessageServeMux) MessageHandleFunc(msgType MessageType, handler func(http.ResponseWriter, *Request)) {
 	mux.MessageHandle(msgType, MessageHandlerFunc(handler))
 }
@@ -87,6 +96,8 @@ func (mux *MessageServeMux) EventHandle(eventType EventType, handler MessageHand
 }
 
 // 注册 MessageHandlerFunc, 处理特定类型的事件.
+//
+// Deprecated: 使用 dispatch.Mux 的 OnSubscribe, OnClick 等方法按类型注册处理函数.
 func (mux *MessageServeMux) EventHandleFunc(eventType EventType, handler func(http.ResponseWriter, *Request)) {
 	mux.EventHandle(eventType, MessageHandlerFunc(handler))
 }
@@ -118,7 +129,6 @@ func (mux *MessageServeMux) messageHandler(msgType MessageType) (handler Message
 	defer mux.rwmutex.RUnlock()
 
 	handler = mux.messageHandlers[msgType]
-	//fmt.Println("messageHandler...", msgType, handler)
 	if handler != nil {
 		return
 	}
@@ -135,7 +145,6 @@ func (mux *MessageServeMux) eventHandler(eventType EventType) (handler MessageHa
 	defer mux.rwmutex.RUnlock()
 
 	handler = mux.eventHandlers[eventType]
-	//fmt.Println("eventHandler...", eventType, handler)
 	if handler != nil {
 		return
 	}
@@ -144,18 +153,19 @@ func (mux *MessageServeMux) eventHandler(eventType EventType) (handler MessageHa
 
 // MessageServeMux 实现了 MessageHandler 接口.
 func (mux *MessageServeMux) ServeMessage(w http.ResponseWriter, r *Request) {
-	fmt.Println("MessageServeMux.ServeMessage:", r.MixedMsg)
+	if handler := mux.routeHandler(r); handler != nil {
+		handler.ServeMessage(w, r)
+		return
+	}
 	if MsgType := r.MixedMsg.MsgType; MsgType == "event" {
 		handler := mux.eventHandler(EventType(r.MixedMsg.Event))
 		if handler == nil {
-			//fmt.Println("eventHandler nil...", r.MixedMsg, MsgType)
 			return // 返回空串, 符合微信协议
 		}
 		handler.ServeMessage(w, r)
 	} else {
 		handler := mux.messageHandler(MessageType(MsgType))
 		if handler == nil {
-			//fmt.Println("messageHandler nil...", r.MixedMsg, MsgType)
 			return // 返回空串, 符合微信协议
 		}
 		handler.ServeMessage(w, r)
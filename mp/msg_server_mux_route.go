@@ -0,0 +1,145 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 路由的匹配条件, 参考 MessageServeMux.Route.
+type Matcher func(r *Request) bool
+
+// MessageServeMux 的一条路由.
+type route struct {
+	priority int
+	matcher  Matcher
+	handler  MessageHandler
+}
+
+// 注册一条路由, matcher 匹配的消息(事件)交给 handler 处理.
+//  路由的优先级:
+//  1. Route 注册的路由, priority 大的优先, priority 相同的先注册的优先, 第一个匹配的路由处理消息;
+//  2. MessageHandle, EventHandle 注册的按 MsgType, Event 的路由;
+//  3. DefaultMessageHandle, DefaultEventHandle 注册的默认路由.
+func (mux *MessageServeMux) Route(priority int, matcher Matcher, handler MessageHandler) {
+	if matcher == nil {
+		panic("mp: nil matcher")
+	}
+	if handler == nil {
+		panic("mp: nil handler")
+	}
+
+	mux.rwmutex.Lock()
+	defer mux.rwmutex.Unlock()
+
+	// 复制一份, 正在 ServeMessage 的 goroutine 持有的是旧的 slice
+	routes := make([]route, len(mux.routes), len(mux.routes)+1)
+	copy(routes, mux.routes)
+	routes = append(routes, route{priority: priority, matcher: matcher, handler: handler})
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].priority > routes[j].priority })
+	mux.routes = routes
+}
+
+// 注册一条路由, 参考 Route.
+func (mux *MessageServeMux) RouteFunc(priority int, matcher Matcher, handler func(http.ResponseWriter, *Request)) {
+	mux.Route(priority, matcher, MessageHandlerFunc(handler))
+}
+
+// 查找第一个匹配 r 的路由的 MessageHandler, 没有找到则返回 nil.
+func (mux *MessageServeMux) routeHandler(r *Request) MessageHandler {
+	mux.rwmutex.RLock()
+	routes := mux.routes
+	mux.rwmutex.RUnlock()
+
+	for _, route := range routes {
+		if route.matcher(r) {
+			return route.handler
+		}
+	}
+	return nil
+}
+
+// 匹配事件类型为 eventType 并且 EventKey 等于 key 的事件, eventType 为空则匹配所有类型的事件.
+//  比如 MatchEventKey("CLICK", "V1001_TODAY_MUSIC") 匹配一个菜单的点击事件.
+func MatchEventKey(eventType EventType, key string) Matcher {
+	return func(r *Request) bool {
+		return isEvent(r, eventType) && r.MixedMsg.EventKey == key
+	}
+}
+
+// 匹配事件类型为 eventType 并且 EventKey 以 prefix 开头的事件, eventType 为空则匹配所有类型的事件.
+func MatchEventKeyPrefix(eventType EventType, prefix string) Matcher {
+	return func(r *Request) bool {
+		return isEvent(r, eventType) && strings.HasPrefix(r.MixedMsg.EventKey, prefix)
+	}
+}
+
+// 匹配扫描场景值为 scene 的带参数二维码的事件:
+//  未关注用户扫码关注的 subscribe 事件(EventKey 为 "qrscene_" + scene)和已关注用户扫码的 SCAN 事件(EventKey 为 scene).
+func MatchQRScene(scene string) Matcher {
+	return func(r *Request) bool {
+		switch {
+		case isEvent(r, "subscribe"):
+			return r.MixedMsg.EventKey == "qrscene_"+scene
+		case isEvent(r, "SCAN"):
+			return r.MixedMsg.EventKey == scene
+		default:
+			return false
+		}
+	}
+}
+
+// 匹配 Content 满足 re 的文本消息.
+func MatchContent(re *regexp.Regexp) Matcher {
+	if re == nil {
+		panic("mp: nil regexp")
+	}
+	return func(r *Request) bool {
+		return isTextMessage(r) && re.MatchString(r.MixedMsg.Content)
+	}
+}
+
+// 匹配去掉首尾空白之后 Content 等于 keywords 中任意一个的文本消息.
+func MatchKeyword(keywords ...string) Matcher {
+	return func(r *Request) bool {
+		if !isTextMessage(r) {
+			return false
+		}
+		content := strings.TrimSpace(r.MixedMsg.Content)
+		for _, keyword := range keywords {
+			if content == keyword {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// 匹配同时满足所有 matchers 的消息(事件).
+func MatchAll(matchers ...Matcher) Matcher {
+	return func(r *Request) bool {
+		for _, matcher := range matchers {
+			if !matcher(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func isEvent(r *Request, eventType EventType) bool {
+	if r.MixedMsg == nil || r.MixedMsg.MsgType != "event" {
+		return false
+	}
+	return eventType == "" || EventType(r.MixedMsg.Event) == eventType
+}
+
+func isTextMessage(r *Request) bool {
+	return r.MixedMsg != nil && r.MixedMsg.MsgType == "text"
+}
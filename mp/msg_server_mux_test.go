@@ -0,0 +1,59 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestMessageServeMuxRoute(t *testing.T) {
+	reply := func(s string) MessageHandler {
+		return MessageHandlerFunc(func(w http.ResponseWriter, r *Request) { io.WriteString(w, s) })
+	}
+
+	mux := NewMessageServeMux()
+	mux.EventHandle("CLICK", reply("click"))
+	mux.DefaultMessageHandle(reply("default"))
+	mux.Route(0, MatchEventKeyPrefix("CLICK", "MENU_"), reply("menu"))
+	mux.Route(0, MatchEventKey("CLICK", "MENU_HELP"), reply("help")) // 优先级相同, 先注册的优先
+	mux.Route(1, MatchEventKey("CLICK", "MENU_ABOUT"), reply("about"))
+	mux.Route(0, MatchQRScene("123"), reply("scene"))
+	mux.Route(0, MatchKeyword("hi", "hello"), reply("keyword"))
+	mux.Route(0, MatchContent(regexp.MustCompile(`^\d+$`)), reply("number"))
+
+	event := func(event, key string) *MixedMessage {
+		return &MixedMessage{CommonMessageHeader: CommonMessageHeader{MsgType: "event"}, Event: event, EventKey: key}
+	}
+	text := func(content string) *MixedMessage {
+		return &MixedMessage{CommonMessageHeader: CommonMessageHeader{MsgType: "text"}, Content: content}
+	}
+
+	tests := []struct {
+		msg  *MixedMessage
+		want string
+	}{
+		{event("CLICK", "OTHER"), "click"},
+		{event("CLICK", "MENU_HELP"), "menu"},
+		{event("CLICK", "MENU_ABOUT"), "about"},
+		{event("subscribe", "qrscene_123"), "scene"},
+		{event("SCAN", "123"), "scene"},
+		{event("SCAN", "qrscene_123"), ""},
+		{text(" hello "), "keyword"},
+		{text("42"), "number"},
+		{text("hello world"), "default"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeMessage(w, &Request{MixedMsg: test.msg})
+		if have := w.Body.String(); have != test.want {
+			t.Errorf("route mismatch for %+v, have: %q, want: %q", test.msg, have, test.want)
+		}
+	}
+}
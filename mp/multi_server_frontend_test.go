@@ -0,0 +1,92 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+func TestMultiWechatServerFrontendResolver(t *testing.T) {
+	var served, resolved int32
+	srv := NewDefaultWechatServer("gh_test", "token", "appid", make([]byte, 32),
+		MessageHandlerFunc(func(w http.ResponseWriter, r *Request) { atomic.AddInt32(&served, 1) }))
+
+	var frontend MultiWechatServerFrontend
+	frontend.SetServerKeyExtractor(util.PathServerKey("/wx/"))
+	frontend.SetWriteStatusCode(true)
+	frontend.SetWechatServerResolver(WechatServerResolverFunc(func(serverKey string) (WechatServer, error) {
+		atomic.AddInt32(&resolved, 1)
+		time.Sleep(10 * time.Millisecond)
+		switch serverKey {
+		case "appid":
+			return srv, nil
+		case "broken":
+			return nil, errors.New("config center is unavailable")
+		}
+		return nil, nil
+	}))
+
+	newRequest := func(serverKey string) *http.Request {
+		r := newRawMessageRequest("token", time.Now().Unix(), "nonce")
+		r.URL.Path = "/wx/" + serverKey
+		return r
+	}
+
+	// 并发的请求只加载一次, 之后使用缓存
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			frontend.ServeHTTP(httptest.NewRecorder(), newRequest("appid"))
+		}()
+	}
+	wg.Wait()
+	frontend.ServeHTTP(httptest.NewRecorder(), newRequest("appid"))
+	if served != 9 || resolved != 1 {
+		t.Errorf("served: %d, resolved: %d", served, resolved)
+	}
+
+	// 不存在的 key 返回 404, 并且缓存一段时间
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		frontend.ServeHTTP(w, newRequest("unknown"))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("unknown serverKey, have status %d", w.Code)
+		}
+	}
+	if resolved != 2 {
+		t.Errorf("resolved: %d, want: 2", resolved)
+	}
+
+	// 加载出错返回 503, 不缓存
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		frontend.ServeHTTP(w, newRequest("broken"))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("broken resolver, have status %d", w.Code)
+		}
+	}
+	if resolved != 4 {
+		t.Errorf("resolved: %d, want: 4", resolved)
+	}
+
+	// 不缓存不存在的 key
+	frontend.SetNotFoundCacheTTL(-1)
+	frontend.ServeHTTP(httptest.NewRecorder(), newRequest("unknown"))
+	frontend.ServeHTTP(httptest.NewRecorder(), newRequest("unknown"))
+	if resolved != 6 {
+		t.Errorf("resolved: %d, want: 6", resolved)
+	}
+}
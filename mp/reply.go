@@ -0,0 +1,103 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+// 回复消息给微信服务器, 根据 r.EncryptType 自动选择明文模式或者安全模式(兼容模式).
+//  和 WriteRawResponse, WriteAESResponse 不同:
+//  1. 回复之前校验 msg: msg 实现了 CheckValid() error 则调用它; MsgType 不能为空;
+//     如果 r.MixedMsg != nil, 则 ToUserName, FromUserName 必须和收到的消息相反;
+//  2. 安全模式使用新的 timestamp, nonce 和 random 加密和签名;
+//  3. 先在内存里编码好回复, 出错的时候不会写入任何内容.
+func Reply(w http.ResponseWriter, r *Request, msg interface{}) (err error) {
+	if w == nil {
+		return errors.New("nil http.ResponseWriter")
+	}
+	if r == nil {
+		return errors.New("nil Request")
+	}
+
+	MsgRawXML, err := marshalReply(msg, r.MixedMsg)
+	if err != nil {
+		return
+	}
+
+	if r.EncryptType != "aes" {
+		_, err = w.Write(MsgRawXML)
+		return
+	}
+
+	responseHttpBody := newResponseHttpBody(MsgRawXML, util.NewAESRandom(), r.WechatAppId, r.AESKey,
+		r.WechatToken, time.Now().Unix(), util.NewNonce())
+
+	var buf bytes.Buffer
+	if err = xml.NewEncoder(&buf).Encode(responseHttpBody); err != nil {
+		return
+	}
+	_, err = w.Write(buf.Bytes())
+	return
+}
+
+// 校验并编码被动回复的消息, received 是收到的消息, 可以为 nil.
+func marshalReply(msg interface{}, received *MixedMessage) (MsgRawXML []byte, err error) {
+	if msg == nil {
+		return nil, errors.New("nil message")
+	}
+	if checker, ok := msg.(interface {
+		CheckValid() error
+	}); ok {
+		if err = checker.CheckValid(); err != nil {
+			return
+		}
+	}
+
+	if MsgRawXML, err = xml.Marshal(msg); err != nil {
+		return
+	}
+
+	var header CommonMessageHeader
+	if err = xml.Unmarshal(MsgRawXML, &header); err != nil {
+		return
+	}
+	if header.MsgType == "" {
+		return nil, errors.New("the reply's MsgType is empty")
+	}
+	if received != nil {
+		if header.ToUserName != received.FromUserName {
+			return nil, fmt.Errorf("the reply's ToUserName mismatch, have: %s, want: %s", header.ToUserName, received.FromUserName)
+		}
+		if header.FromUserName != received.ToUserName {
+			return nil, fmt.Errorf("the reply's FromUserName mismatch, have: %s, want: %s", header.FromUserName, received.ToUserName)
+		}
+	}
+	return
+}
+
+var _ MessageHandler = ReplyHandlerFunc(nil)
+
+// 返回被动回复的消息的处理函数, 实现了 MessageHandler, 返回的消息通过 Reply 写入.
+//  返回 nil 表示回复空串; Reply 出错的时候也是回复空串, 错误通过 ServeHTTP 的 Logger 输出.
+type ReplyHandlerFunc func(r *Request) (msg interface{})
+
+func (fn ReplyHandlerFunc) ServeMessage(w http.ResponseWriter, r *Request) {
+	msg := fn(r)
+	if msg == nil {
+		return
+	}
+	if err := Reply(w, r, msg); err != nil && r.logger != nil {
+		r.logger.Log(util.LogLevelError, "reply failed", util.LogField{Key: "error", Value: err})
+	}
+}
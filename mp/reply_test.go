@@ -0,0 +1,106 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"log"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+type testReplyText struct {
+	XMLName struct{} `xml:"xml"`
+	CommonMessageHeader
+	Content string `xml:"Content"`
+}
+
+func TestReply(t *testing.T) {
+	received := &MixedMessage{CommonMessageHeader: CommonMessageHeader{ToUserName: "gh_id", FromUserName: "openid", MsgType: "text"}}
+	msg := &testReplyText{
+		CommonMessageHeader: CommonMessageHeader{ToUserName: "openid", FromUserName: "gh_id", MsgType: "text"},
+		Content:             "hello",
+	}
+
+	// 明文模式
+	w := httptest.NewRecorder()
+	if err := Reply(w, &Request{MixedMsg: received}, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.Body.String(), "<Content>hello</Content>") {
+		t.Errorf("unexpected raw reply: %s", w.Body.String())
+	}
+
+	// 安全模式, 每次回复的 nonce 都不一样
+	var aesKey [32]byte
+	r := &Request{EncryptType: "aes", MixedMsg: received, WechatAppId: "appid", WechatToken: "token", AESKey: aesKey, Nonce: "nonce"}
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		if err := Reply(w, r, msg); err != nil {
+			t.Fatal(err)
+		}
+		var body ResponseHttpBody
+		if err := xml.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Nonce == "" || body.Nonce == r.Nonce {
+			t.Errorf("reply nonce not fresh: %q", body.Nonce)
+		}
+		if want := util.MsgSign("token", strconv.FormatInt(body.TimeStamp, 10), body.Nonce, body.EncryptedMsg); body.MsgSignature != want {
+			t.Errorf("reply signature mismatch, have: %s, want: %s", body.MsgSignature, want)
+		}
+		encryptedMsg, err := base64.StdEncoding.DecodeString(body.EncryptedMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, rawXML, err := util.AESDecryptMsg(encryptedMsg, "appid", aesKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(rawXML), "<Content>hello</Content>") {
+			t.Errorf("unexpected decrypted reply: %s", rawXML)
+		}
+		nonces = append(nonces, body.Nonce)
+	}
+	if nonces[0] == nonces[1] {
+		t.Errorf("reply nonce reused: %s", nonces[0])
+	}
+
+	// 校验失败的时候不写入任何内容
+	msg.ToUserName = "other"
+	w = httptest.NewRecorder()
+	if err := Reply(w, &Request{MixedMsg: received}, msg); err == nil {
+		t.Error("want error for mismatched ToUserName")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("want empty body, have: %s", w.Body.String())
+	}
+}
+
+func TestReplyHandlerFuncLogError(t *testing.T) {
+	var buf bytes.Buffer
+	srv := NewDefaultWechatServer("gh_test", "token", "appid", make([]byte, 32), ReplyHandlerFunc(func(r *Request) interface{} {
+		return &testReplyText{CommonMessageHeader: CommonMessageHeader{ToUserName: "other", FromUserName: "gh_test", MsgType: "text"}}
+	}))
+	srv.SetLogger(&util.StdLogger{Logger: log.New(&buf, "", 0), Level: util.LogLevelError})
+
+	w := httptest.NewRecorder()
+	NewWechatServerFrontend(srv, nil).ServeHTTP(w, newRawMessageRequest("token", time.Now().Unix(), "nonce"))
+	if w.Body.Len() != 0 {
+		t.Errorf("want empty body, have: %s", w.Body.String())
+	}
+	if !strings.HasPrefix(buf.String(), "ERROR reply failed error=") {
+		t.Errorf("the reply error is not logged: %q", buf.String())
+	}
+}
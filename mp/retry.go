@@ -0,0 +1,227 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 请求失败后的重试策略.
+//  NOTE:
+//  1. access_token 失效(40001, 42001)的重试由 WechatClient 单独处理, 不经过 RetryPolicy;
+//  2. 对于非幂等的 API(参考 AddNonIdempotentAPIs), 只有确定请求没有被微信服务器执行的时候
+//     (连接不上服务器, 或者返回了 access_token 无效, 调用次数超过限制等错误码) WechatClient 才会询问 RetryPolicy,
+//     其他情况(比如读取回复超时, 系统繁忙 -1)一律不重试, 以免重复群发消息等.
+type RetryPolicy interface {
+	// 第 attempt 次请求(从 1 开始计数)返回错误 err 后是否重试, 如果重试则返回重试前等待的时间.
+	//  err 是 *Error 或者 *TransportError.
+	Retry(attempt int, err error) (wait time.Duration, retry bool)
+}
+
+// 指数退避的重试策略.
+//  第 n 次重试前等待 BaseDelay * 2^(n-1), 不超过 MaxDelay, 然后加上 ±Jitter 比例的随机抖动.
+type BackoffRetryPolicy struct {
+	MaxAttempts int           // 最多请求的次数(包括第一次), <= 1 表示不重试
+	BaseDelay   time.Duration // 第一次重试前等待的时间
+	MaxDelay    time.Duration // 等待时间的上限, <= 0 表示没有上限
+	Jitter      float64       // 随机抖动的比例, 取值 [0, 1]
+
+	// 按错误码指定是否重试, 优先于默认的规则;
+	// 没有在这里指定的错误按 IsRetryable 判断.
+	ErrCodeRules map[int]bool
+}
+
+// 默认的重试策略, 系统繁忙, 5xx, 网络错误等最多请求 3 次.
+//  WechatClient.RetryPolicy 默认为 nil, 即不重试, 需要的话可以设置为 DefaultRetryPolicy.
+var DefaultRetryPolicy RetryPolicy = &BackoffRetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Jitter:      0.2,
+}
+
+func (policy *BackoffRetryPolicy) Retry(attempt int, err error) (wait time.Duration, retry bool) {
+	if attempt >= policy.MaxAttempts {
+		return
+	}
+
+	retry = IsRetryable(err)
+	var wxErr *Error
+	if errors.As(err, &wxErr) {
+		if rule, ok := policy.ErrCodeRules[wxErr.ErrCode]; ok {
+			retry = rule
+		}
+	}
+	if !retry {
+		return
+	}
+	return policy.backoff(attempt), true
+}
+
+// 第 attempt 次请求失败后等待的时间.
+func (policy *BackoffRetryPolicy) backoff(attempt int) time.Duration {
+	wait := policy.BaseDelay
+	for i := 1; i < attempt; i++ {
+		if policy.MaxDelay > 0 && wait >= policy.MaxDelay {
+			break
+		}
+		if wait > 1<<62 {
+			break // 防止溢出
+		}
+		wait <<= 1
+	}
+	if policy.MaxDelay > 0 && wait > policy.MaxDelay {
+		wait = policy.MaxDelay
+	}
+
+	if policy.Jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(wait))
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// 非幂等的 API, key 是 URL 的 path, 由 nonIdempotentAPIsRWMutex 保护.
+//  重复调用这些 API 会产生重复的效果(比如重复群发消息, 重复上传素材, 重复创建二维码),
+//  WechatClient 不会盲目重试; 其他的 API 可以通过 AddNonIdempotentAPIs 添加.
+var (
+	nonIdempotentAPIsRWMutex sync.RWMutex
+	nonIdempotentAPIs        = map[string]bool{
+		"/cgi-bin/message/mass/sendall":         true,
+		"/cgi-bin/message/mass/send":            true,
+		"/cgi-bin/message/mass/preview":         true,
+		"/cgi-bin/message/custom/send":          true,
+		"/cgi-bin/message/template/send":        true,
+		"/cgi-bin/template/api_add_template":    true,
+		"/cgi-bin/groups/create":                true,
+		"/cgi-bin/tags/create":                  true,
+		"/cgi-bin/menu/addconditional":          true,
+		"/cgi-bin/qrcode/create":                true,
+		"/cgi-bin/shorturl":                     true,
+		"/cgi-bin/media/upload":                 true,
+		"/cgi-bin/media/uploadimg":              true,
+		"/cgi-bin/media/uploadnews":             true,
+		"/cgi-bin/media/uploadvideo":            true,
+		"/cgi-bin/material/add_news":            true,
+		"/cgi-bin/material/add_material":        true,
+		"/customservice/kfaccount/add":          true,
+		"/customservice/kfsession/create":       true,
+		"/card/create":                          true,
+		"/card/qrcode/create":                   true,
+		"/merchant/create":                      true,
+		"/merchant/group/add":                   true,
+		"/merchant/shelf/add":                   true,
+		"/merchant/express/add":                 true,
+		"/cgi-bin/poi/addpoi":                   true,
+		"/shakearound/device/applyid":           true,
+		"/shakearound/page/add":                 true,
+		"/shakearound/material/add":             true,
+		"/bizwifi/shop/add":                     true,
+		"/cgi-bin/message/wxopen/template/send": true,
+		"/cgi-bin/message/subscribe/bizsend":    true,
+		"/cgi-bin/message/template/subscribe":   true,
+	}
+)
+
+// 添加非幂等的 API, path 是 URL 的 path, 比如 "/cgi-bin/message/mass/sendall".
+//  并发安全, 一般在程序初始化的时候调用.
+func AddNonIdempotentAPIs(paths ...string) {
+	nonIdempotentAPIsRWMutex.Lock()
+	for _, path := range paths {
+		nonIdempotentAPIs[path] = true
+	}
+	nonIdempotentAPIsRWMutex.Unlock()
+}
+
+// 判断 path 对应的 API 是否是非幂等的.
+func isNonIdempotentAPI(path string) bool {
+	nonIdempotentAPIsRWMutex.RLock()
+	nonIdempotent := nonIdempotentAPIs[path]
+	nonIdempotentAPIsRWMutex.RUnlock()
+	return nonIdempotent
+}
+
+// 判断 rawURL 对应的 API 是否是幂等的, 参考 AddNonIdempotentAPIs.
+func IsIdempotentAPI(rawURL string) bool {
+	return !isNonIdempotentAPI(apiPath(rawURL))
+}
+
+// 返回 rawURL 的 path 部分, 比如
+//  apiPath("https://api.weixin.qq.com/cgi-bin/menu/get?access_token=") == "/cgi-bin/menu/get"
+func apiPath(rawURL string) string {
+	if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+		rawURL = rawURL[:i]
+	}
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		rawURL = rawURL[i+len("://"):]
+		if i = strings.IndexByte(rawURL, '/'); i >= 0 {
+			return rawURL[i:]
+		}
+		return "/"
+	}
+	return rawURL
+}
+
+// 确定请求没有被微信服务器执行的错误码: access_token 无效, 调用次数超过限制.
+//  其他的错误码(比如系统繁忙 -1)微信服务器可能已经执行了请求, 非幂等的 API 不能重试.
+var notExecutedErrCodes = map[int]bool{
+	ErrCodeInvalidCredential:  true,
+	ErrCodeTimeout:            true,
+	ErrCodeInvalidAccessToken: true,
+	ErrCodeAccessTokenMissing: true,
+	ErrCodeAPIQuotaExceeded:   true,
+	ErrCodeAPIFreqOutOfLimit:  true,
+}
+
+// 判断返回 err 的请求是否确定没有被微信服务器执行.
+//  微信服务器返回了 notExecutedErrCodes 里的错误码, 或者根本没有连接上服务器.
+func requestNotProcessed(err error) bool {
+	var wxErr *Error
+	if errors.As(err, &wxErr) {
+		return notExecutedErrCodes[wxErr.ErrCode]
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+	return false
+}
+
+// 根据 clt.RetryPolicy 判断是否需要重试, 需要的话等待相应的时间.
+//  ctx 取消或者超时则不再重试.
+func (clt *WechatClient) shouldRetry(ctx context.Context, idempotent bool, attempt int, err error) bool {
+	if clt.RetryPolicy == nil {
+		return false
+	}
+	if !idempotent && !requestNotProcessed(err) {
+		return false
+	}
+	wait, retry := clt.RetryPolicy.Retry(attempt, err)
+	if !retry {
+		return false
+	}
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -9,14 +9,13 @@ import (
 	"bytes"
 	"crypto/subtle"
 	"encoding/base64"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/philsong/wechat2/util"
 )
@@ -35,13 +34,15 @@ type RequestHttpBody struct {
 func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 	wechatServer WechatServer, invalidRequestHandler InvalidRequestHandler) {
 
-	fmt.Println("ServeHTTP...", r.Method, urlValues)
+	start := time.Now()
+	logger := serverLogger(wechatServer)
+	invalidRequestHandler = util.WithInvalidRequestLogger(invalidRequestHandler, logger,
+		util.LogField{Key: "appid", Value: wechatServer.AppId()})
 
 	switch r.Method {
 	case "POST": // 消息处理
 		signature1, timestampStr, nonce, encryptType, msgSignature1, err := parsePostURLQuery(urlValues)
 		if err != nil {
-			fmt.Println("ServeHTTP err...", err)
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
@@ -49,41 +50,57 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 		timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
 		if err != nil {
 			err = errors.New("can not parse timestamp to int64: " + timestampStr)
-			fmt.Println("err ''...", err)
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
 
+		policy := serverSignaturePolicy(wechatServer)
+
 		switch encryptType {
 		case "aes": // 兼容模式, 安全模式
-			//if len(signature1) != 40 {
-			//	err = fmt.Errorf("the length of signature mismatch, have: %d, want: 40", len(signature1))
-			//	invalidRequestHandler.ServeInvalidRequest(w, r, err)
-			//	return
-			//}
-
-			//WechatToken := wechatServer.Token()
-			//signature2 := util.Sign(WechatToken, timestampStr, nonce)
-			//if subtle.ConstantTimeCompare([]byte(signature1), []byte(signature2)) != 1 {
-			//	err = fmt.Errorf("check signature failed, input: %s, local: %s", signature1, signature2)
-			//	invalidRequestHandler.ServeInvalidRequest(w, r, err)
-			//	return
-			//}
-			// 首先验证密文签名长度
+			// 根据策略验证 URL 上的 signature
+			if policy.checkSignature() {
+				if len(signature1) != 40 {
+					err = &util.SignatureError{Name: "signature", Input: signature1}
+					invalidRequestHandler.ServeInvalidRequest(w, r, err)
+					return
+				}
+
+				signature2 := util.Sign(wechatServer.Token(), timestampStr, nonce)
+				if subtle.ConstantTimeCompare([]byte(signature1), []byte(signature2)) != 1 {
+					err = &util.SignatureError{Name: "signature", Input: signature1, Local: signature2}
+					invalidRequestHandler.ServeInvalidRequest(w, r, err)
+					return
+				}
+			}
+
+			// 验证密文签名长度
 			if len(msgSignature1) != 40 {
-				err = fmt.Errorf("the length of msg_signature mismatch, have: %d, want: 40", len(msgSignature1))
+				err = &util.SignatureError{Name: "msg_signature", Input: msgSignature1}
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
 
-			var requestHttpBody RequestHttpBody
-			if err := xml.NewDecoder(r.Body).Decode(&requestHttpBody); err != nil {
+			// 先只读取验证需要的 ToUserName 和 Encrypt, 验证签名之后再解析整个 http body
+			body, err := util.ReadRequestBody(r, serverMaxBodySize(wechatServer))
+			if err != nil {
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+			fields, err := util.ScanXMLFields(body, "ToUserName", "Encrypt")
+			if err != nil {
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+			EncryptedMsg, ok := fields["Encrypt"]
+			if !ok {
+				err = errors.New("the RequestHttpBody has no Encrypt")
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
 
 			// 安全考虑验证下 ToUserName
-			haveToUserName := requestHttpBody.ToUserName
+			haveToUserName := fields["ToUserName"]
 			wantToUserName := wechatServer.WechatId()
 			if len(haveToUserName) != len(wantToUserName) {
 				err = fmt.Errorf("the RequestHttpBody's ToUserName mismatch, have: %s, want: %s", haveToUserName, wantToUserName)
@@ -99,15 +116,46 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 			wechatToken := wechatServer.Token()
 
 			// 验证签名
-			msgSignature2 := util.MsgSign(wechatToken, timestampStr, nonce, requestHttpBody.EncryptedMsg)
+			msgSignature2 := util.MsgSign(wechatToken, timestampStr, nonce, EncryptedMsg)
 			if subtle.ConstantTimeCompare([]byte(msgSignature1), []byte(msgSignature2)) != 1 {
-				err = fmt.Errorf("check signature failed, input: %s, local: %s", msgSignature1, msgSignature2)
+				err = &util.SignatureError{Name: "msg_signature", Input: msgSignature1, Local: msgSignature2}
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+
+			// 签名验证通过, 解析整个 http body(兼容模式的明文字段)
+			var requestHttpBody RequestHttpBody
+			if err = util.UnmarshalXML(body, &requestHttpBody); err != nil {
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+			if requestHttpBody.ToUserName != haveToUserName || requestHttpBody.EncryptedMsg != EncryptedMsg {
+				err = errors.New("the RequestHttpBody has duplicate ToUserName or Encrypt")
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+
+			plaintextFields, err := compatFields(body)
+			if err != nil {
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+
+			// 整个 http body 都要被 msg_signature 覆盖, 拒绝带有明文字段的兼容模式
+			if policy.requireSignedBody() && len(plaintextFields) > 0 {
+				err = fmt.Errorf("plaintext message fields are not allowed by the %s signature policy", policy)
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+
+			// 防重放
+			if err = checkReplay(wechatServer, timestamp, nonce, body); err != nil {
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
 
 			// 解密
-			EncryptedMsgBytes, err := base64.StdEncoding.DecodeString(requestHttpBody.EncryptedMsg)
+			EncryptedMsgBytes, err := base64.StdEncoding.DecodeString(EncryptedMsg)
 			if err != nil {
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
@@ -134,7 +182,7 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 
 			// 解密成功, 解析 MixedMessage
 			var MixedMsg MixedMessage
-			if err = xml.Unmarshal(RawMsgXML, &MixedMsg); err != nil {
+			if err = util.UnmarshalXML(RawMsgXML, &MixedMsg); err != nil {
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
@@ -146,6 +194,19 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 				return
 			}
 
+			// 兼容模式, 明文字段必须和解密后的消息一致
+			if len(plaintextFields) > 0 {
+				decryptedFields, err := compatFields(RawMsgXML)
+				if err != nil {
+					invalidRequestHandler.ServeInvalidRequest(w, r, err)
+					return
+				}
+				if err = checkCompatFields(plaintextFields, decryptedFields); err != nil {
+					invalidRequestHandler.ServeInvalidRequest(w, r, err)
+					return
+				}
+			}
+
 			// 成功, 交给 MessageHandler
 			r := &Request{
 				HttpRequest: r,
@@ -164,15 +225,24 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 				WechatId:    wantToUserName,
 				WechatToken: wechatToken,
 				WechatAppId: WechatAppId,
+
+				logger: logger,
 			}
 
 			wechatServer.MessageHandler().ServeMessage(w, r)
+			logMessageServed(logger, r, start)
 
 		case "", "raw": // 明文模式
+			if policy.requireSignedBody() {
+				err = fmt.Errorf("plaintext mode is not allowed by the %s signature policy", policy)
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+
 			// 首先验证签名
 
 			if len(signature1) != 40 {
-				err = fmt.Errorf("the length of signature mismatch, have: %d, want: 40", len(signature1))
+				err = &util.SignatureError{Name: "signature", Input: signature1}
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
@@ -180,20 +250,26 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 			WechatToken := wechatServer.Token()
 			signature2 := util.Sign(WechatToken, timestampStr, nonce)
 			if subtle.ConstantTimeCompare([]byte(signature1), []byte(signature2)) != 1 {
-				err = fmt.Errorf("check signature failed, input: %s, local: %s", signature1, signature2)
+				err = &util.SignatureError{Name: "signature", Input: signature1, Local: signature2}
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
 
 			// 验证签名成功, 解析 MixedMessage
-			RawMsgXML, err := ioutil.ReadAll(r.Body)
+			RawMsgXML, err := util.ReadRequestBody(r, serverMaxBodySize(wechatServer))
 			if err != nil {
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
 
+			// 防重放
+			if err = checkReplay(wechatServer, timestamp, nonce, RawMsgXML); err != nil {
+				invalidRequestHandler.ServeInvalidRequest(w, r, err)
+				return
+			}
+
 			var MixedMsg MixedMessage
-			if err := xml.Unmarshal(RawMsgXML, &MixedMsg); err != nil {
+			if err := util.UnmarshalXML(RawMsgXML, &MixedMsg); err != nil {
 				invalidRequestHandler.ServeInvalidRequest(w, r, err)
 				return
 			}
@@ -225,9 +301,12 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 				WechatId:    wantToUserName,
 				WechatToken: WechatToken,
 				WechatAppId: wechatServer.AppId(),
+
+				logger: logger,
 			}
 
 			wechatServer.MessageHandler().ServeMessage(w, r)
+			logMessageServed(logger, r, start)
 
 		default: // 未知的加密类型
 			err := errors.New("unknown encrypt_type: " + encryptType)
@@ -243,18 +322,40 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, urlValues url.Values,
 		}
 
 		if len(signature1) != 40 {
-			err = fmt.Errorf("the length of signature mismatch, have: %d, want: 40", len(signature1))
+			err = &util.SignatureError{Name: "signature", Input: signature1}
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
 
 		signature2 := util.Sign(wechatServer.Token(), timestamp, nonce)
 		if subtle.ConstantTimeCompare([]byte(signature1), []byte(signature2)) != 1 {
-			err = fmt.Errorf("check signature failed, input: %s, local: %s", signature1, signature2)
+			err = &util.SignatureError{Name: "signature", Input: signature1, Local: signature2}
 			invalidRequestHandler.ServeInvalidRequest(w, r, err)
 			return
 		}
-		fmt.Println("echostr.....")
+		logger.Log(util.LogLevelInfo, "url verified", util.LogField{Key: "appid", Value: wechatServer.AppId()})
 		io.WriteString(w, echostr)
+
+	default:
+		err := &util.MethodNotAllowedError{Method: r.Method, Allow: []string{"GET", "POST"}}
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
+	}
+}
+
+// 如果 wechatServer 实现了 ReplayGuardProvider 则做防重放检查, 只检查通过了签名验证的消息请求.
+//  body 是请求的 http body, 设置了 util.ReplayGuard.AllowRedelivery 则放行完全一样的请求(微信服务器的重试).
+func checkReplay(wechatServer WechatServer, timestamp int64, nonce string, body []byte) error {
+	provider, ok := wechatServer.(ReplayGuardProvider)
+	if !ok {
+		return nil
+	}
+	return provider.ReplayGuard().CheckBody(wechatServer.WechatId(), timestamp, nonce, body)
+}
+
+// 获取 wechatServer 的消息请求 http body 的最大长度, 参考 MaxBodySizeProvider.
+func serverMaxBodySize(wechatServer WechatServer) int64 {
+	if provider, ok := wechatServer.(MaxBodySizeProvider); ok {
+		return provider.MaxBodySize()
 	}
+	return util.DefaultMaxRequestBodySize
 }
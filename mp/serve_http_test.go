@@ -0,0 +1,309 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philsong/wechat2/util"
+)
+
+// 构造一个明文模式的消息请求
+func newRawMessageRequest(token string, timestamp int64, nonce string) *http.Request {
+	timestampStr := strconv.FormatInt(timestamp, 10)
+	query := url.Values{
+		"signature": {util.Sign(token, timestampStr, nonce)},
+		"timestamp": {timestampStr},
+		"nonce":     {nonce},
+	}
+	body := "<xml><ToUserName>gh_test</ToUserName><FromUserName>user</FromUserName>" +
+		"<CreateTime>" + timestampStr + "</CreateTime><MsgType>text</MsgType><Content>hi</Content></xml>"
+	return httptest.NewRequest("POST", "/?"+query.Encode(), strings.NewReader(body))
+}
+
+func TestServeHTTPReplayGuard(t *testing.T) {
+	served := 0
+	srv := NewDefaultWechatServer("gh_test", "token", "appid", make([]byte, 32),
+		MessageHandlerFunc(func(w http.ResponseWriter, r *Request) { served++ }))
+	srv.SetReplayGuard(util.NewReplayGuard(time.Minute, nil))
+
+	var invalidErr error
+	frontend := NewWechatServerFrontend(srv, InvalidRequestHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		invalidErr = err
+	}))
+
+	now := time.Now().Unix()
+	frontend.ServeHTTP(httptest.NewRecorder(), newRawMessageRequest("token", now, "nonce1"))
+	if served != 1 || invalidErr != nil {
+		t.Fatalf("served: %d, err: %v", served, invalidErr)
+	}
+
+	// 默认拒绝完全一样的请求, 安全模式下也一样
+	frontend.ServeHTTP(httptest.NewRecorder(), newRawMessageRequest("token", now, "nonce1"))
+	if _, ok := invalidErr.(*util.ReplayError); !ok || served != 1 {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", "", "", now, "nonce3"))
+	if served != 2 || invalidErr != nil {
+		t.Fatalf("served: %d, err: %v", served, invalidErr)
+	}
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", "", "", now, "nonce3"))
+	if _, ok := invalidErr.(*util.ReplayError); !ok || served != 2 {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+
+	// timestamp 过期
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newRawMessageRequest("token", now-3600, "nonce2"))
+	if _, ok := invalidErr.(*util.TimestampSkewError); !ok || served != 2 {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+
+	// 设置了 AllowRedelivery 则放行完全一样的请求(微信服务器的重试)
+	guard := util.NewReplayGuard(time.Minute, nil)
+	guard.AllowRedelivery = true
+	srv.SetReplayGuard(guard)
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newRawMessageRequest("token", now, "nonce1"))
+	frontend.ServeHTTP(httptest.NewRecorder(), newRawMessageRequest("token", now, "nonce1"))
+	if served != 4 || invalidErr != nil {
+		t.Fatalf("served: %d, err: %v", served, invalidErr)
+	}
+
+	// 同样的 timestamp 和 nonce, 不同的 body 还是重放
+	r := newRawMessageRequest("token", now, "nonce1")
+	r.Body = ioutil.NopCloser(strings.NewReader("<xml><ToUserName>gh_test</ToUserName><MsgType>text</MsgType><Content>replayed</Content></xml>"))
+	frontend.ServeHTTP(httptest.NewRecorder(), r)
+	if _, ok := invalidErr.(*util.ReplayError); !ok || served != 4 {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+}
+
+// 构造一个安全模式(plaintext 不为空则是兼容模式)的消息请求, signature 为空则 URL 上使用正确的 signature
+func newAESMessageRequest(token, signature, plaintext string, timestamp int64, nonce string) *http.Request {
+	timestampStr := strconv.FormatInt(timestamp, 10)
+	rawMsgXML := "<xml><ToUserName>gh_test</ToUserName><FromUserName>user</FromUserName>" +
+		"<CreateTime>" + timestampStr + "</CreateTime><MsgType>text</MsgType><Content>hi</Content></xml>"
+
+	var aesKey [32]byte
+	encryptedMsg := base64.StdEncoding.EncodeToString(
+		util.AESEncryptMsg([]byte("0123456789abcdef"), []byte(rawMsgXML), "appid", aesKey))
+
+	if signature == "" {
+		signature = util.Sign(token, timestampStr, nonce)
+	}
+	query := url.Values{
+		"signature":     {signature},
+		"timestamp":     {timestampStr},
+		"nonce":         {nonce},
+		"encrypt_type":  {"aes"},
+		"msg_signature": {util.MsgSign(token, timestampStr, nonce, encryptedMsg)},
+	}
+	body := "<xml><ToUserName>gh_test</ToUserName>" + plaintext + "<Encrypt>" + encryptedMsg + "</Encrypt></xml>"
+	return httptest.NewRequest("POST", "/?"+query.Encode(), strings.NewReader(body))
+}
+
+func TestServeHTTPSignaturePolicy(t *testing.T) {
+	served := 0
+	srv := NewDefaultWechatServer("gh_test", "token", "appid", make([]byte, 32),
+		MessageHandlerFunc(func(w http.ResponseWriter, r *Request) { served++ }))
+
+	var invalidErr error
+	frontend := NewWechatServerFrontend(srv, InvalidRequestHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		invalidErr = err
+	}))
+	now := time.Now().Unix()
+	badSignature := strings.Repeat("0", 40)
+
+	// 默认策略同时验证 URL 上的 signature
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", badSignature, "", now, "nonce"))
+	if invalidErr == nil || served != 0 {
+		t.Fatalf("bad signature should be rejected, served: %d", served)
+	}
+
+	// 兼容模式的明文和密文不一致, 两边都有的字段都要比较
+	for _, tt := range []struct {
+		plaintext string
+		field     string
+	}{
+		{"<FromUserName>attacker</FromUserName><MsgType>text</MsgType>", "FromUserName"},
+		{"<FromUserName>user</FromUserName><Content>bye</Content>", "Content"},
+		{"<CreateTime>1</CreateTime>", "CreateTime"},
+	} {
+		invalidErr = nil
+		frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", "", tt.plaintext, now, "nonce"))
+		if e, ok := invalidErr.(*CompatFieldMismatchError); !ok || e.Field != tt.field || served != 0 {
+			t.Errorf("served: %d, err: %v", served, invalidErr)
+		}
+	}
+
+	// 只有明文里有的字段不比较
+	invalidErr = nil
+	plaintext := "<FromUserName>user</FromUserName><MsgType>text</MsgType><Content>hi</Content><Event>unused</Event>"
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", "", plaintext, now, "nonce"))
+	if served != 1 || invalidErr != nil {
+		t.Fatalf("served: %d, err: %v", served, invalidErr)
+	}
+
+	// 显式设置为只验证 msg_signature
+	srv.SetSignaturePolicy(SignaturePolicyMsgSignature)
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", badSignature, "", now, "nonce"))
+	if served != 2 || invalidErr != nil {
+		t.Fatalf("served: %d, err: %v", served, invalidErr)
+	}
+
+	srv.SetSignaturePolicy(SignaturePolicyStrict)
+	invalidErr = nil
+	plaintext = "<FromUserName>user</FromUserName><MsgType>text</MsgType>"
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", "", plaintext, now, "nonce"))
+	if invalidErr == nil || served != 2 {
+		t.Errorf("compatible mode should be rejected, served: %d", served)
+	}
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newRawMessageRequest("token", now, "nonce"))
+	if invalidErr == nil || served != 2 {
+		t.Errorf("plaintext mode should be rejected, served: %d", served)
+	}
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", "", "", now, "nonce"))
+	if served != 3 || invalidErr != nil {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+
+	// 整个 http body 都要被 msg_signature 覆盖, 不验证 URL 上的 signature
+	srv.SetSignaturePolicy(SignaturePolicyRawBody)
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", "", plaintext, now, "nonce"))
+	if invalidErr == nil || served != 3 {
+		t.Errorf("compatible mode should be rejected, served: %d", served)
+	}
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newRawMessageRequest("token", now, "nonce"))
+	if invalidErr == nil || served != 3 {
+		t.Errorf("plaintext mode should be rejected, served: %d", served)
+	}
+	invalidErr = nil
+	frontend.ServeHTTP(httptest.NewRecorder(), newAESMessageRequest("token", badSignature, "", now, "nonce"))
+	if served != 4 || invalidErr != nil {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+	r := newAESMessageRequest("token", "", "", now, "nonce")
+	r.URL.RawQuery = strings.Replace(r.URL.RawQuery, "msg_signature=", "msg_signature=0", 1)
+	frontend.ServeHTTP(httptest.NewRecorder(), r)
+	if _, ok := invalidErr.(*util.SignatureError); !ok || served != 4 {
+		t.Errorf("bad msg_signature should be rejected, served: %d, err: %v", served, invalidErr)
+	}
+}
+
+func TestCompatFields(t *testing.T) {
+	data := []byte("<xml><ToUserName>gh_test</ToUserName><Encrypt>xxx</Encrypt>" +
+		"<MsgType><![CDATA[event]]></MsgType>" +
+		"<ScanCodeInfo><ScanType>qrcode</ScanType><ScanResult>1</ScanResult></ScanCodeInfo>" +
+		"<Articles><item><Title>a</Title></item><item><Title>b</Title></item></Articles></xml>")
+	fields, err := compatFields(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"MsgType":                 "event",
+		"ScanCodeInfo/ScanType":   "qrcode",
+		"ScanCodeInfo/ScanResult": "1",
+		"Articles/item/Title":     "a",
+		"Articles/item/Title#2":   "b",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("fields mismatch,\nhave: %v\nwant: %v", fields, want)
+	}
+}
+
+func TestServeHTTPBodyLimit(t *testing.T) {
+	served := 0
+	srv := NewDefaultWechatServer("gh_test", "token", "appid", make([]byte, 32),
+		MessageHandlerFunc(func(w http.ResponseWriter, r *Request) { served++ }))
+
+	var invalidErr error
+	frontend := NewWechatServerFrontend(srv, InvalidRequestHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		invalidErr = err
+	}))
+	now := time.Now().Unix()
+
+	// DTD 和实体
+	r := newRawMessageRequest("token", now, "nonce")
+	body := `<!DOCTYPE xml [<!ENTITY e "hi">]><xml><ToUserName>gh_test</ToUserName><Content>&e;</Content></xml>`
+	r.Body, r.ContentLength = ioutil.NopCloser(strings.NewReader(body)), int64(len(body))
+	frontend.ServeHTTP(httptest.NewRecorder(), r)
+	if invalidErr != util.ErrXMLDirective || served != 0 {
+		t.Errorf("served: %d, err: %v", served, invalidErr)
+	}
+
+	srv.SetMaxBodySize(64)
+	for _, r := range []*http.Request{
+		newRawMessageRequest("token", now, "nonce"),
+		newAESMessageRequest("token", "", "", now, "nonce"),
+	} {
+		invalidErr = nil
+		frontend.ServeHTTP(httptest.NewRecorder(), r)
+		if _, ok := invalidErr.(*util.RequestBodyTooLargeError); !ok || served != 0 {
+			t.Errorf("served: %d, err: %v", served, invalidErr)
+		}
+	}
+}
+
+func TestWechatServerFrontendStatusCode(t *testing.T) {
+	srv := NewDefaultWechatServer("gh_test", "token", "appid", make([]byte, 32),
+		MessageHandlerFunc(func(w http.ResponseWriter, r *Request) {}))
+	srv.SetMaxBodySize(64)
+
+	frontend := NewWechatServerFrontend(srv, nil)
+	frontend.SetWriteStatusCode(true)
+	frontend.SetAllowHEAD(true)
+
+	now := time.Now().Unix()
+	tests := []struct {
+		r    *http.Request
+		want int
+	}{
+		{httptest.NewRequest("HEAD", "/", nil), http.StatusOK},
+		{httptest.NewRequest("PUT", "/", nil), http.StatusMethodNotAllowed},
+		{httptest.NewRequest("POST", "/?a=%zz", nil), http.StatusBadRequest},
+		{httptest.NewRequest("POST", "/?timestamp=1", nil), http.StatusBadRequest},
+		{newRawMessageRequest("other_token", now, "nonce"), http.StatusForbidden},
+		{newAESMessageRequest("token", "", "", now, "nonce"), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		frontend.ServeHTTP(w, test.r)
+		if w.Code != test.want {
+			t.Errorf("%s %s, have status %d, want %d", test.r.Method, test.r.URL, w.Code, test.want)
+		}
+		if test.want == http.StatusMethodNotAllowed {
+			if allow := w.Header().Get("Allow"); allow != "GET, POST, HEAD" {
+				t.Errorf("unexpected Allow header: %q", allow)
+			}
+		}
+	}
+
+	// InvalidRequestHandler 写入的响应优先
+	frontend = NewWechatServerFrontend(srv, InvalidRequestHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	frontend.SetWriteStatusCode(true)
+	w := httptest.NewRecorder()
+	frontend.ServeHTTP(w, httptest.NewRequest("HEAD", "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("have status %d, want %d", w.Code, http.StatusTeapot)
+	}
+}
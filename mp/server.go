@@ -8,6 +8,8 @@ package mp
 import (
 	"errors"
 	"sync"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 公众号服务端接口, 处理单个公众号的消息(事件)请求.
@@ -22,7 +24,23 @@ type WechatServer interface {
 	MessageHandler() MessageHandler // 获取 MessageHandler
 }
 
+// WechatServer 实现了这个接口则 ServeHTTP 会对消息请求做防重放检查, 参考 DefaultWechatServer.SetReplayGuard.
+//  检查失败的错误是 *util.TimestampSkewError 或者 *util.ReplayError, 交给 InvalidRequestHandler 处理.
+type ReplayGuardProvider interface {
+	ReplayGuard() *util.ReplayGuard // 返回 nil 表示不检查
+}
+
+// WechatServer 实现了这个接口则 ServeHTTP 按照返回的长度限制消息请求的 http body, 否则使用 util.DefaultMaxRequestBodySize.
+//  超过限制的错误是 *util.RequestBodyTooLargeError, 交给 InvalidRequestHandler 处理.
+type MaxBodySizeProvider interface {
+	MaxBodySize() int64 // 返回 <= 0 表示使用 util.DefaultMaxRequestBodySize
+}
+
 var _ WechatServer = new(DefaultWechatServer)
+var _ ReplayGuardProvider = new(DefaultWechatServer)
+var _ LoggerProvider = new(DefaultWechatServer)
+var _ SignaturePolicyProvider = new(DefaultWechatServer)
+var _ MaxBodySizeProvider = new(DefaultWechatServer)
 
 type DefaultWechatServer struct {
 	wechatId string
@@ -33,6 +51,10 @@ type DefaultWechatServer struct {
 	currentAESKey     [32]byte // 当前的 AES Key
 	lastAESKey        [32]byte // 最后一个 AES Key
 	isLastAESKeyValid bool     // lastAESKey 是否有效, 如果 lastAESKey 是 zero 则无效
+	replayGuard       *util.ReplayGuard
+	logger            util.Logger
+	signaturePolicy   SignaturePolicy
+	maxBodySize       int64
 
 	messageHandler MessageHandler
 }
@@ -100,3 +122,60 @@ func (srv *DefaultWechatServer) UpdateAESKey(AESKey []byte) (err error) {
 	srv.rwmutex.Unlock()
 	return
 }
+
+// 设置防重放检查, guard == nil 表示不检查(默认).
+//  比如 srv.SetReplayGuard(util.NewReplayGuard(util.DefaultMaxTimestampSkew, nil)).
+//  NOTE: 默认拒绝微信服务器的重试, 需要处理重试请设置 guard.AllowRedelivery 并且使用 DedupHandler 去重.
+func (srv *DefaultWechatServer) SetReplayGuard(guard *util.ReplayGuard) {
+	srv.rwmutex.Lock()
+	srv.replayGuard = guard
+	srv.rwmutex.Unlock()
+}
+func (srv *DefaultWechatServer) ReplayGuard() (guard *util.ReplayGuard) {
+	srv.rwmutex.RLock()
+	guard = srv.replayGuard
+	srv.rwmutex.RUnlock()
+	return
+}
+
+// 设置 ServeHTTP 输出日志的 Logger, logger == nil 表示不输出日志(默认).
+//  比如 srv.SetLogger(util.NewStdLogger(os.Stderr, util.LogLevelInfo)).
+func (srv *DefaultWechatServer) SetLogger(logger util.Logger) {
+	srv.rwmutex.Lock()
+	srv.logger = logger
+	srv.rwmutex.Unlock()
+}
+func (srv *DefaultWechatServer) Logger() (logger util.Logger) {
+	srv.rwmutex.RLock()
+	logger = srv.logger
+	srv.rwmutex.RUnlock()
+	return
+}
+
+// 设置消息请求的签名验证策略, 默认是 SignaturePolicyBoth.
+//  公众号后台选择了安全模式的建议设置为 SignaturePolicyStrict,
+//  URL 上的 signature 不可靠(比如被代理改写)的时候设置为 SignaturePolicyRawBody.
+func (srv *DefaultWechatServer) SetSignaturePolicy(policy SignaturePolicy) {
+	srv.rwmutex.Lock()
+	srv.signaturePolicy = policy
+	srv.rwmutex.Unlock()
+}
+func (srv *DefaultWechatServer) SignaturePolicy() (policy SignaturePolicy) {
+	srv.rwmutex.RLock()
+	policy = srv.signaturePolicy
+	srv.rwmutex.RUnlock()
+	return
+}
+
+// 设置消息请求 http body 的最大长度, size <= 0 表示使用 util.DefaultMaxRequestBodySize(默认).
+func (srv *DefaultWechatServer) SetMaxBodySize(size int64) {
+	srv.rwmutex.Lock()
+	srv.maxBodySize = size
+	srv.rwmutex.Unlock()
+}
+func (srv *DefaultWechatServer) MaxBodySize() (size int64) {
+	srv.rwmutex.RLock()
+	size = srv.maxBodySize
+	srv.rwmutex.RUnlock()
+	return
+}
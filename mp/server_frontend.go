@@ -6,15 +6,19 @@
 package mp
 
 import (
-	"fmt"
 	"net/http"
 	"net/url"
+
+	"github.com/philsong/wechat2/util"
 )
 
 // 实现了 http.Handler, 处理一个公众号的消息(事件)请求.
 type WechatServerFrontend struct {
 	wechatServer          WechatServer
 	invalidRequestHandler InvalidRequestHandler
+	writeStatusCode       bool
+	allowHEAD             bool
+	logger                util.Logger
 }
 
 func NewWechatServerFrontend(server WechatServer, handler InvalidRequestHandler) *WechatServerFrontend {
@@ -31,14 +35,47 @@ func NewWechatServerFrontend(server WechatServer, handler InvalidRequestHandler)
 	}
 }
 
+// 设置 Logger, 用于输出 frontend 本身拒绝的请求的日志, logger == nil 表示不输出(默认).
+//  WechatServer 处理请求的日志由 WechatServer 自己的 Logger 输出, 参考 LoggerProvider.
+//  NOTE: 请在使用之前设置.
+func (frontend *WechatServerFrontend) SetLogger(logger util.Logger) {
+	frontend.logger = logger
+}
+
+// 设置是否按照错误写入 HTTP 状态码, 默认不写入, 由 InvalidRequestHandler 决定.
+//  设置为 true 之后, 如果 InvalidRequestHandler 没有写入响应: 不支持的请求方法返回 405 并且设置 Allow header,
+//  查询参数等格式错误返回 400, 签名验证或者防重放检查失败返回 403, http body 太大返回 413, 参考 util.InvalidRequestStatusCode.
+//  NOTE: 请在使用之前设置.
+func (frontend *WechatServerFrontend) SetWriteStatusCode(enabled bool) {
+	frontend.writeStatusCode = enabled
+}
+
+// 设置是否响应 HEAD 请求, 默认不响应(当作不支持的方法).
+//  设置为 true 之后 HEAD 请求直接返回 200, 不做任何检查, 一般用于负载均衡的健康检查.
+//  NOTE: 请在使用之前设置.
+func (frontend *WechatServerFrontend) SetAllowHEAD(enabled bool) {
+	frontend.allowHEAD = enabled
+}
+
 // 实现 http.Handler.
 func (frontend *WechatServerFrontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	wechatServer := frontend.wechatServer
-	invalidRequestHandler := frontend.invalidRequestHandler
+	invalidRequestHandler := withInvalidRequestStatus(frontend.invalidRequestHandler, frontend.writeStatusCode)
+
+	head, err := checkFrontendMethod(r, frontend.allowHEAD, "GET", "POST")
+	if head {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		invalidRequestHandler = util.WithInvalidRequestLogger(invalidRequestHandler, frontend.logger)
+		invalidRequestHandler.ServeInvalidRequest(w, r, err)
+		return
+	}
 
 	urlValues, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		fmt.Println("err", err)
+		invalidRequestHandler = util.WithInvalidRequestLogger(invalidRequestHandler, frontend.logger)
 		invalidRequestHandler.ServeInvalidRequest(w, r, err)
 		return
 	}
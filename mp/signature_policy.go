@@ -0,0 +1,168 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 消息请求的签名验证策略, 参考 DefaultWechatServer.SetSignaturePolicy.
+type SignaturePolicy int
+
+const (
+	// 默认策略: 安全模式(兼容模式)同时验证 URL 上的 signature 和 msg_signature, 明文模式验证 signature.
+	SignaturePolicyBoth SignaturePolicy = iota
+
+	// 安全模式(兼容模式)只验证 msg_signature, 不验证 URL 上的 signature;
+	// 只有在 URL 上的 signature 不可靠(比如被代理改写)的时候才需要显式设置.
+	SignaturePolicyMsgSignature
+
+	// 同时满足 SignaturePolicyBoth 和 SignaturePolicyRawBody: 验证两个签名, 并且只接受安全模式.
+	SignaturePolicyStrict
+
+	// 验证 msg_signature, 并且整个 http body 都要被 msg_signature 覆盖:
+	// 除了 ToUserName 和 Encrypt 不能有别的字段, 即拒绝明文模式的请求和带有明文字段的兼容模式的请求;
+	// 不验证 URL 上的 signature, 用于 URL 上的 signature 不可靠但是只接受安全模式的场景.
+	SignaturePolicyRawBody
+)
+
+func (policy SignaturePolicy) String() string {
+	switch policy {
+	case SignaturePolicyBoth:
+		return "both"
+	case SignaturePolicyMsgSignature:
+		return "msg_signature"
+	case SignaturePolicyStrict:
+		return "strict"
+	case SignaturePolicyRawBody:
+		return "raw_body"
+	default:
+		return "SignaturePolicy(" + strconv.Itoa(int(policy)) + ")"
+	}
+}
+
+// 安全模式(兼容模式)下是否验证 URL 上的 signature.
+func (policy SignaturePolicy) checkSignature() bool {
+	return policy != SignaturePolicyMsgSignature && policy != SignaturePolicyRawBody
+}
+
+// 是否要求整个 http body 都被 msg_signature 覆盖, 即只接受没有明文字段的安全模式.
+func (policy SignaturePolicy) requireSignedBody() bool {
+	return policy == SignaturePolicyStrict || policy == SignaturePolicyRawBody
+}
+
+// WechatServer 实现了这个接口则 ServeHTTP 按照返回的策略验证签名, 否则使用 SignaturePolicyBoth.
+type SignaturePolicyProvider interface {
+	SignaturePolicy() SignaturePolicy
+}
+
+// 获取 wechatServer 的签名验证策略.
+func serverSignaturePolicy(wechatServer WechatServer) SignaturePolicy {
+	if provider, ok := wechatServer.(SignaturePolicyProvider); ok {
+		return provider.SignaturePolicy()
+	}
+	return SignaturePolicyBoth
+}
+
+// 兼容模式下 http body 里的明文字段和解密后的消息不一致.
+type CompatFieldMismatchError struct {
+	Field     string // 字段的路径, 比如 FromUserName, ScanCodeInfo/ScanType
+	Plaintext string // http body 里的明文
+	Decrypted string // 解密后的消息里的值
+}
+
+func (e *CompatFieldMismatchError) Error() string {
+	return fmt.Sprintf("the plaintext %s mismatch the decrypted message, plaintext: %s, decrypted: %s",
+		e.Field, e.Plaintext, e.Decrypted)
+}
+
+// 解析 XML 根元素下所有的叶子元素的文本, key 是从根元素的子元素开始的路径, 比如 "FromUserName",
+// "ScanCodeInfo/ScanType"; 同一个路径第 n(n > 1) 次出现的 key 是 "路径#n", 比如 "Articles/item/Title#2".
+//  不包含 ToUserName 和 Encrypt, 它们在验证签名的时候单独检查.
+//  NOTE: data 必须已经通过了 util.CheckXML 的检查.
+func compatFields(data []byte) (fields map[string]string, err error) {
+	fields = make(map[string]string)
+	counts := make(map[string]int)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var (
+		path    []string // 当前元素的路径, 不包含根元素
+		text    []byte
+		isLeaf  bool
+		started bool // 已经进入了根元素
+	)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if !started {
+				started = true
+				continue
+			}
+			path = append(path, token.Name.Local)
+			text, isLeaf = text[:0], true
+		case xml.CharData:
+			text = append(text, token...)
+		case xml.EndElement:
+			if len(path) == 0 {
+				continue // 根元素结束
+			}
+			if isLeaf {
+				key := strings.Join(path, "/")
+				counts[key]++
+				if n := counts[key]; n > 1 {
+					key += "#" + strconv.Itoa(n)
+				}
+				fields[key] = string(text)
+			}
+			path = path[:len(path)-1]
+			isLeaf = false
+		}
+	}
+
+	delete(fields, "ToUserName")
+	delete(fields, "Encrypt")
+	return fields, nil
+}
+
+// 兼容模式下比较 http body 里的明文字段和解密后的消息, 两边都有的字段必须完全一样;
+// 只有明文里有的字段不会被使用(MessageHandler 只能看到解密后的消息), 所以不比较.
+//  plaintext 和 decrypted 都是 compatFields 的返回值.
+func checkCompatFields(plaintext, decrypted map[string]string) error {
+	keys := make([]string, 0, len(plaintext))
+	for key := range plaintext {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // 出错的时候报告的字段是确定的
+
+	for _, key := range keys {
+		decryptedValue, ok := decrypted[key]
+		if !ok {
+			continue
+		}
+		if plaintextValue := plaintext[key]; plaintextValue != decryptedValue {
+			return &CompatFieldMismatchError{
+				Field:     key,
+				Plaintext: plaintextValue,
+				Decrypted: decryptedValue,
+			}
+		}
+	}
+	return nil
+}
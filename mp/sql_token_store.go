@@ -0,0 +1,145 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+var _ TokenStore = new(SQLTokenStore)
+
+// 基于关系数据库的 TokenStore, 用于多台机器上的多个进程.
+//  需要先创建下面的表(表名可以自定义, MySQL 的语法, 其他数据库请相应修改):
+//
+//  CREATE TABLE wechat_access_token (
+//      token_key        VARCHAR(64)  NOT NULL PRIMARY KEY,
+//      token            VARCHAR(512) NOT NULL DEFAULT '',
+//      expires_at       BIGINT       NOT NULL DEFAULT 0, -- unix 时间戳, 毫秒
+//      lease_owner      VARCHAR(128) NOT NULL DEFAULT '',
+//      lease_expires_at BIGINT       NOT NULL DEFAULT 0  -- unix 时间戳, 毫秒
+//  );
+//
+//  租约通过带条件的 UPDATE 实现, 不依赖数据库的锁.
+type SQLTokenStore struct {
+	db    *sql.DB
+	table string
+
+	// 返回第 n 个(从 1 开始)参数的占位符, 默认是 "?";
+	// PostgreSQL 请设置为 func(n int) string { return "$" + strconv.Itoa(n) }.
+	//  请在使用之前设置.
+	Placeholder func(n int) string
+}
+
+// 创建一个新的 SQLTokenStore, table 是保存 access_token 的表名.
+func NewSQLTokenStore(db *sql.DB, table string) *SQLTokenStore {
+	return &SQLTokenStore{
+		db:    db,
+		table: table,
+	}
+}
+
+// 把 query 里的 "?" 替换为 store.Placeholder 返回的占位符, 并且把 "{table}" 替换为表名.
+func (store *SQLTokenStore) query(query string) string {
+	query = strings.Replace(query, "{table}", store.table, -1)
+	if store.Placeholder == nil {
+		return query
+	}
+	var buf strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			buf.WriteString(store.Placeholder(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(msec int64) time.Time {
+	return time.Unix(0, msec*int64(time.Millisecond))
+}
+
+// 确保 key 对应的行存在, 并发插入导致的主键冲突可以忽略.
+func (store *SQLTokenStore) ensureRow(key string) error {
+	var n int
+	err := store.db.QueryRow(store.query("SELECT COUNT(*) FROM {table} WHERE token_key = ?"), key).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	if _, err = store.db.Exec(store.query("INSERT INTO {table} (token_key) VALUES (?)"), key); err != nil {
+		// 可能是别的进程已经插入了
+		if err2 := store.db.QueryRow(store.query("SELECT COUNT(*) FROM {table} WHERE token_key = ?"), key).Scan(&n); err2 == nil && n > 0 {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (store *SQLTokenStore) Load(key string) (entry *TokenEntry, err error) {
+	var (
+		token     string
+		expiresAt int64
+	)
+	err = store.db.QueryRow(store.query("SELECT token, expires_at FROM {table} WHERE token_key = ?"), key).Scan(&token, &expiresAt)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+		return
+	case err != nil:
+		return
+	case token == "":
+		return
+	}
+	entry = &TokenEntry{
+		Token:     token,
+		ExpiresAt: fromUnixMilli(expiresAt),
+	}
+	return
+}
+
+func (store *SQLTokenStore) Save(key string, entry *TokenEntry) (err error) {
+	if err = store.ensureRow(key); err != nil {
+		return
+	}
+	_, err = store.db.Exec(store.query("UPDATE {table} SET token = ?, expires_at = ? WHERE token_key = ?"),
+		entry.Token, unixMilli(entry.ExpiresAt), key)
+	return
+}
+
+func (store *SQLTokenStore) AcquireLease(key, owner string, ttl time.Duration) (ok bool, err error) {
+	if err = store.ensureRow(key); err != nil {
+		return
+	}
+
+	now := time.Now()
+	result, err := store.db.Exec(store.query("UPDATE {table} SET lease_owner = ?, lease_expires_at = ? "+
+		"WHERE token_key = ? AND (lease_owner = '' OR lease_owner = ? OR lease_expires_at <= ?)"),
+		owner, unixMilli(now.Add(ttl)), key, owner, unixMilli(now))
+	if err != nil {
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	ok = n > 0
+	return
+}
+
+func (store *SQLTokenStore) ReleaseLease(key, owner string) (err error) {
+	_, err = store.db.Exec(store.query("UPDATE {table} SET lease_owner = '', lease_expires_at = 0 "+
+		"WHERE token_key = ? AND lease_owner = ?"), key, owner)
+	return
+}
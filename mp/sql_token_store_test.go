@@ -0,0 +1,266 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的 database/sql 驱动, 只支持 SQLTokenStore 用到的几条语句, 数据保存在内存里.
+//  DSN 作为数据库的名字, 同一个 DSN 的连接共享数据.
+type fakeTokenDriver struct {
+	mutex sync.Mutex
+	dbs   map[string]*fakeTokenDB
+}
+
+type fakeTokenDB struct {
+	mutex sync.Mutex
+	rows  map[string]*fakeTokenRow
+}
+
+type fakeTokenRow struct {
+	token          string
+	expiresAt      int64
+	leaseOwner     string
+	leaseExpiresAt int64
+}
+
+var fakeDriver = &fakeTokenDriver{dbs: make(map[string]*fakeTokenDB)}
+
+func init() {
+	sql.Register("mp_fake_token", fakeDriver)
+}
+
+func (d *fakeTokenDriver) Open(name string) (driver.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	db := d.dbs[name]
+	if db == nil {
+		db = &fakeTokenDB{rows: make(map[string]*fakeTokenRow)}
+		d.dbs[name] = db
+	}
+	return &fakeTokenConn{db: db}, nil
+}
+
+type fakeTokenConn struct {
+	db *fakeTokenDB
+}
+
+func (c *fakeTokenConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeTokenStmt{db: c.db, query: placeholderRegexp.ReplaceAllString(query, "?")}, nil
+}
+func (c *fakeTokenConn) Close() error              { return nil }
+func (c *fakeTokenConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+// PostgreSQL 风格的占位符统一成 "?"
+var placeholderRegexp = regexp.MustCompile(`\$[0-9]+`)
+
+type fakeTokenStmt struct {
+	db    *fakeTokenDB
+	query string
+}
+
+func (s *fakeTokenStmt) Close() error  { return nil }
+func (s *fakeTokenStmt) NumInput() int { return -1 }
+
+func (s *fakeTokenStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mutex.Lock()
+	defer s.db.mutex.Unlock()
+
+	switch s.query {
+	case "INSERT INTO wechat_access_token (token_key) VALUES (?)":
+		key := args[0].(string)
+		if _, ok := s.db.rows[key]; ok {
+			return nil, errors.New("duplicate primary key")
+		}
+		s.db.rows[key] = new(fakeTokenRow)
+		return driver.RowsAffected(1), nil
+
+	case "UPDATE wechat_access_token SET token = ?, expires_at = ? WHERE token_key = ?":
+		row := s.db.rows[args[2].(string)]
+		if row == nil {
+			return driver.RowsAffected(0), nil
+		}
+		row.token, row.expiresAt = args[0].(string), args[1].(int64)
+		return driver.RowsAffected(1), nil
+
+	case "UPDATE wechat_access_token SET lease_owner = ?, lease_expires_at = ? " +
+		"WHERE token_key = ? AND (lease_owner = '' OR lease_owner = ? OR lease_expires_at <= ?)":
+		row := s.db.rows[args[2].(string)]
+		if row == nil {
+			return driver.RowsAffected(0), nil
+		}
+		if row.leaseOwner != "" && row.leaseOwner != args[3].(string) && row.leaseExpiresAt > args[4].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		row.leaseOwner, row.leaseExpiresAt = args[0].(string), args[1].(int64)
+		return driver.RowsAffected(1), nil
+
+	case "UPDATE wechat_access_token SET lease_owner = '', lease_expires_at = 0 " +
+		"WHERE token_key = ? AND lease_owner = ?":
+		row := s.db.rows[args[0].(string)]
+		if row == nil || row.leaseOwner != args[1].(string) {
+			return driver.RowsAffected(0), nil
+		}
+		row.leaseOwner, row.leaseExpiresAt = "", 0
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unsupported statement: %s", s.query)
+}
+
+func (s *fakeTokenStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mutex.Lock()
+	defer s.db.mutex.Unlock()
+
+	row := s.db.rows[args[0].(string)]
+	switch s.query {
+	case "SELECT COUNT(*) FROM wechat_access_token WHERE token_key = ?":
+		n := int64(0)
+		if row != nil {
+			n = 1
+		}
+		return &fakeTokenRows{columns: []string{"COUNT(*)"}, values: [][]driver.Value{{n}}}, nil
+
+	case "SELECT token, expires_at FROM wechat_access_token WHERE token_key = ?":
+		rows := &fakeTokenRows{columns: []string{"token", "expires_at"}}
+		if row != nil {
+			rows.values = [][]driver.Value{{row.token, row.expiresAt}}
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unsupported query: %s", s.query)
+}
+
+type fakeTokenRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeTokenRows) Columns() []string { return r.columns }
+func (r *fakeTokenRows) Close() error      { return nil }
+
+func (r *fakeTokenRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// 每个测试使用单独的数据库
+var fakeDBCount int
+
+func newFakeSQLTokenStore(t *testing.T) *SQLTokenStore {
+	fakeDriver.mutex.Lock()
+	fakeDBCount++
+	dsn := "db" + strconv.Itoa(fakeDBCount)
+	fakeDriver.mutex.Unlock()
+
+	db, err := sql.Open("mp_fake_token", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewSQLTokenStore(db, "wechat_access_token")
+}
+
+func TestSQLTokenStore(t *testing.T) {
+	for _, postgres := range []bool{false, true} {
+		store := newFakeSQLTokenStore(t)
+		if postgres {
+			store.Placeholder = func(n int) string { return "$" + strconv.Itoa(n) }
+		}
+
+		entry, err := store.Load("appid")
+		if err != nil || entry != nil {
+			t.Fatalf("unexpected entry: %+v, err: %v", entry, err)
+		}
+
+		expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		if err = store.Save("appid", &TokenEntry{Token: "token1", ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		entry, err = store.Load("appid")
+		if err != nil || entry == nil || entry.Token != "token1" || !entry.ExpiresAt.Equal(expiresAt) {
+			t.Fatalf("unexpected entry: %+v, err: %v", entry, err)
+		}
+	}
+}
+
+func TestSQLTokenStoreLease(t *testing.T) {
+	store := newFakeSQLTokenStore(t)
+
+	acquire := func(owner string, ttl time.Duration, want bool) {
+		t.Helper()
+		ok, err := store.AcquireLease("appid", owner, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("AcquireLease(%q) mismatch, have: %t, want: %t", owner, ok, want)
+		}
+	}
+
+	acquire("owner1", time.Minute, true)
+	acquire("owner2", time.Minute, false)
+	acquire("owner1", time.Minute, true) // 持有者可以续约
+
+	// 不是持有者不能释放
+	if err := store.ReleaseLease("appid", "owner2"); err != nil {
+		t.Fatal(err)
+	}
+	acquire("owner2", time.Minute, false)
+
+	if err := store.ReleaseLease("appid", "owner1"); err != nil {
+		t.Fatal(err)
+	}
+	acquire("owner2", time.Millisecond, true)
+
+	// 过期的租约可以被别人获取
+	time.Sleep(5 * time.Millisecond)
+	acquire("owner1", time.Minute, true)
+
+	// 并发获取只有一个成功
+	if err := store.ReleaseLease("appid", "owner1"); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		winners []string
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			ok, err := store.AcquireLease("appid", owner, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mutex.Lock()
+				winners = append(winners, owner)
+				mutex.Unlock()
+			}
+		}("replica" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	if len(winners) != 1 {
+		t.Errorf("winners mismatch, have: %q, want: only one", winners)
+	}
+}
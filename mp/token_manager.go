@@ -0,0 +1,436 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"container/heap"
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 多个公众号的 access_token 管理器, 以 appid 为 key.
+//  和每个公众号一个 DefaultTokenServer 不同, 所有公众号的定时刷新都由一个后台 goroutine 调度,
+//  可以在运行中动态增加和删除公众号, 并发安全.
+//
+//  一般和 MultiWechatServerFrontend 配合使用, 用 appid 作为 serverKey:
+//
+//    manager.AddAccount(appid, appsecret)
+//    frontend.SetWechatServer(appid, mp.NewDefaultWechatServer(wechatId, token, appid, AESKey, handler))
+//
+//  在 MessageHandler 里通过 Request.WechatAppId 找到对应的 TokenServer:
+//
+//    clt := &mp.WechatClient{TokenServer: manager.TokenServer(r.WechatAppId), HttpClient: mp.TextHttpClient}
+//
+//  NOTE: 和 DefaultTokenServer 一样, 整个系统里每个公众号只能被一个 TokenManager 管理.
+type TokenManager struct {
+	httpClient *http.Client
+
+	mutex     sync.Mutex
+	accounts  map[string]*ManagedTokenServer
+	schedule  refreshHeap              // 按下次刷新时间排序的最小堆
+	health    []*HealthHandler         // 通过 RegisterHealth 注册的 HealthHandler
+	wakeChan  chan struct{}            // 容量为 1, 调度有变化的时候通知后台的 goroutine
+	dueChan   chan *ManagedTokenServer // 到期的公众号, 由刷新的 goroutine 接收
+	started   bool
+	closed    bool
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+	startOnce sync.Once
+
+	// 同时从微信服务器获取 access_token 的 goroutine 的数量, <= 0 则为 defaultTokenManagerWorkers.
+	//  一个公众号的网络问题只会占用一个 goroutine, 不会影响其他的公众号.
+	//  NOTE: 请在第一次使用之前设置.
+	Workers int
+
+	// 获取 access_token 使用的 Endpoint, 如果 Endpoint == nil 则使用 DefaultEndpoint.
+	//  NOTE: 请在第一次使用之前设置.
+	Endpoint *Endpoint
+
+	// 获取 access_token 之前调用 Limiter.Wait(ctx, "/cgi-bin/token"), 如果 Limiter == nil 则不限流.
+	//  NOTE: 所有公众号共用一个 Limiter, 所以一般不设置配额, 只限制速率; 请在第一次使用之前设置.
+	Limiter Limiter
+
+	// 某个公众号成功获取 access_token 之后调用.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnRefresh func(appid string, status RefreshStatus)
+
+	// 某个公众号获取 access_token 失败之后调用.
+	//  NOTE: 请在第一次使用之前设置; 同步调用, 不要阻塞.
+	OnError func(appid string, status RefreshStatus)
+}
+
+const defaultTokenManagerWorkers = 8
+
+// 创建一个新的 TokenManager.
+//  如果 httpClient == nil 则默认使用 http.DefaultClient.
+func NewTokenManager(httpClient *http.Client) *TokenManager {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &TokenManager{
+		httpClient: httpClient,
+		accounts:   make(map[string]*ManagedTokenServer),
+		wakeChan:   make(chan struct{}, 1),
+		dueChan:    make(chan *ManagedTokenServer),
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
+}
+
+// 增加一个公众号, 返回这个公众号的 TokenServer; 后台会马上开始获取 access_token.
+//  如果 appid 已经存在, 则用新的 appsecret 替换原来的公众号.
+func (manager *TokenManager) AddAccount(appid, appsecret string) *ManagedTokenServer {
+	manager.startOnce.Do(manager.start)
+
+	srv := newManagedTokenServer(manager, appid, appsecret)
+
+	manager.mutex.Lock()
+	if old := manager.accounts[appid]; old != nil {
+		manager.removeLocked(old)
+	}
+	manager.accounts[appid] = srv
+	manager.scheduleLocked(srv, time.Now())
+	for _, handler := range manager.health {
+		handler.Register(appid+"/access_token", srv)
+	}
+	manager.mutex.Unlock()
+
+	manager.wake()
+	return srv
+}
+
+// 删除一个公众号, 之后这个公众号的 TokenServer 不会再自动刷新.
+func (manager *TokenManager) RemoveAccount(appid string) {
+	manager.mutex.Lock()
+	if srv := manager.accounts[appid]; srv != nil {
+		manager.removeLocked(srv)
+		for _, handler := range manager.health {
+			handler.Unregister(appid + "/access_token")
+		}
+	}
+	manager.mutex.Unlock()
+
+	manager.wake()
+}
+
+// NOTE: 调用者要先锁定 manager.mutex
+func (manager *TokenManager) removeLocked(srv *ManagedTokenServer) {
+	delete(manager.accounts, srv.appid)
+	if srv.heapIndex >= 0 {
+		heap.Remove(&manager.schedule, srv.heapIndex)
+	}
+	srv.removed = true
+}
+
+// 获取 appid 对应的 TokenServer, 没有则返回 nil.
+func (manager *TokenManager) TokenServer(appid string) *ManagedTokenServer {
+	manager.mutex.Lock()
+	srv := manager.accounts[appid]
+	manager.mutex.Unlock()
+	return srv
+}
+
+// 返回所有公众号的 appid, 按字典序排序.
+func (manager *TokenManager) AppIds() []string {
+	manager.mutex.Lock()
+	appids := make([]string, 0, len(manager.accounts))
+	for appid := range manager.accounts {
+		appids = append(appids, appid)
+	}
+	manager.mutex.Unlock()
+
+	sort.Strings(appids)
+	return appids
+}
+
+// 把所有公众号注册到 handler, name 为 "appid/access_token".
+//  之后增加的公众号也会自动注册, 删除的公众号会自动注销.
+func (manager *TokenManager) RegisterHealth(handler *HealthHandler) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for _, h := range manager.health {
+		if h == handler {
+			return
+		}
+	}
+	manager.health = append(manager.health, handler)
+	for appid, srv := range manager.accounts {
+		handler.Register(appid+"/access_token", srv)
+	}
+}
+
+// 停止后台的 goroutine, 并等待它退出或者 ctx 结束.
+//  Stop 之后 TokenServer 不再自动刷新, 但是仍然可以使用.
+func (manager *TokenManager) Stop(ctx context.Context) error {
+	manager.mutex.Lock()
+	if !manager.closed {
+		manager.closed = true
+		close(manager.stopChan)
+	}
+	manager.mutex.Unlock()
+
+	manager.startOnce.Do(func() {})
+
+	manager.mutex.Lock()
+	started := manager.started
+	manager.mutex.Unlock()
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-manager.doneChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 停止后台的 goroutine 并等待它退出, 实现了 io.Closer.
+func (manager *TokenManager) Close() error {
+	return manager.Stop(context.Background())
+}
+
+func (manager *TokenManager) start() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.closed {
+		return
+	}
+	manager.started = true
+
+	workers := manager.Workers
+	if workers <= 0 {
+		workers = defaultTokenManagerWorkers
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			manager.work()
+		}()
+	}
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		manager.run()
+	}()
+	go func() {
+		wg.Wait()
+		<-schedulerDone
+		close(manager.doneChan)
+	}()
+}
+
+// 刷新的 goroutine, 从 manager.dueChan 取出到期的公众号去刷新.
+func (manager *TokenManager) work() {
+	for {
+		select {
+		case <-manager.stopChan:
+			return
+		case srv := <-manager.dueChan:
+			srv.autoRefresh()
+		}
+	}
+}
+
+func (manager *TokenManager) wake() {
+	select {
+	case manager.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// 设置 srv 下次刷新的时间.
+//  NOTE: 调用者要先锁定 manager.mutex
+func (manager *TokenManager) scheduleLocked(srv *ManagedTokenServer, at time.Time) {
+	if srv.removed {
+		return
+	}
+	srv.nextRefresh = at
+	if srv.heapIndex >= 0 {
+		heap.Fix(&manager.schedule, srv.heapIndex)
+	} else {
+		heap.Push(&manager.schedule, srv)
+	}
+}
+
+func (manager *TokenManager) reschedule(srv *ManagedTokenServer, at time.Time) {
+	manager.mutex.Lock()
+	manager.scheduleLocked(srv, at)
+	manager.mutex.Unlock()
+
+	manager.wake()
+}
+
+// 后台调度的 goroutine, 把到期的公众号交给刷新的 goroutine.
+func (manager *TokenManager) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		// 取出到期的公众号, 计算下次唤醒的时间
+		var due []*ManagedTokenServer
+		wait := time.Hour
+
+		manager.mutex.Lock()
+		now := time.Now()
+		for manager.schedule.Len() > 0 {
+			srv := manager.schedule[0]
+			if d := srv.nextRefresh.Sub(now); d > 0 {
+				wait = d
+				break
+			}
+			heap.Pop(&manager.schedule)
+			due = append(due, srv)
+		}
+		manager.mutex.Unlock()
+
+		// 刷新的 goroutine 都在忙的时候等待, 不会无限制的创建 goroutine
+		for _, srv := range due {
+			select {
+			case manager.dueChan <- srv:
+			case <-manager.stopChan:
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-manager.stopChan:
+			return
+		case <-manager.wakeChan:
+		case <-timer.C:
+		}
+	}
+}
+
+// 按 nextRefresh 排序的最小堆, 实现了 heap.Interface.
+type refreshHeap []*ManagedTokenServer
+
+func (h refreshHeap) Len() int           { return len(h) }
+func (h refreshHeap) Less(i, j int) bool { return h[i].nextRefresh.Before(h[j].nextRefresh) }
+func (h refreshHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+func (h *refreshHeap) Push(x interface{}) {
+	srv := x.(*ManagedTokenServer)
+	srv.heapIndex = len(*h)
+	*h = append(*h, srv)
+}
+func (h *refreshHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	srv := old[n-1]
+	old[n-1] = nil
+	srv.heapIndex = -1
+	*h = old[:n-1]
+	return srv
+}
+
+var _ ContextTokenServer = new(ManagedTokenServer)
+
+// TokenManager 管理的单个公众号的 TokenServer.
+type ManagedTokenServer struct {
+	manager          *TokenManager
+	appid, appsecret string
+
+	// 按需获取的模式, 定时刷新由 manager 调度
+	refresher *CredentialRefresher
+
+	// 下面的字段由 manager.mutex 保护
+	nextRefresh time.Time
+	heapIndex   int // 在 manager.schedule 中的位置, -1 表示不在里面
+	removed     bool
+}
+
+func newManagedTokenServer(manager *TokenManager, appid, appsecret string) (srv *ManagedTokenServer) {
+	srv = &ManagedTokenServer{
+		manager:   manager,
+		appid:     appid,
+		appsecret: appsecret,
+		heapIndex: -1,
+	}
+	srv.refresher = newOnDemandCredentialRefresher(srv.getToken, func(tickDuration time.Duration) {
+		// TokenRefresh 或者第一次同步获取之后按新的有效期安排下次刷新
+		manager.reschedule(srv, time.Now().Add(tickDuration))
+	})
+	srv.refresher.OnRefresh = func(status RefreshStatus) {
+		if manager.OnRefresh != nil {
+			manager.OnRefresh(appid, status)
+		}
+	}
+	srv.refresher.OnError = func(status RefreshStatus) {
+		if manager.OnError != nil {
+			manager.OnError(appid, status)
+		}
+	}
+	return
+}
+
+func (srv *ManagedTokenServer) AppId() string {
+	return srv.appid
+}
+
+// 如果还没有获取过 access_token, access_token 过期了或者上次获取失败(5 秒内不会重复获取), 则同步的获取.
+func (srv *ManagedTokenServer) Token() (token string, err error) {
+	return srv.refresher.Credential()
+}
+
+// 同 Token, 同时返回 access_token 的过期时间, 实现了 ExpiringTokenServer.
+func (srv *ManagedTokenServer) TokenWithExpiry() (token string, expiresAt time.Time, err error) {
+	return srv.refresher.CredentialWithExpiry()
+}
+
+// 如果 5 秒内获取过, 则直接返回原来获取的结果.
+func (srv *ManagedTokenServer) TokenRefresh() (token string, err error) {
+	return srv.refresher.Refresh()
+}
+
+// 同 TokenWithExpiry, 需要获取 access_token 的时候请求绑定到 ctx 上, 实现了 ContextTokenServer.
+func (srv *ManagedTokenServer) TokenWithExpiryContext(ctx context.Context) (token string, expiresAt time.Time, err error) {
+	return srv.refresher.CredentialWithExpiryContext(ctx)
+}
+
+// 同 TokenRefresh, 请求绑定到 ctx 上, 实现了 ContextTokenServer.
+func (srv *ManagedTokenServer) TokenRefreshContext(ctx context.Context) (token string, err error) {
+	return srv.refresher.RefreshContext(ctx)
+}
+
+// 获取 access_token 的刷新状态, 实现了 StatusReporter.
+func (srv *ManagedTokenServer) Status() RefreshStatus {
+	return srv.refresher.Status()
+}
+
+// 后台调度的刷新, 完成之后安排下次刷新.
+func (srv *ManagedTokenServer) autoRefresh() {
+	tickDuration := srv.refresher.tick()
+	srv.manager.reschedule(srv, time.Now().Add(tickDuration))
+}
+
+// 从微信服务器获取 access_token, 实现了 CredentialFetcher.
+func (srv *ManagedTokenServer) getToken(ctx context.Context) (token string, expiresIn time.Duration, err error) {
+	resp, err := getToken(ctx, srv.manager.httpClient, srv.manager.Endpoint, srv.manager.Limiter, srv.appid, srv.appsecret)
+	if err != nil {
+		return
+	}
+	return resp.Token, time.Duration(resp.ExpiresIn) * time.Second, nil
+}
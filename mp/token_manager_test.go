@@ -0,0 +1,79 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenManager(t *testing.T) {
+	var (
+		mutex         sync.Mutex
+		requestCounts = make(map[string]int)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appid := r.URL.Query().Get("appid")
+		mutex.Lock()
+		requestCounts[appid]++
+		n := requestCounts[appid]
+		mutex.Unlock()
+		fmt.Fprintf(w, `{"access_token":"%s-token%d","expires_in":7200}`, appid, n)
+	}))
+	defer server.Close()
+
+	refreshed := make(chan string, 10)
+	manager := NewTokenManager(server.Client())
+	manager.Endpoint = &Endpoint{APIBaseURL: server.URL}
+	manager.Workers = 1
+	manager.OnRefresh = func(appid string, status RefreshStatus) { refreshed <- appid }
+	defer manager.Close()
+
+	// 注册之后增加的公众号也会注册到 health
+	health := NewHealthHandler()
+	manager.RegisterHealth(health)
+
+	manager.AddAccount("app1", "secret1")
+	manager.AddAccount("app2", "secret2")
+
+	// 后台调度马上获取所有公众号的 access_token
+	for i := 0; i < 2; i++ {
+		select {
+		case <-refreshed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for refresh")
+		}
+	}
+	for _, appid := range manager.AppIds() {
+		token, err := manager.TokenServer(appid).Token()
+		if err != nil || token != appid+"-token1" {
+			t.Errorf("unexpected token: %q, err: %v", token, err)
+		}
+	}
+
+	manager.RemoveAccount("app1")
+	if manager.TokenServer("app1") != nil {
+		t.Error("app1 should be removed")
+	}
+	if appids := manager.AppIds(); len(appids) != 1 || appids[0] != "app2" {
+		t.Errorf("unexpected appids: %q", appids)
+	}
+	health.mutex.RLock()
+	if len(health.reporters) != 1 || health.reporters["app2/access_token"] == nil {
+		t.Errorf("unexpected health reporters: %v", health.reporters)
+	}
+	health.mutex.RUnlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requestCounts["app1"] != 1 || requestCounts["app2"] != 1 {
+		t.Errorf("unexpected requestCounts: %v", requestCounts)
+	}
+}
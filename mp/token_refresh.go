@@ -0,0 +1,112 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	proactiveRefreshWindow   = time.Minute     // access_token 在这个时间内过期则提前刷新
+	proactiveRefreshInterval = 5 * time.Second // 同一个 TokenServer 两次提前刷新的最小间隔
+)
+
+// 正在进行的一次 TokenRefresh, 同一个 TokenServer 并发的刷新请求共享这一次的结果.
+type tokenRefreshCall struct {
+	done     chan struct{}
+	token    string
+	err      error
+	canceled bool // 发起刷新的调用者的 ctx 结束了, 等待的调用者要自己重新刷新
+}
+
+// 以 TokenServer 为 key 的进程内状态, 刷新完成之后就删除, 不会一直增长.
+var tokenRefreshGroup struct {
+	mutex     sync.Mutex
+	calls     map[TokenServer]*tokenRefreshCall
+	proactive map[TokenServer]time.Time // 最近一次提前刷新的时间
+}
+
+// 调用 srv.TokenRefresh(), 同一个 srv 并发的调用合并为一次.
+//  如果 srv 实现了 ContextTokenServer 则调用 srv.TokenRefreshContext(ctx);
+//  等待别的调用者的刷新的时候 ctx 结束则直接返回, 别的调用者的 ctx 结束导致的失败则重新刷新.
+func refreshToken(ctx context.Context, srv TokenServer) (token string, err error) {
+	// 不能作为 map 的 key 的 TokenServer 无法合并, 直接调用
+	if !reflect.TypeOf(srv).Comparable() {
+		return tokenRefresh(ctx, srv)
+	}
+
+	for {
+		tokenRefreshGroup.mutex.Lock()
+		call := tokenRefreshGroup.calls[srv]
+		if call == nil {
+			break
+		}
+		tokenRefreshGroup.mutex.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if !call.canceled {
+			return call.token, call.err
+		}
+	}
+	if tokenRefreshGroup.calls == nil {
+		tokenRefreshGroup.calls = make(map[TokenServer]*tokenRefreshCall)
+	}
+	call := &tokenRefreshCall{done: make(chan struct{})}
+	tokenRefreshGroup.calls[srv] = call
+	tokenRefreshGroup.mutex.Unlock()
+
+	defer func() {
+		tokenRefreshGroup.mutex.Lock()
+		delete(tokenRefreshGroup.calls, srv)
+		tokenRefreshGroup.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.token, call.err = tokenRefresh(ctx, srv)
+	call.canceled = call.err != nil && ctx.Err() != nil
+	return call.token, call.err
+}
+
+func tokenRefresh(ctx context.Context, srv TokenServer) (token string, err error) {
+	if ctxSrv, ok := srv.(ContextTokenServer); ok {
+		return ctxSrv.TokenRefreshContext(ctx)
+	}
+	return srv.TokenRefresh()
+}
+
+// 在后台提前刷新 srv 的 access_token, 同一个 srv 在 proactiveRefreshInterval 内只刷新一次.
+func refreshTokenAhead(srv TokenServer) {
+	if !reflect.TypeOf(srv).Comparable() {
+		return
+	}
+
+	now := time.Now()
+
+	tokenRefreshGroup.mutex.Lock()
+	if tokenRefreshGroup.calls[srv] != nil || now.Sub(tokenRefreshGroup.proactive[srv]) < proactiveRefreshInterval {
+		tokenRefreshGroup.mutex.Unlock()
+		return
+	}
+	if tokenRefreshGroup.proactive == nil {
+		tokenRefreshGroup.proactive = make(map[TokenServer]time.Time)
+	}
+	for key, t := range tokenRefreshGroup.proactive { // 清理过期的记录
+		if now.Sub(t) >= proactiveRefreshInterval {
+			delete(tokenRefreshGroup.proactive, key)
+		}
+	}
+	tokenRefreshGroup.proactive[srv] = now
+	tokenRefreshGroup.mutex.Unlock()
+
+	go refreshToken(context.Background(), srv)
+}
@@ -0,0 +1,112 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 并发安全的测试用 ExpiringTokenServer, TokenRefresh 比较慢.
+type slowTokenServer struct {
+	mutex        sync.Mutex
+	token        string
+	expiresAt    time.Time
+	refreshCount int
+}
+
+func (srv *slowTokenServer) Token() (string, error) {
+	token, _, err := srv.TokenWithExpiry()
+	return token, err
+}
+
+func (srv *slowTokenServer) TokenWithExpiry() (string, time.Time, error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.token, srv.expiresAt, nil
+}
+
+func (srv *slowTokenServer) TokenRefresh() (string, error) {
+	time.Sleep(50 * time.Millisecond)
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.refreshCount++
+	srv.token = "new_token"
+	srv.expiresAt = time.Now().Add(time.Hour)
+	return srv.token, nil
+}
+
+func (srv *slowTokenServer) count() int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.refreshCount
+}
+
+func TestWechatClientConcurrentTokenRefresh(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "new_token" {
+			io.WriteString(w, `{"errcode":40001,"errmsg":"invalid credential"}`)
+			return
+		}
+		io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+	}))
+	defer server.Close()
+
+	tokenServer := &slowTokenServer{token: "old_token", expiresAt: time.Now().Add(time.Hour)}
+	clt := &WechatClient{
+		TokenServer: tokenServer,
+		HttpClient:  server.Client(),
+		Endpoint:    &Endpoint{APIBaseURL: server.URL},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var result Error
+			if err := clt.GetJSON("https://api.weixin.qq.com/cgi-bin/test?access_token=", &result); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := tokenServer.count(); n != 1 {
+		t.Errorf("refreshCount mismatch, have: %d, want: 1", n)
+	}
+}
+
+func TestWechatClientProactiveTokenRefresh(t *testing.T) {
+	tokenServer := &slowTokenServer{token: "old_token", expiresAt: time.Now().Add(10 * time.Second)}
+	clt := &WechatClient{TokenServer: tokenServer}
+
+	for i := 0; i < 10; i++ {
+		token, err := clt.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "old_token" {
+			t.Fatalf("token mismatch, have: %s, want: old_token", token)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for tokenServer.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tokenServer.count(); n != 1 {
+		t.Errorf("refreshCount mismatch, have: %d, want: 1", n)
+	}
+	if token, _ := clt.Token(); token != "new_token" {
+		t.Errorf("token mismatch, have: %s, want: new_token", token)
+	}
+}
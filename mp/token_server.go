@@ -5,6 +5,11 @@
 
 package mp
 
+import (
+	"context"
+	"time"
+)
+
 // access_token 中控服务器接口, see token_server.png.
 type TokenServer interface {
 	// 从中控服务器获取 access_token, 该 access_token 一般缓存在某个地方.
@@ -14,3 +19,35 @@ type TokenServer interface {
 	// 建议从微信服务器获取一次 access_token 之后的5秒内再次调用该函数不再获取, 而是直接返回之前的结果.
 	TokenRefresh() (token string, err error)
 }
+
+// 可以同时返回 access_token 过期时间的 TokenServer.
+//  WechatClient 发现 access_token 快要过期的时候会在后台提前调用 TokenRefresh,
+//  DefaultTokenServer, DistributedTokenServer, ManagedTokenServer 都实现了这个接口.
+type ExpiringTokenServer interface {
+	TokenServer
+
+	// 同 Token, expiresAt 是 access_token 的过期时间(已经减去了缓冲的时间);
+	// 不知道过期时间则返回零值, 这个时候不会提前刷新.
+	TokenWithExpiry() (token string, expiresAt time.Time, err error)
+}
+
+// 支持 context 的 ExpiringTokenServer, 需要从微信服务器获取 access_token 的时候请求绑定到 ctx 上.
+//  WechatClient 获取和刷新 access_token 的时候会传入自己的 context(参考 WechatClient.WithContext),
+//  这样调用者的取消和超时对获取 access_token 也有效;
+//  DefaultTokenServer, DistributedTokenServer, ManagedTokenServer 都实现了这个接口.
+type ContextTokenServer interface {
+	ExpiringTokenServer
+
+	// 同 TokenWithExpiry, 需要获取 access_token 的时候请求绑定到 ctx 上.
+	TokenWithExpiryContext(ctx context.Context) (token string, expiresAt time.Time, err error)
+
+	// 同 TokenRefresh, 请求绑定到 ctx 上.
+	TokenRefreshContext(ctx context.Context) (token string, err error)
+}
+
+// access_token, jsapi_ticket 等凭证的一次刷新结果, 参考 DefaultTokenServer.Notify.
+type RefreshEvent struct {
+	Time      time.Time     // 刷新的时间
+	ExpiresIn time.Duration // 刷新成功时凭证的有效期, 已经减去了缓冲的时间
+	Err       error         // 刷新失败时的错误, 成功为 nil
+}
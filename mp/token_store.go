@@ -0,0 +1,108 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package mp
+
+import (
+	"sync"
+	"time"
+)
+
+// 缓存的 access_token.
+type TokenEntry struct {
+	Token     string    `json:"access_token"`
+	ExpiresAt time.Time `json:"expires_at"` // 过期时间, 已经减去了缓冲的时间
+}
+
+// access_token 在 now 时刻是否有效.
+func (entry *TokenEntry) Valid(now time.Time) bool {
+	return entry != nil && entry.Token != "" && now.Before(entry.ExpiresAt)
+}
+
+// 多个进程(副本)共享的 access_token 存储, 参考 DistributedTokenServer.
+//  key 一般是公众号的 appid, 这样多个公众号可以共享一个 TokenStore.
+//  实现必须是并发安全的, 并且对于多个进程是原子的.
+type TokenStore interface {
+	// 读取 key 对应的 access_token, 没有则返回 nil, nil.
+	Load(key string) (entry *TokenEntry, err error)
+
+	// 保存 key 对应的 access_token.
+	Save(key string, entry *TokenEntry) error
+
+	// 尝试获取 key 的刷新租约, 租约在 ttl 之后自动失效;
+	// 如果租约被别的 owner 持有并且没有失效则返回 false, nil;
+	// 同一个 owner 重复获取则续期.
+	AcquireLease(key, owner string, ttl time.Duration) (ok bool, err error)
+
+	// 释放 owner 持有的 key 的租约, 如果租约不是 owner 持有的则什么都不做.
+	ReleaseLease(key, owner string) error
+}
+
+type tokenLease struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// 租约是否可以被 owner 获取.
+func (lease *tokenLease) available(owner string, now time.Time) bool {
+	return lease.Owner == "" || lease.Owner == owner || !now.Before(lease.ExpiresAt)
+}
+
+var _ TokenStore = new(MemoryTokenStore)
+
+// 进程内存里的 TokenStore, 一般用于测试, 或者单进程里多个 DistributedTokenServer 共享.
+//  零值可以直接使用.
+type MemoryTokenStore struct {
+	mutex   sync.Mutex
+	entries map[string]TokenEntry
+	leases  map[string]tokenLease
+}
+
+func (store *MemoryTokenStore) Load(key string) (entry *TokenEntry, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if e, ok := store.entries[key]; ok {
+		entry = &e
+	}
+	return
+}
+
+func (store *MemoryTokenStore) Save(key string, entry *TokenEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.entries == nil {
+		store.entries = make(map[string]TokenEntry)
+	}
+	store.entries[key] = *entry
+	return nil
+}
+
+func (store *MemoryTokenStore) AcquireLease(key, owner string, ttl time.Duration) (ok bool, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	lease := store.leases[key]
+	if !lease.available(owner, now) {
+		return false, nil
+	}
+	if store.leases == nil {
+		store.leases = make(map[string]tokenLease)
+	}
+	store.leases[key] = tokenLease{Owner: owner, ExpiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (store *MemoryTokenStore) ReleaseLease(key, owner string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if lease, ok := store.leases[key]; ok && lease.Owner == owner {
+		delete(store.leases, key)
+	}
+	return nil
+}
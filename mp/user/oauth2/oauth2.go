@@ -6,6 +6,7 @@
 package oauth2
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -36,6 +37,9 @@ type Client struct {
 	*OAuth2Token // 程序会自动更新最新的 OAuth2Token 到这个字段, 如有必要该字段可以保存起来
 
 	HttpClient *http.Client // 如果 httpClient == nil 则默认用 http.DefaultClient
+	Endpoint   *mp.Endpoint // 如果 Endpoint == nil 则默认用 mp.DefaultEndpoint
+
+	ctx context.Context // 通过 WithContext 设置
 }
 
 func (clt *Client) httpClient() *http.Client {
@@ -45,6 +49,39 @@ func (clt *Client) httpClient() *http.Client {
 	return http.DefaultClient
 }
 
+// 获取 Client 的 context.
+//  如果没有通过 WithContext 设置, 则返回 context.Background().
+func (clt *Client) Context() context.Context {
+	if clt.ctx != nil {
+		return clt.ctx
+	}
+	return context.Background()
+}
+
+// 返回 clt 的一个浅拷贝, 该拷贝发起的所有请求都绑定到 ctx 上.
+//  NOTE: 拷贝和 clt 共享同一个 OAuth2Token.
+func (clt *Client) WithContext(ctx context.Context) *Client {
+	if ctx == nil {
+		panic("oauth2: nil context")
+	}
+	clt2 := *clt
+	clt2.ctx = ctx
+	return &clt2
+}
+
+// GET url, 请求绑定到 clt.Context() 上, url 会根据 Endpoint 替换为最终的地址.
+func (clt *Client) httpGet(url string) (*http.Response, error) {
+	endpoint := clt.Endpoint
+	if endpoint == nil {
+		endpoint = mp.DefaultEndpoint
+	}
+	httpReq, err := http.NewRequestWithContext(clt.Context(), "GET", endpoint.ResolveURL(url), nil)
+	if err != nil {
+		return nil, err
+	}
+	return clt.httpClient().Do(httpReq)
+}
+
 // 通过code换取网页授权 access_token.
 //  NOTE:
 //  1. Client 需要指定 OAuth2Config
@@ -112,7 +149,7 @@ func (clt *Client) CheckAccessTokenValid() (valid bool, err error) {
 		return
 	}
 
-	httpResp, err := clt.httpClient().Get(checkAccessTokenValidURL(clt.AccessToken, clt.OpenId))
+	httpResp, err := clt.httpGet(checkAccessTokenValidURL(clt.AccessToken, clt.OpenId))
 	if err != nil {
 		return
 	}
@@ -142,7 +179,7 @@ func (clt *Client) CheckAccessTokenValid() (valid bool, err error) {
 
 // 从服务器获取新的 token 更新 tk
 func (clt *Client) updateToken(tk *OAuth2Token, url string) (err error) {
-	httpResp, err := clt.httpClient().Get(url)
+	httpResp, err := clt.httpGet(url)
 	if err != nil {
 		return
 	}
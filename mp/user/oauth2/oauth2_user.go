@@ -121,7 +121,7 @@ func (clt *Client) UserInfo(lang string) (info *UserInfo, err error) {
 		return
 	}
 
-	httpResp, err := clt.httpClient().Get(userInfoURL(clt.AccessToken, clt.OpenId, lang))
+	httpResp, err := clt.httpGet(userInfoURL(clt.AccessToken, clt.OpenId, lang))
 	if err != nil {
 		return
 	}
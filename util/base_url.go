@@ -0,0 +1,41 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"strings"
+)
+
+// 如果 rawURL 的 host 等于 host(不区分 http 和 https), 则把 rawURL 的 scheme://host 部分
+// 替换为 baseURL, 否则原样返回 rawURL.
+//  baseURL 为空则原样返回 rawURL, baseURL 末尾的 '/' 会被忽略.
+//
+//  ReplaceBaseURL("https://api.weixin.qq.com/cgi-bin/token?a=b", "api.weixin.qq.com", "http://127.0.0.1:8080")
+//  == "http://127.0.0.1:8080/cgi-bin/token?a=b"
+func ReplaceBaseURL(rawURL, host, baseURL string) string {
+	if baseURL == "" {
+		return rawURL
+	}
+
+	var rest string
+	switch {
+	case strings.HasPrefix(rawURL, "https://"):
+		rest = rawURL[len("https://"):]
+	case strings.HasPrefix(rawURL, "http://"):
+		rest = rawURL[len("http://"):]
+	default:
+		return rawURL
+	}
+
+	if !strings.HasPrefix(rest, host) {
+		return rawURL
+	}
+	rest = rest[len(host):]
+	if rest != "" && rest[0] != '/' && rest[0] != '?' {
+		return rawURL // 比如 host 是 rest 的 host 的前缀
+	}
+	return strings.TrimRight(baseURL, "/") + rest
+}
@@ -0,0 +1,119 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// 回调请求的签名验证失败, 包括签名的长度不对.
+type SignatureError struct {
+	Name  string // 签名参数的名称, 比如 signature, msg_signature, sign
+	Input string // 请求里的签名
+	Local string // 本地计算的签名, 为空表示请求里的签名长度不对, 没有计算; 不会出现在 Error() 里
+}
+
+func (e *SignatureError) Error() string {
+	if e.Local == "" {
+		return fmt.Sprintf("the length of %s mismatch, have: %d, want: 40", e.Name, len(e.Input))
+	}
+	// 不输出 Local, 本地计算的签名可以用来伪造请求, 不能出现在日志或者响应里
+	return fmt.Sprintf("check %s failed, input: %s", e.Name, e.Input)
+}
+
+// 回调请求的方法不被支持.
+type MethodNotAllowedError struct {
+	Method string
+	Allow  []string // 支持的方法
+}
+
+func (e *MethodNotAllowedError) Error() string {
+	return fmt.Sprintf("the request method %s is not allowed, allow: %s", e.Method, strings.Join(e.Allow, ", "))
+}
+
+// 如果 method 不在 allow 里面则返回 *MethodNotAllowedError.
+func CheckMethod(method string, allow ...string) error {
+	for _, m := range allow {
+		if method == m {
+			return nil
+		}
+	}
+	return &MethodNotAllowedError{Method: method, Allow: allow}
+}
+
+// 无效的回调请求对应的 HTTP 状态码, 通过 errors.As 判断, 所以包装过的错误也可以:
+//  *MethodNotAllowedError 是 405, *RequestBodyTooLargeError 是 413,
+//  *SignatureError, *TimestampSkewError, *ReplayError 是 403,
+//  *ServerNotFoundError 是 404, *ServerResolveError 是 503,
+//  其他的(比如查询参数或者 http body 格式错误)都是 400.
+func InvalidRequestStatusCode(err error) int {
+	var (
+		methodErr    *MethodNotAllowedError
+		signatureErr *SignatureError
+		skewErr      *TimestampSkewError
+		replayErr    *ReplayError
+		tooLargeErr  *RequestBodyTooLargeError
+		notFoundErr  *ServerNotFoundError
+		resolveErr   *ServerResolveError
+	)
+	switch {
+	case errors.As(err, &methodErr):
+		return http.StatusMethodNotAllowed
+	case errors.As(err, &signatureErr), errors.As(err, &skewErr), errors.As(err, &replayErr):
+		return http.StatusForbidden
+	case errors.As(err, &tooLargeErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &notFoundErr):
+		return http.StatusNotFound
+	case errors.As(err, &resolveErr):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// 调用 serve 处理无效的回调请求, 如果 serve 没有写入响应则写入 InvalidRequestStatusCode(err).
+//  *MethodNotAllowedError 在调用 serve 之前设置 Allow header.
+func ServeInvalidRequestStatus(w http.ResponseWriter, err error, serve func(w http.ResponseWriter)) {
+	var methodErr *MethodNotAllowedError
+	if errors.As(err, &methodErr) {
+		w.Header().Set("Allow", strings.Join(methodErr.Allow, ", "))
+	}
+
+	sw := &statusResponseWriter{ResponseWriter: w}
+	serve(sw)
+	if !sw.wroteHeader {
+		w.WriteHeader(InvalidRequestStatusCode(err))
+	}
+}
+
+// 记录是否已经写入了响应.
+//  实现了 http.Flusher, 这样 serve 里面的 w.(http.Flusher) 不会因为包装而失效.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush 会写入 200 的 header, 所以也算写入了响应; 底层的 ResponseWriter 不是 http.Flusher 则什么都不做.
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,67 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInvalidRequestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&MethodNotAllowedError{Method: "PUT"}, http.StatusMethodNotAllowed},
+		{&SignatureError{Name: "signature"}, http.StatusForbidden},
+		{&TimestampSkewError{}, http.StatusForbidden},
+		{&ReplayError{}, http.StatusForbidden},
+		{&RequestBodyTooLargeError{}, http.StatusRequestEntityTooLarge},
+		{&ServerNotFoundError{}, http.StatusNotFound},
+		{&ServerResolveError{Err: errors.New("timeout")}, http.StatusServiceUnavailable},
+		{errors.New("bad query"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if have := InvalidRequestStatusCode(tt.err); have != tt.want {
+			t.Errorf("InvalidRequestStatusCode(%T) mismatch, have: %d, want: %d", tt.err, have, tt.want)
+		}
+		// 包装过的错误也一样
+		if have := InvalidRequestStatusCode(fmt.Errorf("wrapped: %w", tt.err)); have != tt.want {
+			t.Errorf("InvalidRequestStatusCode(wrapped %T) mismatch, have: %d, want: %d", tt.err, have, tt.want)
+		}
+	}
+}
+
+func TestServeInvalidRequestStatus(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &MethodNotAllowedError{Method: "PUT", Allow: []string{"GET", "POST"}})
+	w := httptest.NewRecorder()
+	ServeInvalidRequestStatus(w, err, func(http.ResponseWriter) {})
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("have status %d, Allow: %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	// serve 通过 http.Flusher 写入了响应, 不再写入状态码
+	w = httptest.NewRecorder()
+	ServeInvalidRequestStatus(w, &ReplayError{}, func(w http.ResponseWriter) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the ResponseWriter is not a http.Flusher")
+		}
+		flusher.Flush()
+	})
+	if w.Code != http.StatusOK || !w.Flushed {
+		t.Errorf("have status %d, flushed: %t", w.Code, w.Flushed)
+	}
+
+	w = httptest.NewRecorder()
+	ServeInvalidRequestStatus(w, &ReplayError{}, func(http.ResponseWriter) {})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("have status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,100 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 默认的延迟直方图的桶(上界), 覆盖了微信服务器 5 秒的超时.
+var DefaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// 记录延迟, label 一般是消息类型, 比如 "text", "event:subscribe".
+//  实现必须是并发安全的; 可以很容易的适配到 prometheus 的 HistogramVec 等.
+type LatencyObserver interface {
+	ObserveLatency(label string, latency time.Duration)
+}
+
+// 延迟直方图某个 label 的快照.
+type LatencySnapshot struct {
+	Buckets []time.Duration // 每个桶的上界
+	Counts  []uint64        // 落在每个桶的次数(非累计), 比 Buckets 多一个, 最后一个是超过所有上界的次数
+	Count   uint64          // 总次数
+	Sum     time.Duration   // 总延迟
+}
+
+var _ LatencyObserver = new(LatencyHistogram)
+
+// 按 label 分组的进程内的延迟直方图, 并发安全.
+type LatencyHistogram struct {
+	buckets []time.Duration
+
+	mutex  sync.Mutex
+	series map[string]*LatencySnapshot
+}
+
+// 创建一个新的 LatencyHistogram, 如果 buckets 为空则使用 DefaultLatencyBuckets.
+func NewLatencyHistogram(buckets []time.Duration) *LatencyHistogram {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]time.Duration(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	return &LatencyHistogram{
+		buckets: buckets,
+		series:  make(map[string]*LatencySnapshot),
+	}
+}
+
+func (h *LatencyHistogram) ObserveLatency(label string, latency time.Duration) {
+	i := sort.Search(len(h.buckets), func(i int) bool { return latency <= h.buckets[i] })
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s := h.series[label]
+	if s == nil {
+		s = &LatencySnapshot{
+			Buckets: h.buckets,
+			Counts:  make([]uint64, len(h.buckets)+1),
+		}
+		h.series[label] = s
+	}
+	s.Counts[i]++
+	s.Count++
+	s.Sum += latency
+}
+
+// 返回所有 label 的快照.
+func (h *LatencyHistogram) Snapshot() map[string]LatencySnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	snapshot := make(map[string]LatencySnapshot, len(h.series))
+	for label, s := range h.series {
+		snapshot[label] = LatencySnapshot{
+			Buckets: s.Buckets,
+			Counts:  append([]uint64(nil), s.Counts...),
+			Count:   s.Count,
+			Sum:     s.Sum,
+		}
+	}
+	return snapshot
+}
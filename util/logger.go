@@ -0,0 +1,141 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// 日志的级别.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(level))
+	}
+}
+
+// 结构化日志的字段, 比如 LogField{"appid", appId}.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// 日志接口, mp 和 corp 的 frontend, server 和 client 都通过它输出日志, 默认不输出任何日志.
+//  实现必须是并发安全的; 可以很容易的适配到 log/slog, zap, logrus 等.
+//  NOTE: SDK 不会把消息的内容和 access_token 等密钥作为字段传入, 但是实现最好还是对敏感字段做脱敏处理,
+//  参考 RedactLogField.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// 不输出任何日志的 Logger.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, ...LogField) {}
+
+// 需要脱敏的字段的 key(小写).
+var redactedLogKeys = map[string]bool{
+	"token":          true,
+	"access_token":   true,
+	"ticket":         true,
+	"secret":         true,
+	"appsecret":      true,
+	"signature":      true,
+	"msg_signature":  true,
+	"aes_key":        true,
+	"encodingaeskey": true,
+	"echostr":        true,
+	"body":           true,
+	"content":        true,
+	"raw_xml":        true,
+	"encrypt":        true,
+}
+
+// 如果 field 是密钥或者消息内容(比如 access_token, signature, body, content), 则返回把值替换为 "[REDACTED]" 的 field,
+// 否则原样返回.
+func RedactLogField(field LogField) LogField {
+	if redactedLogKeys[strings.ToLower(field.Key)] {
+		field.Value = "[REDACTED]"
+	}
+	return field
+}
+
+var _ Logger = new(StdLogger)
+
+// 基于标准库 log.Logger 的 Logger, 输出 "LEVEL msg key=value ..." 格式的一行, 敏感字段会脱敏.
+type StdLogger struct {
+	Logger *log.Logger // 如果 Logger == nil 则输出到 os.Stderr
+	Level  LogLevel    // 低于 Level 的日志不输出
+}
+
+// 创建一个输出到 w 的 StdLogger, 如果 w == nil 则输出到 os.Stderr.
+func NewStdLogger(w io.Writer, level LogLevel) *StdLogger {
+	if w == nil {
+		w = os.Stderr
+	}
+	return &StdLogger{
+		Logger: log.New(w, "", log.LstdFlags),
+		Level:  level,
+	}
+}
+
+var stderrLogger = log.New(os.Stderr, "", log.LstdFlags)
+
+func (l *StdLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if level < l.Level {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(level.String())
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for _, field := range fields {
+		field = RedactLogField(field)
+		buf.WriteByte(' ')
+		buf.WriteString(field.Key)
+		buf.WriteByte('=')
+		value := field.Value
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if s, ok := value.(string); ok && (s == "" || strings.ContainsAny(s, " \t\r\n\"=")) {
+			fmt.Fprintf(&buf, "%q", s)
+		} else {
+			fmt.Fprint(&buf, value)
+		}
+	}
+
+	logger := l.Logger
+	if logger == nil {
+		logger = stderrLogger
+	}
+	logger.Output(2, buf.String())
+}
@@ -0,0 +1,65 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &StdLogger{
+		Logger: log.New(&buf, "", 0),
+		Level:  LogLevelInfo,
+	}
+
+	logger.Log(LogLevelDebug, "ignored")
+	logger.Log(LogLevelWarn, "invalid request",
+		LogField{Key: "appid", Value: "wx123"},
+		LogField{Key: "access_token", Value: "secret-token"},
+		LogField{Key: "Content", Value: "hello"},
+		LogField{Key: "error", Value: errors.New("bad signature")},
+	)
+
+	want := `WARN invalid request appid=wx123 access_token=[REDACTED] Content=[REDACTED] error="bad signature"` + "\n"
+	if have := buf.String(); have != want {
+		t.Errorf("output mismatch,\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestInvalidRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &StdLogger{
+		Logger: log.New(&buf, "", 0),
+		Level:  LogLevelDebug,
+	}
+
+	served := false
+	handler := WithInvalidRequestLogger(InvalidRequestHandlerFunc(func(http.ResponseWriter, *http.Request, error) {
+		served = true
+	}), logger, LogField{Key: "appid", Value: "wx123"})
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+	handler.ServeInvalidRequest(httptest.NewRecorder(), r, &SignatureError{Name: "signature", Input: "input", Local: "local"})
+	if !served {
+		t.Error("the handler is not called")
+	}
+
+	want := `WARN invalid request appid=wx123 method=POST remote_addr=1.2.3.4:5678 error="check signature failed, input: input"` + "\n"
+	if have := buf.String(); have != want {
+		t.Errorf("output mismatch,\nhave: %q\nwant: %q", have, want)
+	}
+
+	if WithInvalidRequestLogger(nil, NopLogger) != nil {
+		t.Error("NopLogger should not wrap the handler")
+	}
+}
@@ -0,0 +1,115 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+)
+
+// mp, corp, pay 的 RecoverMiddleware 和 TimeoutMiddleware 的公共实现, 它们只负责把 Request 绑定到 serve 上.
+
+// 调用 serve, serve 写入的回复先缓存起来, 正常返回才写入 w.
+//  serve panic 则丢弃已经缓存的回复(w 不会被写入, 即回复空串), 返回 recover 的值, 否则返回 nil.
+func ServeRecover(w http.ResponseWriter, serve func(w http.ResponseWriter)) (recovered interface{}) {
+	bw := newBufferedResponseWriter()
+	defer func() {
+		if recovered = recover(); recovered == nil {
+			bw.writeTo(w)
+		}
+	}()
+	serve(bw)
+	return
+}
+
+// 在另外一个 goroutine 里调用 serve, serve 写入的回复先缓存起来, ctx 结束之前完成才写入 w,
+// 否则 w 不会被写入(即回复空串), 之后 serve 的写入都返回 ctx.Err().
+//  serve 按时完成的 panic 会在当前 goroutine 里重新抛出, 超时之后的 panic 会被忽略.
+func ServeTimeout(ctx context.Context, w http.ResponseWriter, serve func(w http.ResponseWriter)) {
+	bw := newBufferedResponseWriter()
+	panicChan := make(chan interface{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				panicChan <- v
+			}
+			close(done)
+		}()
+		serve(bw)
+	}()
+
+	select {
+	case <-done:
+		select {
+		case v := <-panicChan:
+			panic(v)
+		default:
+		}
+		bw.writeTo(w)
+	case <-ctx.Done():
+		bw.discard(ctx.Err())
+	}
+}
+
+// 缓存回复的 http.ResponseWriter, 调用 writeTo 才写入真正的 http.ResponseWriter.
+type bufferedResponseWriter struct {
+	mutex  sync.Mutex
+	header http.Header
+	body   bytes.Buffer
+	code   int
+	err    error // discard 之后的写入返回这个错误
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: make(http.Header)}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.body.Write(p)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil || w.code != 0 {
+		return
+	}
+	w.code = code
+}
+
+// 丢弃缓存的回复, 之后的写入都返回 err.
+func (w *bufferedResponseWriter) discard(err error) {
+	w.mutex.Lock()
+	w.err = err
+	w.body.Reset()
+	w.mutex.Unlock()
+}
+
+// 把缓存的回复写入 dst.
+func (w *bufferedResponseWriter) writeTo(dst http.ResponseWriter) {
+	dstHeader := dst.Header()
+	for key, values := range w.header {
+		dstHeader[key] = values
+	}
+	if w.code != 0 {
+		dst.WriteHeader(w.code)
+	}
+	dst.Write(w.body.Bytes())
+}
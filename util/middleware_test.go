@@ -0,0 +1,71 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeRecover(t *testing.T) {
+	w := httptest.NewRecorder()
+	v := ServeRecover(w, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, "<xml>")
+		panic("boom")
+	})
+	if v != "boom" {
+		t.Errorf("recovered mismatch, have: %v, want: boom", v)
+	}
+	if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Errorf("partial reply should be discarded, have: %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	v = ServeRecover(w, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "<xml></xml>")
+	})
+	if v != nil || w.Code != http.StatusAccepted || w.Body.String() != "<xml></xml>" || w.Header().Get("Content-Type") != "text/xml" {
+		t.Errorf("recovered: %v, code: %d, body: %q", v, w.Code, w.Body.String())
+	}
+}
+
+func TestServeTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	release := make(chan struct{})
+	writeErr := make(chan error, 1)
+	w := httptest.NewRecorder()
+	ServeTimeout(ctx, w, func(w http.ResponseWriter) {
+		io.WriteString(w, "partial")
+		<-release
+		_, err := io.WriteString(w, "reply")
+		writeErr <- err
+	})
+	close(release)
+	if w.Body.Len() != 0 {
+		t.Errorf("timed out serve should reply empty, have: %q", w.Body.String())
+	}
+	if err := <-writeErr; err != context.DeadlineExceeded {
+		t.Errorf("write after timeout mismatch, have: %v, want: %v", err, context.DeadlineExceeded)
+	}
+
+	defer func() {
+		if v := recover(); v != "boom" {
+			t.Errorf("panic mismatch, have: %v, want: boom", v)
+		}
+	}()
+	ServeTimeout(context.Background(), httptest.NewRecorder(), func(w http.ResponseWriter) {
+		panic("boom")
+	})
+}
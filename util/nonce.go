@@ -0,0 +1,34 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+)
+
+// 生成一个随机的 nonce, 16 个十六进制字符.
+//  NOTE: crypto/rand 出错的时候 panic, 这时候系统的随机数已经不可用, 不能生成可预测的 nonce.
+func NewNonce() string {
+	b := make([]byte, 8)
+	readRandom(b)
+	return hex.EncodeToString(b)
+}
+
+// 生成 AES 加密消息用的 16 字节的 random, 参考 AESEncryptMsg.
+//  NOTE: crypto/rand 出错的时候 panic, 同 NewNonce.
+func NewAESRandom() []byte {
+	random := make([]byte, 16)
+	readRandom(random)
+	return random
+}
+
+func readRandom(b []byte) {
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic("util: crypto/rand failed: " + err.Error())
+	}
+}
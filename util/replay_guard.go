@@ -0,0 +1,242 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxTimestampSkew = 5 * time.Minute // ReplayGuard.MaxSkew 的建议值
+	defaultNonceTTL         = 10 * time.Minute
+)
+
+// 回调请求的 timestamp 和本地时间相差太多.
+type TimestampSkewError struct {
+	Timestamp int64         // 请求的 timestamp
+	Now       int64         // 本地的时间戳
+	MaxSkew   time.Duration // 允许的最大偏差
+}
+
+func (e *TimestampSkewError) Error() string {
+	return fmt.Sprintf("timestamp skew too large, timestamp: %d, now: %d, max skew: %s", e.Timestamp, e.Now, e.MaxSkew)
+}
+
+// 回调请求的 timestamp 和 nonce 已经处理过了, 一般是重放攻击.
+type ReplayError struct {
+	Timestamp int64
+	Nonce     string
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("replayed request, timestamp: %d, nonce: %s", e.Timestamp, e.Nonce)
+}
+
+// 记录处理过的 nonce, 用于防重放.
+//  实现必须是并发安全的; 多个进程处理同一个回调 URL 的时候要使用多个进程共享的实现, 比如 SQLNonceCache.
+type NonceCache interface {
+	// 如果 key 在 ttl 之内没有添加过, 则添加并返回 true, 否则返回 false.
+	//  NOTE: 检查和添加必须是原子的.
+	Add(key string, ttl time.Duration) (added bool, err error)
+}
+
+// 回调请求的防重放检查: 检查 timestamp 和本地时间的偏差, 并且通过 NonceCache 拒绝处理过的 nonce.
+//  零值不做任何检查.
+//
+//  NOTE: 微信服务器 5 秒内收不到回复会用同样的 timestamp 和 nonce 重试, 这种重试和重放完全一样, 默认都会被拒绝;
+//  需要处理重试的话设置 AllowRedelivery, 参考 CheckBody.
+type ReplayGuard struct {
+	// timestamp 和本地时间允许的最大偏差, <= 0 表示不检查, 一般设置为 DefaultMaxTimestampSkew.
+	MaxSkew time.Duration
+
+	// 记录处理过的 nonce, nil 表示不检查 nonce.
+	//  nonce 的保存时间是 2*MaxSkew(MaxSkew <= 0 的时候是 10 分钟), 超过这个时间的请求会被 MaxSkew 拒绝.
+	NonceCache NonceCache
+
+	// CheckBody 是否放行 timestamp, nonce 和 body 都和之前一样的请求(微信服务器的重试), 默认 false 即拒绝.
+	//  NOTE: 放行的请求也可能是截获的请求的重放, 设置为 true 的时候后面的 Handler 必须去重, 比如 mp.DedupHandler.
+	AllowRedelivery bool
+
+	now func() time.Time // 测试用
+}
+
+// 创建一个 ReplayGuard, 如果 nonceCache == nil 则使用容量为 10000 的 MemoryNonceCache.
+func NewReplayGuard(maxSkew time.Duration, nonceCache NonceCache) *ReplayGuard {
+	if nonceCache == nil {
+		nonceCache = NewMemoryNonceCache(10000)
+	}
+	return &ReplayGuard{
+		MaxSkew:    maxSkew,
+		NonceCache: nonceCache,
+	}
+}
+
+// 检查一个已经通过签名验证的请求, namespace 用于区分不同的公众号(企业号应用), 一般是原始ID.
+//  返回的错误是 *TimestampSkewError, *ReplayError 或者 NonceCache 的错误.
+func (guard *ReplayGuard) Check(namespace string, timestamp int64, nonce string) error {
+	if guard == nil {
+		return nil
+	}
+	if err := guard.checkSkew(timestamp); err != nil {
+		return err
+	}
+	if guard.NonceCache == nil {
+		return nil
+	}
+	added, err := guard.NonceCache.Add(nonceKey(namespace, timestamp, nonce), guard.nonceTTL())
+	if err != nil {
+		return err
+	}
+	if !added {
+		return &ReplayError{
+			Timestamp: timestamp,
+			Nonce:     nonce,
+		}
+	}
+	return nil
+}
+
+// 检查一个已经通过签名验证的请求, body 一般是整个 http body, 或者安全模式下签名的密文.
+//  如果 AllowRedelivery == false(默认) 则同 Check, 拒绝任何重复的 timestamp 和 nonce;
+//  否则放行 timestamp, nonce 和 body 都和之前一样的请求, 只拒绝 timestamp 和 nonce 一样但是 body 不一样的请求.
+func (guard *ReplayGuard) CheckBody(namespace string, timestamp int64, nonce string, body []byte) error {
+	if guard == nil {
+		return nil
+	}
+	if !guard.AllowRedelivery {
+		return guard.Check(namespace, timestamp, nonce)
+	}
+	if err := guard.checkSkew(timestamp); err != nil {
+		return err
+	}
+	if guard.NonceCache == nil {
+		return nil
+	}
+
+	ttl := guard.nonceTTL()
+	key := nonceKey(namespace, timestamp, nonce)
+	bodyHash := sha1.Sum(body)
+
+	// 先记录 timestamp+nonce+body, 没有添加说明是完全一样的请求, 放行;
+	// 然后记录 timestamp+nonce, 没有添加说明同样的 timestamp 和 nonce 用在了不同的 body 上.
+	added, err := guard.NonceCache.Add(key+":"+hex.EncodeToString(bodyHash[:]), ttl)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return nil
+	}
+	if added, err = guard.NonceCache.Add(key, ttl); err != nil {
+		return err
+	}
+	if !added {
+		return &ReplayError{
+			Timestamp: timestamp,
+			Nonce:     nonce,
+		}
+	}
+	return nil
+}
+
+func (guard *ReplayGuard) checkSkew(timestamp int64) error {
+	if guard.MaxSkew <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if guard.now != nil {
+		now = guard.now()
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > guard.MaxSkew {
+		return &TimestampSkewError{
+			Timestamp: timestamp,
+			Now:       now.Unix(),
+			MaxSkew:   guard.MaxSkew,
+		}
+	}
+	return nil
+}
+
+func (guard *ReplayGuard) nonceTTL() time.Duration {
+	if guard.MaxSkew > 0 {
+		return 2 * guard.MaxSkew
+	}
+	return defaultNonceTTL
+}
+
+func nonceKey(namespace string, timestamp int64, nonce string) string {
+	return fmt.Sprintf("%s:%d:%s", namespace, timestamp, nonce)
+}
+
+var _ NonceCache = new(MemoryNonceCache)
+
+// 进程内存里的 NonceCache, 超过容量的时候淘汰最久没有访问(添加或者命中)的 key, 即 LRU.
+//  NOTE: 被淘汰的 nonce 可以被重放, 所以容量要大于 2*MaxSkew 时间内的请求数.
+type MemoryNonceCache struct {
+	mutex    sync.Mutex
+	capacity int
+	list     *list.List // 按访问时间排序, Front 是最近访问的
+	items    map[string]*list.Element
+}
+
+type nonceCacheItem struct {
+	key       string
+	expiresAt time.Time
+}
+
+// 创建一个新的 MemoryNonceCache, capacity 是最多保存的 key 的数量.
+func NewMemoryNonceCache(capacity int) *MemoryNonceCache {
+	if capacity <= 0 {
+		panic("util: invalid MemoryNonceCache capacity")
+	}
+	return &MemoryNonceCache{
+		capacity: capacity,
+		list:     list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (cache *MemoryNonceCache) Add(key string, ttl time.Duration) (added bool, err error) {
+	now := time.Now()
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// 删除尾部过期的 key, 中间过期的 key 在访问或者淘汰的时候删除
+	for e := cache.list.Back(); e != nil; e = cache.list.Back() {
+		item := e.Value.(*nonceCacheItem)
+		if now.Before(item.expiresAt) {
+			break
+		}
+		cache.list.Remove(e)
+		delete(cache.items, item.key)
+	}
+
+	if e, ok := cache.items[key]; ok {
+		if now.Before(e.Value.(*nonceCacheItem).expiresAt) {
+			cache.list.MoveToFront(e)
+			return false, nil
+		}
+		cache.list.Remove(e) // 过期的 key 可能不在尾部
+		delete(cache.items, key)
+	}
+
+	for cache.list.Len() >= cache.capacity {
+		e := cache.list.Back()
+		cache.list.Remove(e)
+		delete(cache.items, e.Value.(*nonceCacheItem).key)
+	}
+	cache.items[key] = cache.list.PushFront(&nonceCacheItem{key: key, expiresAt: now.Add(ttl)})
+	return true, nil
+}
@@ -0,0 +1,124 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayGuardCheck(t *testing.T) {
+	now := time.Unix(1420000000, 0)
+	guard := NewReplayGuard(time.Minute, NewMemoryNonceCache(2))
+	guard.now = func() time.Time { return now }
+
+	if err := guard.Check("gh_1", now.Unix()-30, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.Check("gh_1", now.Unix()-30, "a"); err == nil {
+		t.Error("replayed nonce should be rejected")
+	} else if _, ok := err.(*ReplayError); !ok {
+		t.Errorf("unexpected error type: %T", err)
+	}
+	// 不同的公众号互不影响
+	if err := guard.Check("gh_2", now.Unix()-30, "a"); err != nil {
+		t.Error(err)
+	}
+	if err := guard.Check("gh_1", now.Unix()+120, "b"); err == nil {
+		t.Error("skewed timestamp should be rejected")
+	} else if _, ok := err.(*TimestampSkewError); !ok {
+		t.Errorf("unexpected error type: %T", err)
+	}
+
+	var zero *ReplayGuard
+	if err := zero.Check("gh_1", 0, "a"); err != nil {
+		t.Errorf("nil ReplayGuard should not check: %v", err)
+	}
+}
+
+func TestMemoryNonceCacheEviction(t *testing.T) {
+	cache := NewMemoryNonceCache(2)
+	for _, key := range []string{"a", "b", "c"} {
+		if added, _ := cache.Add(key, time.Minute); !added {
+			t.Errorf("%s should be added", key)
+		}
+	}
+	if added, _ := cache.Add("c", time.Minute); added {
+		t.Error("c should not be added again")
+	}
+	if added, _ := cache.Add("a", time.Minute); !added {
+		t.Error("a was evicted and should be added")
+	}
+	if added, _ := cache.Add("d", time.Nanosecond); !added {
+		t.Error("d should be added")
+	}
+	time.Sleep(time.Millisecond)
+	if added, _ := cache.Add("d", time.Minute); !added {
+		t.Error("expired d should be added again")
+	}
+}
+
+func TestReplayGuardCheckBody(t *testing.T) {
+	now := time.Unix(1420000000, 0)
+	guard := NewReplayGuard(time.Minute, nil)
+	guard.now = func() time.Time { return now }
+
+	// 默认拒绝完全一样的请求
+	if err := guard.CheckBody("gh_1", now.Unix(), "a", []byte("body1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.CheckBody("gh_1", now.Unix(), "a", []byte("body1")); err == nil {
+		t.Error("verbatim resend should be rejected")
+	} else if _, ok := err.(*ReplayError); !ok {
+		t.Errorf("unexpected error type: %T", err)
+	}
+
+	guard = NewReplayGuard(time.Minute, nil)
+	guard.AllowRedelivery = true
+	guard.now = func() time.Time { return now }
+
+	if err := guard.CheckBody("gh_1", now.Unix(), "a", []byte("body1")); err != nil {
+		t.Fatal(err)
+	}
+	// 微信服务器的重试
+	if err := guard.CheckBody("gh_1", now.Unix(), "a", []byte("body1")); err != nil {
+		t.Errorf("redelivery should be allowed: %v", err)
+	}
+	if err := guard.CheckBody("gh_1", now.Unix(), "a", []byte("body2")); err == nil {
+		t.Error("the same nonce with another body should be rejected")
+	} else if _, ok := err.(*ReplayError); !ok {
+		t.Errorf("unexpected error type: %T", err)
+	}
+	// Check 过的 nonce 不能再用 CheckBody 放行
+	if err := guard.Check("gh_1", now.Unix(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.CheckBody("gh_1", now.Unix(), "b", []byte("body1")); err == nil {
+		t.Error("replayed nonce should be rejected")
+	}
+	if err := guard.CheckBody("gh_1", now.Unix()+120, "c", []byte("body1")); err == nil {
+		t.Error("skewed timestamp should be rejected")
+	} else if _, ok := err.(*TimestampSkewError); !ok {
+		t.Errorf("unexpected error type: %T", err)
+	}
+}
+
+func TestMemoryNonceCacheLRU(t *testing.T) {
+	cache := NewMemoryNonceCache(2)
+	cache.Add("a", time.Minute)
+	cache.Add("b", time.Minute)
+	// 命中 a 之后 b 是最久没有访问的
+	if added, _ := cache.Add("a", time.Minute); added {
+		t.Error("a should not be added again")
+	}
+	cache.Add("c", time.Minute)
+	if added, _ := cache.Add("a", time.Minute); added {
+		t.Error("a was recently used and should not be evicted")
+	}
+	if added, _ := cache.Add("b", time.Minute); !added {
+		t.Error("b was least recently used and should be evicted")
+	}
+}
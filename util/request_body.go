@@ -0,0 +1,45 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// 回调请求 http body 的默认最大长度, 微信服务器推送的消息(事件)和支付通知都远小于这个长度.
+const DefaultMaxRequestBodySize = 256 << 10
+
+// 回调请求的 http body 超过了限制的长度.
+type RequestBodyTooLargeError struct {
+	Limit int64 // 限制的长度
+}
+
+func (e *RequestBodyTooLargeError) Error() string {
+	return fmt.Sprintf("the request body is larger than %d bytes", e.Limit)
+}
+
+// 读取回调请求的 http body, 超过 limit 字节返回 *RequestBodyTooLargeError.
+//  limit <= 0 表示使用 DefaultMaxRequestBodySize; Content-Length 超过 limit 的请求不会读取 body.
+func ReadRequestBody(r *http.Request, limit int64) (body []byte, err error) {
+	if limit <= 0 {
+		limit = DefaultMaxRequestBodySize
+	}
+	if r.ContentLength > limit {
+		return nil, &RequestBodyTooLargeError{Limit: limit}
+	}
+
+	body, err = ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, &RequestBodyTooLargeError{Limit: limit}
+	}
+	return
+}
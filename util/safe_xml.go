@@ -0,0 +1,138 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 回调请求的 XML 允许的最大嵌套深度, 微信服务器推送的消息(事件)最深不超过 5 层.
+const maxXMLDepth = 16
+
+var (
+	ErrXMLDirective = errors.New("xml: DTD and other directives are not allowed")
+	ErrXMLTooDeep   = fmt.Errorf("xml: the nesting depth exceeds %d", maxXMLDepth)
+	ErrXMLNoRoot    = errors.New("xml: no root element")
+)
+
+// 回调请求的 XML 里同一个字段出现了多次.
+type DuplicateXMLFieldError struct {
+	Field string
+}
+
+func (e *DuplicateXMLFieldError) Error() string {
+	return "xml: duplicate field " + e.Field
+}
+
+// 遍历 data 的 token, 拒绝 DTD(<!DOCTYPE ...>, <!ENTITY ...> 等指令), 超过 maxXMLDepth 的嵌套和多个根元素.
+//  Strict 模式下不认识的实体(除了 &lt; 等 5 个预定义实体)都是语法错误, 也不支持非 UTF-8 的编码.
+//  fn 返回 false 则停止遍历.
+func walkXML(data []byte, fn func(token xml.Token, depth int) bool) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = true
+
+	depth := 0
+	hasRoot := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			if !hasRoot {
+				return ErrXMLNoRoot
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch token.(type) {
+		case xml.Directive:
+			return ErrXMLDirective
+		case xml.StartElement:
+			if depth == 0 {
+				if hasRoot {
+					return errors.New("xml: multiple root elements")
+				}
+				hasRoot = true
+			}
+			if depth++; depth > maxXMLDepth {
+				return ErrXMLTooDeep
+			}
+		case xml.EndElement:
+			depth--
+		}
+		if !fn(token, depth) {
+			return nil
+		}
+	}
+}
+
+// 检查 data 是否是安全的回调请求 XML, 参考 UnmarshalXML.
+func CheckXML(data []byte) error {
+	return walkXML(data, func(xml.Token, int) bool { return true })
+}
+
+// 通过 CheckXML 检查之后再 xml.Unmarshal, 用于解析回调请求的 XML.
+func UnmarshalXML(data []byte, v interface{}) error {
+	if err := CheckXML(data); err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// 读取根元素下名字为 names 的子元素的文本, 所有的 names 都读到之后立即停止, 不再解析后面的内容.
+//  NOTE: data 是已经读取的完整 http body, 长度由 ReadRequestBody 限制, 这里只是提前结束 token 的遍历.
+//  用于在验证签名之前只读取验证需要的字段(比如 ToUserName, Encrypt); 没有出现的字段不在 fields 里;
+//  同一个字段出现多次返回 *DuplicateXMLFieldError.
+func ScanXMLFields(data []byte, names ...string) (fields map[string]string, err error) {
+	fields = make(map[string]string, len(names))
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var (
+		current string // 当前正在读取的字段
+		text    []byte
+		dupErr  error
+	)
+	err = walkXML(data, func(token xml.Token, depth int) bool {
+		switch token := token.(type) {
+		case xml.StartElement:
+			if depth != 2 || !wanted[token.Name.Local] {
+				return true
+			}
+			if _, ok := fields[token.Name.Local]; ok {
+				dupErr = &DuplicateXMLFieldError{Field: token.Name.Local}
+				return false
+			}
+			current, text = token.Name.Local, text[:0]
+		case xml.CharData:
+			if current != "" {
+				text = append(text, token...)
+			}
+		case xml.EndElement:
+			if depth != 1 || current == "" {
+				return true
+			}
+			fields[current] = string(text)
+			current = ""
+			return len(fields) < len(wanted)
+		}
+		return true
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
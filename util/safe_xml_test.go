@@ -0,0 +1,61 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScanXMLFields(t *testing.T) {
+	// 读到 ToUserName 和 Encrypt 之后就停止, 后面的非法内容不会被解析
+	data := "<xml><ToUserName><![CDATA[gh_id]]></ToUserName><Encrypt>abc</Encrypt><Nested><ToUserName>x</ToUserName></Nested></xml><bad"
+	fields, err := ScanXMLFields([]byte(data), "ToUserName", "Encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["ToUserName"] != "gh_id" || fields["Encrypt"] != "abc" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+
+	if _, err = ScanXMLFields([]byte("<xml><Encrypt>a</Encrypt><Encrypt>b</Encrypt></xml>"), "Encrypt", "ToUserName"); err == nil {
+		t.Error("want error for duplicate field")
+	}
+
+	bad := []string{
+		`<!DOCTYPE xml [<!ENTITY e "boom">]><xml><Encrypt>&e;</Encrypt></xml>`,
+		`<xml><Encrypt>&e;</Encrypt></xml>`,
+		strings.Repeat("<a>", maxXMLDepth+1) + strings.Repeat("</a>", maxXMLDepth+1),
+		`<xml></xml><xml></xml>`,
+		``,
+	}
+	for _, data := range bad {
+		if err := CheckXML([]byte(data)); err == nil {
+			t.Errorf("want error for %q", data)
+		}
+	}
+}
+
+func TestReadRequestBody(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+	if _, err := ReadRequestBody(r, 9); err == nil {
+		t.Error("want error for Content-Length > limit")
+	}
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+	r.ContentLength = -1
+	if _, err := ReadRequestBody(r, 9); err == nil {
+		t.Error("want error for body > limit")
+	} else if _, ok := err.(*RequestBodyTooLargeError); !ok {
+		t.Errorf("unexpected error type: %T", err)
+	}
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+	if body, err := ReadRequestBody(r, 10); err != nil || string(body) != "0123456789" {
+		t.Errorf("body: %q, err: %v", body, err)
+	}
+}
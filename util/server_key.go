@@ -0,0 +1,87 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 从回调请求中提取索引 server 的 key, 用于 mp.MultiWechatServerFrontend, corp.MultiAgentServerFrontend,
+// pay.MultiMessageServerFrontend 等多 server 的前端.
+//  urlValues 是已经解析好的 r.URL.RawQuery; 提取不到 key 的时候返回 error.
+type ServerKeyExtractor func(r *http.Request, urlValues url.Values) (serverKey string, err error)
+
+// 以回调 URL 上名称为 name 的查询参数作为 key, 比如 http://www.xxx.com/weixin?wechat_server=wechat1.
+func QueryServerKey(name string) ServerKeyExtractor {
+	return func(r *http.Request, urlValues url.Values) (serverKey string, err error) {
+		if serverKey = urlValues.Get(name); serverKey == "" {
+			err = fmt.Errorf("the url query value with name %s is empty", name)
+		}
+		return
+	}
+}
+
+// 以回调 URL 的 path 上 prefix 后面的第一段作为 key.
+//  比如 prefix 为 "/wx/", 那么 http://www.xxx.com/wx/appid1?signature=XXX 的 key 就是 appid1.
+func PathServerKey(prefix string) ServerKeyExtractor {
+	return func(r *http.Request, urlValues url.Values) (serverKey string, err error) {
+		path := r.URL.Path
+		if !strings.HasPrefix(path, prefix) {
+			return "", fmt.Errorf("the url path %q does not have prefix %q", path, prefix)
+		}
+		serverKey = path[len(prefix):]
+		if i := strings.IndexByte(serverKey, '/'); i >= 0 {
+			serverKey = serverKey[:i]
+		}
+		if serverKey == "" {
+			err = fmt.Errorf("the url path segment after prefix %q is empty", prefix)
+		}
+		return
+	}
+}
+
+// 以请求的 Host(去掉端口, 转换为小写) 作为 key, 比如 http://wechat1.xxx.com/weixin 的 key 就是 wechat1.xxx.com.
+//  NOTE: 如果在反向代理后面并且代理改写了 Host, 请使用 HeaderServerKey("X-Forwarded-Host").
+func HostServerKey() ServerKeyExtractor {
+	return func(r *http.Request, urlValues url.Values) (serverKey string, err error) {
+		serverKey = r.Host
+		if host, _, err := net.SplitHostPort(serverKey); err == nil {
+			serverKey = host
+		}
+		if serverKey = strings.ToLower(serverKey); serverKey == "" {
+			err = errors.New("the request host is empty")
+		}
+		return
+	}
+}
+
+// 以请求的名称为 name 的 header 作为 key, 一般由前面的反向代理设置.
+func HeaderServerKey(name string) ServerKeyExtractor {
+	return func(r *http.Request, urlValues url.Values) (serverKey string, err error) {
+		if serverKey = strings.TrimSpace(r.Header.Get(name)); serverKey == "" {
+			err = fmt.Errorf("the request header with name %s is empty", name)
+		}
+		return
+	}
+}
+
+// 依次尝试 extractors, 返回第一个提取到的 key; 都提取不到则返回最后一个 error.
+func FirstServerKey(extractors ...ServerKeyExtractor) ServerKeyExtractor {
+	return func(r *http.Request, urlValues url.Values) (serverKey string, err error) {
+		err = errors.New("no ServerKeyExtractor")
+		for _, extractor := range extractors {
+			if serverKey, err = extractor(r, urlValues); err == nil {
+				return
+			}
+		}
+		return "", err
+	}
+}
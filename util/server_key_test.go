@@ -0,0 +1,41 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerKeyExtractor(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://WX1.example.com:8080/wx/appid1/notify?wechat_server=wechat1", nil)
+	r.Header.Set("X-Wechat-Server", " header1 ")
+
+	tests := []struct {
+		extractor ServerKeyExtractor
+		want      string
+	}{
+		{QueryServerKey("wechat_server"), "wechat1"},
+		{QueryServerKey("other"), ""},
+		{PathServerKey("/wx/"), "appid1"},
+		{PathServerKey("/mp/"), ""},
+		{PathServerKey("/wx/appid1/notify"), ""},
+		{HostServerKey(), "wx1.example.com"},
+		{HeaderServerKey("X-Wechat-Server"), "header1"},
+		{HeaderServerKey("X-Other"), ""},
+		{FirstServerKey(PathServerKey("/mp/"), QueryServerKey("wechat_server")), "wechat1"},
+		{FirstServerKey(), ""},
+	}
+	for i, test := range tests {
+		have, err := test.extractor(r, r.URL.Query())
+		if have != test.want {
+			t.Errorf("test %d: have %q, want %q", i, have, test.want)
+		}
+		if (err == nil) != (test.want != "") {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+	}
+}
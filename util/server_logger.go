@@ -0,0 +1,79 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"net/http"
+	"time"
+)
+
+// 无效回调请求的处理接口, 和 mp.InvalidRequestHandler, corp.InvalidRequestHandler 一样, 它们之间可以直接赋值.
+type InvalidRequestHandler interface {
+	ServeInvalidRequest(w http.ResponseWriter, r *http.Request, err error)
+}
+
+type InvalidRequestHandlerFunc func(http.ResponseWriter, *http.Request, error)
+
+func (fn InvalidRequestHandlerFunc) ServeInvalidRequest(w http.ResponseWriter, r *http.Request, err error) {
+	fn(w, r, err)
+}
+
+// 在交给 InvalidRequestHandler 处理之前输出一条 Warn 日志.
+type loggingInvalidRequestHandler struct {
+	handler InvalidRequestHandler
+	logger  Logger
+	fields  []LogField
+}
+
+func (h loggingInvalidRequestHandler) ServeInvalidRequest(w http.ResponseWriter, r *http.Request, err error) {
+	fields := append(h.fields[:len(h.fields):len(h.fields)],
+		LogField{Key: "method", Value: r.Method},
+		LogField{Key: "remote_addr", Value: r.RemoteAddr},
+		LogField{Key: "error", Value: err}, // *SignatureError.Error() 不包含本地计算的签名
+	)
+	h.logger.Log(LogLevelWarn, "invalid request", fields...)
+	h.handler.ServeInvalidRequest(w, r, err)
+}
+
+// 返回在交给 handler 处理之前输出 Warn 日志的 InvalidRequestHandler, fields 是额外的字段(比如 appid);
+// 如果 logger 是 nil 或者 NopLogger 则直接返回 handler.
+func WithInvalidRequestLogger(handler InvalidRequestHandler, logger Logger, fields ...LogField) InvalidRequestHandler {
+	if logger == nil || logger == NopLogger {
+		return handler
+	}
+	return loggingInvalidRequestHandler{
+		handler: handler,
+		logger:  logger,
+		fields:  fields,
+	}
+}
+
+// 输出一条 MessageHandler 处理完消息的 Debug 日志, fields 是消息的字段, 后面会加上 latency.
+func LogMessageServed(logger Logger, start time.Time, fields ...LogField) {
+	if logger == nil || logger == NopLogger {
+		return
+	}
+	logger.Log(LogLevelDebug, "message served", append(fields, LogField{Key: "latency", Value: time.Since(start)})...)
+}
+
+// 输出一次 API 调用的日志, 成功是 Debug, 出错或者 errCode != 0 是 Warn.
+func LogAPICall(logger Logger, api, method string, start time.Time, errCode int, err error) {
+	fields := []LogField{
+		{Key: "api", Value: api},
+		{Key: "method", Value: method},
+		{Key: "latency", Value: time.Since(start)},
+	}
+	level := LogLevelDebug
+	if errCode != 0 {
+		level = LogLevelWarn
+		fields = append(fields, LogField{Key: "errcode", Value: errCode})
+	}
+	if err != nil {
+		level = LogLevelWarn
+		fields = append(fields, LogField{Key: "error", Value: err})
+	}
+	logger.Log(level, "api call", fields...)
+}
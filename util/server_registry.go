@@ -0,0 +1,224 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultNotFoundCacheTTL = 5 * time.Second // 不存在的 serverKey 的默认缓存时间, 参考 ServerRegistry.SetNotFoundCacheTTL
+	maxNotFoundCacheSize    = 10000           // 最多缓存的不存在的 serverKey 的数量
+)
+
+// 多 server 的前端找不到回调请求对应的 server, 对应的 HTTP 状态码是 404.
+type ServerNotFoundError struct {
+	Kind      string // server 的类型, 比如 WechatServer, AgentServer
+	ServerKey string
+}
+
+func (e *ServerNotFoundError) Error() string {
+	return fmt.Sprintf("Not found %s for serverKey == %s", e.Kind, e.ServerKey)
+}
+
+// 多 server 的前端加载回调请求对应的 server 失败, 一般是配置中心等暂时不可用, 对应的 HTTP 状态码是 503.
+type ServerResolveError struct {
+	Kind      string // server 的类型, 比如 WechatServer, AgentServer
+	ServerKey string
+	Err       error // resolver 返回的错误
+}
+
+func (e *ServerResolveError) Error() string {
+	return fmt.Sprintf("resolve %s for serverKey == %s failed: %s", e.Kind, e.ServerKey, e.Err.Error())
+}
+
+func (e *ServerResolveError) Unwrap() error {
+	return e.Err
+}
+
+// 加载 serverKey 对应的 server, server == nil && err == nil 表示不存在.
+type ServerResolverFunc func(serverKey string) (server interface{}, err error)
+
+// 正在进行中的 resolver 调用, 同一个 serverKey 同时只调用一次.
+type serverResolveCall struct {
+	wg     sync.WaitGroup
+	server interface{}
+	err    error
+}
+
+// mp.MultiWechatServerFrontend, corp.MultiAgentServerFrontend, pay.MultiMessageServerFrontend 共用的
+// serverKey-server 注册表, 零值可以直接使用, 并发安全.
+//  找不到 serverKey 对应的 server 的时候调用 resolver 加载, 加载成功的 server 会缓存起来, 后面的请求不再调用 resolver;
+//  不存在的 serverKey 缓存一小段时间, 避免无效的回调请求每次都调用 resolver; 加载出错不缓存.
+type ServerRegistry struct {
+	rwmutex          sync.RWMutex
+	servers          map[string]interface{}
+	resolver         ServerResolverFunc
+	notFoundCacheTTL time.Duration
+	notFound         map[string]time.Time // 不存在的 serverKey -> 缓存的过期时间
+	resolveCalls     map[string]*serverResolveCall
+
+	now func() time.Time // 测试用
+}
+
+// 设置 serverKey-server pair, 如果 serverKey == "" 或者 server == nil 则不做任何操作.
+func (registry *ServerRegistry) Set(serverKey string, server interface{}) {
+	if serverKey == "" || server == nil {
+		return
+	}
+
+	registry.rwmutex.Lock()
+	defer registry.rwmutex.Unlock()
+
+	if registry.servers == nil {
+		registry.servers = make(map[string]interface{})
+	}
+	registry.servers[serverKey] = server
+	delete(registry.notFound, serverKey)
+}
+
+// 删除 serverKey 对应的 server.
+func (registry *ServerRegistry) Delete(serverKey string) {
+	registry.rwmutex.Lock()
+	defer registry.rwmutex.Unlock()
+
+	delete(registry.servers, serverKey)
+}
+
+// 删除所有的 server.
+func (registry *ServerRegistry) DeleteAll() {
+	registry.rwmutex.Lock()
+	defer registry.rwmutex.Unlock()
+
+	registry.servers = make(map[string]interface{})
+}
+
+// 设置 resolver, resolver == nil 表示不加载(默认); 同时清除不存在的 serverKey 的缓存.
+func (registry *ServerRegistry) SetResolver(resolver ServerResolverFunc) {
+	registry.rwmutex.Lock()
+	defer registry.rwmutex.Unlock()
+
+	registry.resolver = resolver
+	registry.notFound = nil
+}
+
+// 设置 resolver 返回不存在的 serverKey 的缓存时间, ttl == 0 表示使用 DefaultNotFoundCacheTTL(默认), ttl < 0 表示不缓存.
+func (registry *ServerRegistry) SetNotFoundCacheTTL(ttl time.Duration) {
+	registry.rwmutex.Lock()
+	defer registry.rwmutex.Unlock()
+
+	registry.notFoundCacheTTL = ttl
+	registry.notFound = nil
+}
+
+// 获取 serverKey 对应的 server, 没有的话通过 resolver 加载; server == nil && err == nil 表示不存在.
+func (registry *ServerRegistry) Get(serverKey string) (server interface{}, err error) {
+	now := time.Now()
+	if registry.now != nil {
+		now = registry.now()
+	}
+
+	registry.rwmutex.RLock()
+	server = registry.servers[serverKey]
+	resolver := registry.resolver
+	notFoundExpiresAt, notFound := registry.notFound[serverKey]
+	registry.rwmutex.RUnlock()
+
+	if server != nil || resolver == nil {
+		return
+	}
+	if notFound && now.Before(notFoundExpiresAt) {
+		return
+	}
+
+	registry.rwmutex.Lock()
+	if server = registry.servers[serverKey]; server != nil {
+		registry.rwmutex.Unlock()
+		return
+	}
+	if call := registry.resolveCalls[serverKey]; call != nil {
+		registry.rwmutex.Unlock()
+		call.wg.Wait()
+		return call.server, call.err
+	}
+	call := new(serverResolveCall)
+	call.wg.Add(1)
+	if registry.resolveCalls == nil {
+		registry.resolveCalls = make(map[string]*serverResolveCall)
+	}
+	registry.resolveCalls[serverKey] = call
+	registry.rwmutex.Unlock()
+
+	defer func() {
+		registry.rwmutex.Lock()
+		delete(registry.resolveCalls, serverKey)
+		switch {
+		case call.err != nil:
+		case call.server != nil:
+			if registry.servers == nil {
+				registry.servers = make(map[string]interface{})
+			}
+			registry.servers[serverKey] = call.server
+			delete(registry.notFound, serverKey)
+		default:
+			registry.cacheNotFoundLocked(serverKey, now)
+		}
+		registry.rwmutex.Unlock()
+		call.wg.Done()
+	}()
+
+	call.server, call.err = resolver(serverKey)
+	return call.server, call.err
+}
+
+// 缓存不存在的 serverKey, 缓存满了的时候先删除过期的, 还是满的则不缓存.
+func (registry *ServerRegistry) cacheNotFoundLocked(serverKey string, now time.Time) {
+	ttl := registry.notFoundCacheTTL
+	if ttl == 0 {
+		ttl = DefaultNotFoundCacheTTL
+	}
+	if ttl < 0 {
+		return
+	}
+
+	if registry.notFound == nil {
+		registry.notFound = make(map[string]time.Time)
+	}
+	if len(registry.notFound) >= maxNotFoundCacheSize {
+		for key, expiresAt := range registry.notFound {
+			if !now.Before(expiresAt) {
+				delete(registry.notFound, key)
+			}
+		}
+		if len(registry.notFound) >= maxNotFoundCacheSize {
+			return
+		}
+	}
+	registry.notFound[serverKey] = now.Add(ttl)
+}
+
+// 多 server 前端的 ServeHTTP 的公共部分: 解析查询参数, 通过 extractor 提取 serverKey, 然后查找 serverKey 对应的 server.
+//  kind 是 server 的类型, 用于错误信息; 找不到返回 *ServerNotFoundError, resolver 出错返回 *ServerResolveError.
+func (registry *ServerRegistry) Lookup(r *http.Request, extractor ServerKeyExtractor, kind string) (server interface{}, urlValues url.Values, err error) {
+	if urlValues, err = url.ParseQuery(r.URL.RawQuery); err != nil {
+		return
+	}
+	serverKey, err := extractor(r, urlValues)
+	if err != nil {
+		return
+	}
+	if server, err = registry.Get(serverKey); err != nil {
+		return nil, nil, &ServerResolveError{Kind: kind, ServerKey: serverKey, Err: err}
+	}
+	if server == nil {
+		return nil, nil, &ServerNotFoundError{Kind: kind, ServerKey: serverKey}
+	}
+	return
+}
@@ -0,0 +1,46 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerRegistryNotFoundCache(t *testing.T) {
+	now := time.Unix(1420000000, 0)
+	var registry ServerRegistry
+	registry.now = func() time.Time { return now }
+
+	resolved := 0
+	registry.SetResolver(func(serverKey string) (interface{}, error) {
+		resolved++
+		return nil, nil
+	})
+
+	get := func(wantResolved int) {
+		t.Helper()
+		if server, err := registry.Get("unknown"); server != nil || err != nil {
+			t.Fatalf("server: %v, err: %v", server, err)
+		}
+		if resolved != wantResolved {
+			t.Errorf("resolved mismatch, have: %d, want: %d", resolved, wantResolved)
+		}
+	}
+
+	get(1)
+	get(1)
+	now = now.Add(DefaultNotFoundCacheTTL)
+	get(2)
+
+	// 设置之后不再是不存在的
+	registry.Set("unknown", "server")
+	if server, _ := registry.Get("unknown"); server != "server" {
+		t.Errorf("server mismatch, have: %v", server)
+	}
+	registry.Delete("unknown")
+	get(3)
+}
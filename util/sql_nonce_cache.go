@@ -0,0 +1,99 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sqlNonceCacheCleanupInterval = time.Minute // 清理过期记录的间隔
+
+var _ NonceCache = new(SQLNonceCache)
+
+// 基于关系数据库的 NonceCache, 用于多台机器上的多个进程.
+//  需要先创建下面的表(表名可以自定义, MySQL 的语法, 其他数据库请相应修改):
+//
+//  CREATE TABLE wechat_nonce (
+//      nonce_key  VARCHAR(255) NOT NULL PRIMARY KEY,
+//      expires_at BIGINT       NOT NULL DEFAULT 0 -- unix 时间戳, 毫秒
+//  );
+//
+//  通过主键的唯一性保证原子性, 过期的记录每分钟最多清理一次.
+type SQLNonceCache struct {
+	db    *sql.DB
+	table string
+
+	// 返回第 n 个(从 1 开始)参数的占位符, 默认是 "?";
+	// PostgreSQL 请设置为 func(n int) string { return "$" + strconv.Itoa(n) }.
+	//  请在使用之前设置.
+	Placeholder func(n int) string
+
+	mutex       sync.Mutex
+	lastCleanup time.Time
+}
+
+// 创建一个新的 SQLNonceCache, table 是保存 nonce 的表名.
+func NewSQLNonceCache(db *sql.DB, table string) *SQLNonceCache {
+	return &SQLNonceCache{
+		db:    db,
+		table: table,
+	}
+}
+
+// 把 query 里的 "?" 替换为 cache.Placeholder 返回的占位符, 并且把 "{table}" 替换为表名.
+func (cache *SQLNonceCache) query(query string) string {
+	query = strings.Replace(query, "{table}", cache.table, -1)
+	if cache.Placeholder == nil {
+		return query
+	}
+	var buf strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			buf.WriteString(cache.Placeholder(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func (cache *SQLNonceCache) Add(key string, ttl time.Duration) (added bool, err error) {
+	now := time.Now()
+	nowMsec := now.UnixNano() / int64(time.Millisecond)
+	cache.cleanup(now, nowMsec)
+
+	// 先删除过期的同一个 key, 然后插入; 插入失败说明 key 还没有过期(或者数据库出错了)
+	if _, err = cache.db.Exec(cache.query("DELETE FROM {table} WHERE nonce_key = ? AND expires_at <= ?"), key, nowMsec); err != nil {
+		return
+	}
+	expiresAt := now.Add(ttl).UnixNano() / int64(time.Millisecond)
+	if _, err = cache.db.Exec(cache.query("INSERT INTO {table} (nonce_key, expires_at) VALUES (?, ?)"), key, expiresAt); err != nil {
+		var n int
+		if err2 := cache.db.QueryRow(cache.query("SELECT COUNT(*) FROM {table} WHERE nonce_key = ?"), key).Scan(&n); err2 == nil && n > 0 {
+			return false, nil
+		}
+		return
+	}
+	return true, nil
+}
+
+// 删除所有过期的记录, sqlNonceCacheCleanupInterval 之内最多执行一次.
+func (cache *SQLNonceCache) cleanup(now time.Time, nowMsec int64) {
+	cache.mutex.Lock()
+	if now.Sub(cache.lastCleanup) < sqlNonceCacheCleanupInterval {
+		cache.mutex.Unlock()
+		return
+	}
+	cache.lastCleanup = now
+	cache.mutex.Unlock()
+
+	cache.db.Exec(cache.query("DELETE FROM {table} WHERE expires_at <= ?"), nowMsec)
+}
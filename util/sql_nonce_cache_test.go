@@ -0,0 +1,221 @@
+// @description wechat2 是腾讯微信公众平台 api 的 golang 语言封装
+// @link        https://github.com/philsong/wechat2 for the canonical source repository
+// @license     https://github.com/philsong/wechat2/blob/master/LICENSE
+// @authors     chanxuehong(chanxuehong@gmail.com)
+
+package util
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的 database/sql 驱动, 只支持 SQLNonceCache 用到的几条语句, 数据保存在内存里.
+//  DSN 作为数据库的名字, 同一个 DSN 的连接共享数据.
+type fakeNonceDriver struct {
+	mutex sync.Mutex
+	dbs   map[string]*fakeNonceDB
+}
+
+type fakeNonceDB struct {
+	mutex sync.Mutex
+	rows  map[string]int64 // nonce_key -> expires_at
+}
+
+var fakeDriver = &fakeNonceDriver{dbs: make(map[string]*fakeNonceDB)}
+
+func init() {
+	sql.Register("util_fake_nonce", fakeDriver)
+}
+
+func (d *fakeNonceDriver) Open(name string) (driver.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	db := d.dbs[name]
+	if db == nil {
+		db = &fakeNonceDB{rows: make(map[string]int64)}
+		d.dbs[name] = db
+	}
+	return &fakeNonceConn{db: db}, nil
+}
+
+type fakeNonceConn struct {
+	db *fakeNonceDB
+}
+
+func (c *fakeNonceConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeNonceStmt{db: c.db, query: placeholderRegexp.ReplaceAllString(query, "?")}, nil
+}
+func (c *fakeNonceConn) Close() error              { return nil }
+func (c *fakeNonceConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+// PostgreSQL 风格的占位符统一成 "?"
+var placeholderRegexp = regexp.MustCompile(`\$[0-9]+`)
+
+type fakeNonceStmt struct {
+	db    *fakeNonceDB
+	query string
+}
+
+func (s *fakeNonceStmt) Close() error  { return nil }
+func (s *fakeNonceStmt) NumInput() int { return -1 }
+
+func (s *fakeNonceStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mutex.Lock()
+	defer s.db.mutex.Unlock()
+
+	switch s.query {
+	case "DELETE FROM wechat_nonce WHERE nonce_key = ? AND expires_at <= ?":
+		key := args[0].(string)
+		if expiresAt, ok := s.db.rows[key]; ok && expiresAt <= args[1].(int64) {
+			delete(s.db.rows, key)
+			return driver.RowsAffected(1), nil
+		}
+		return driver.RowsAffected(0), nil
+
+	case "INSERT INTO wechat_nonce (nonce_key, expires_at) VALUES (?, ?)":
+		key := args[0].(string)
+		if _, ok := s.db.rows[key]; ok {
+			return nil, errors.New("duplicate primary key")
+		}
+		s.db.rows[key] = args[1].(int64)
+		return driver.RowsAffected(1), nil
+
+	case "DELETE FROM wechat_nonce WHERE expires_at <= ?":
+		n := int64(0)
+		for key, expiresAt := range s.db.rows {
+			if expiresAt <= args[0].(int64) {
+				delete(s.db.rows, key)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	return nil, fmt.Errorf("unsupported statement: %s", s.query)
+}
+
+func (s *fakeNonceStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mutex.Lock()
+	defer s.db.mutex.Unlock()
+
+	if s.query != "SELECT COUNT(*) FROM wechat_nonce WHERE nonce_key = ?" {
+		return nil, fmt.Errorf("unsupported query: %s", s.query)
+	}
+	n := int64(0)
+	if _, ok := s.db.rows[args[0].(string)]; ok {
+		n = 1
+	}
+	return &fakeNonceRows{values: [][]driver.Value{{n}}}, nil
+}
+
+type fakeNonceRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeNonceRows) Columns() []string { return []string{"COUNT(*)"} }
+func (r *fakeNonceRows) Close() error      { return nil }
+
+func (r *fakeNonceRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// 每个测试使用单独的数据库
+var fakeDBCount int
+
+func newFakeSQLNonceCache(t *testing.T) (*SQLNonceCache, *fakeNonceDB) {
+	fakeDriver.mutex.Lock()
+	fakeDBCount++
+	dsn := "db" + strconv.Itoa(fakeDBCount)
+	fakeDriver.mutex.Unlock()
+
+	db, err := sql.Open("util_fake_nonce", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeDriver.mutex.Lock()
+	defer fakeDriver.mutex.Unlock()
+	return NewSQLNonceCache(db, "wechat_nonce"), fakeDriver.dbs[dsn]
+}
+
+func TestSQLNonceCache(t *testing.T) {
+	for _, postgres := range []bool{false, true} {
+		cache, _ := newFakeSQLNonceCache(t)
+		if postgres {
+			cache.Placeholder = func(n int) string { return "$" + strconv.Itoa(n) }
+		}
+
+		add := func(key string, ttl time.Duration, want bool) {
+			t.Helper()
+			added, err := cache.Add(key, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != want {
+				t.Errorf("Add(%q) mismatch, have: %t, want: %t", key, added, want)
+			}
+		}
+
+		add("a", time.Minute, true)
+		add("a", time.Minute, false)
+		add("b", time.Millisecond, true)
+
+		// 过期的 key 可以再次添加
+		time.Sleep(5 * time.Millisecond)
+		add("b", time.Minute, true)
+		add("b", time.Minute, false)
+	}
+}
+
+func TestSQLNonceCacheCleanup(t *testing.T) {
+	cache, db := newFakeSQLNonceCache(t)
+
+	if _, err := cache.Add("a", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// 距离上次清理不到 sqlNonceCacheCleanupInterval, 不清理
+	if _, err := cache.Add("b", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	db.mutex.Lock()
+	_, ok := db.rows["a"]
+	db.mutex.Unlock()
+	if !ok {
+		t.Fatal("a should not be cleaned up yet")
+	}
+
+	cache.mutex.Lock()
+	cache.lastCleanup = time.Time{}
+	cache.mutex.Unlock()
+	if _, err := cache.Add("c", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.rows["a"]; ok {
+		t.Error("expired a should be cleaned up")
+	}
+	if len(db.rows) != 2 {
+		t.Errorf("rows mismatch, have: %d, want: 2", len(db.rows))
+	}
+}